@@ -1,10 +1,13 @@
 package pproxy
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"io"
 	"net"
 	"strings"
+	"time"
 )
 
 // ProxyInterface ...
@@ -19,42 +22,244 @@ type ProxyInterface interface {
 type PProxy struct {
 	Client net.Conn
 	PI     ProxyInterface
+	Router *Router // 二级代理路由，nil使用默认路由
+	Pool   *Pool   // 普通HTTP转发连接池，nil不在会话间复用
 
-	DebugRead  func(conn net.Conn, bs []byte)
+	Interceptor   *Interceptor   // TLS拦截，nil不拦截
+	Middlewares   []Middleware   // 普通HTTP转发和TLS拦截的请求/响应修改
+	Capture       *Capture       // 抓包，nil不抓
+	Observer      Observer       // 会话事件，nil不通知
+	ProxyProtocol *ProxyProtocol // 接收PROXY protocol头，nil不接收
+	Shadowsocks   *Shadowsocks   // Shadowsocks入站，nil按SOCKS5/HTTP处理
+	Hop           *Hop           // 节点间协议入站和pproxy://二级代理，nil不接受
+	TLS           *tls.Config    // TLS入站，解密后再探测协议，nil不接受；不能和Hop.TLS同时设置
+	Inbounds      []string       // 启用的入站协议名，按顺序探测，nil为全部注册的协议
+	AuthSchemes   []string       // HTTP入站接受并在407中质询的认证方式 AuthBasic/AuthDigest/AuthBearer，nil只有Basic
+	UpstreamTLS   *tls.Config    // https://二级代理的TLS设置，nil使用系统根证书，ServerName为空时取二级代理的主机名
+
+	h2         bool      // HTTP/2 CONNECT流
+	deadline   time.Time // 二级代理连接超时，健康检查用
+	ctx        context.Context
+	dialed     func(conn net.Conn) // 连接目标或二级代理后回调，Dialer取消时关闭
+	session    *Session
+	route      *Route
+	source     net.IP   // 固定出口地址，会话共用的多路复用连接用
+	onClose    []func() // 服务端连接关闭时回调
+	authFailed bool     // OnAuth返回错误，HTTP入站回复407
+	succeeded  bool     // 已发送TunnelEstablished，关闭时才发送TunnelClosed
+	accepted   net.Conn // 回调PI的客户端连接：调用方传入的连接，有PROXY头时为带头中地址的连接；探测和TLS入站不改变
+
+	// Deprecated: 使用Observer的EventRead
+	DebugRead func(conn net.Conn, bs []byte)
+	// Deprecated: 使用Observer的EventWrite
 	DebugWrite func(conn net.Conn, bs []byte)
 }
 
 // Handshake ...
 func (o *PProxy) Handshake() (conn net.Conn, err error) {
-	// check socks5/http
-	prefix := make([]byte, 1)
-	if _, err = o.Client.Read(prefix); err != nil {
+	o.newSession()
+	defer func() {
+		if err != nil {
+			o.emit(&Event{Type: EventError, Err: err})
+		}
+	}()
+
+	// 负载均衡发送的PROXY头
+	if o.ProxyProtocol != nil {
+		if err = o.readProxyHeader(); err != nil {
+			return
+		}
+	}
+
+	if o.Shadowsocks != nil {
+		o.session.Protocol = "ss"
+		o.emit(&Event{Type: EventHandshakeStart})
+		return o.handshakeSS()
+	}
+
+	// 按注册的入站协议探测
+	var in *Inbound
+	if in, err = o.sniff(); err != nil {
 		return
 	}
+	o.session.Protocol = in.Name
+	if in.Name == "http" && o.h2 {
+		o.session.Protocol = "h2"
+	}
+	o.emit(&Event{Type: EventHandshakeStart})
 
-	switch prefix[0] {
-	case 0x5:
-		conn, err = o.handshakeSocks5(prefix)
-	default:
-		conn, err = o.handshakeHTTP(prefix)
+	return in.Handshake(o)
+}
+
+func (o *PProxy) newSession() {
+	o.accepted = o.Client
+	o.session = &Session{
+		ID:         newSessionID(),
+		Start:      time.Now(),
+		ClientAddr: o.Client.RemoteAddr().String(),
 	}
+	o.session.TraceID = o.session.ID
+}
+
+// 回调OnAuth
+func (o *PProxy) onAuth(user, password string) (newAuth string, err error) {
+	return o.onCredential(&Credential{Scheme: AuthBasic, User: user, Password: password})
+}
 
+// 回调OnCredential，没有实现时Basic回调OnAuth
+func (o *PProxy) onCredential(c *Credential) (newAuth string, err error) {
+	o.session.User = c.User
+	o.emit(&Event{Type: EventAuthAttempt})
+	if ca, ok := o.PI.(CredentialAuth); ok {
+		newAuth, err = ca.OnCredential(o.clientConn(), c)
+	} else if c.Scheme == AuthBasic {
+		newAuth, err = o.PI.OnAuth(o.clientConn(), c.User, c.Password)
+	} else {
+		err = errors.New("auth scheme not supported: " + c.Scheme)
+	}
+	o.authFailed = err != nil
+	o.emit(&Event{Type: EventAuthResult, Err: err})
 	return
 }
 
-// 二级代理
+// Connect 自定义入站协议用：OnAuth后按返回值经二级代理或直接连接target
+// ready在连接成功后发送协议的成功应答，可以为nil；返回前已回调OnSuccess
+func (o *PProxy) Connect(user, password, target string, ready func() error) (conn net.Conn, err error) {
+	o.session.Target = target
+
+	var newAuth string
+	if newAuth, err = o.onAuth(user, password); err != nil {
+		return
+	}
+	if newAuth != "" {
+		if conn, err = o.level2(connectInfo(target), newAuth); err != nil {
+			return
+		}
+	}
+	if conn == nil {
+		if conn, err = o.dialTCP(target); err != nil {
+			return
+		}
+	}
+	conn = o.wrapConn(conn)
+	defer func() {
+		if err != nil && conn != nil {
+			conn.Close()
+		}
+	}()
+
+	if ready != nil {
+		if err = ready(); err != nil {
+			return
+		}
+	}
+	if conn, err = o.intercept(conn); err != nil {
+		return
+	}
+	o.success(conn)
+	return
+}
+
+// Session 当前会话信息
+func (o *PProxy) Session() *Session {
+	return o.session
+}
+
+// 二级代理，newAuth可以是多个候选地址或route:name
 func (o *PProxy) level2(info *httpProxyInfo, newAuth string) (conn net.Conn, err error) {
-	if strings.HasPrefix(newAuth, "socks5") {
-		conn, err = o.socks5Level2(info, newAuth)
-	} else if strings.HasPrefix(newAuth, "http") {
-		conn, err = o.httpLevel2(info, newAuth)
-	} else {
-		return nil, errors.New("unknown level2 protocol")
+	var route *Route
+	if route, err = o.resolveRoute(newAuth); err != nil {
+		return
 	}
 
+	return o.router().dial(o, info, route)
+}
+
+func (o *PProxy) router() *Router {
+	if o.Router == nil {
+		return defaultRouter
+	}
+	return o.Router
+}
+
+// 解析OnAuth返回的二级代理，记录当前路由
+func (o *PProxy) resolveRoute(newAuth string) (route *Route, err error) {
+	if route, err = o.router().Resolve(newAuth); err != nil {
+		return
+	}
+	o.route = route
+	return
+}
+
+// 单个二级代理
+func (o *PProxy) level2One(info *httpProxyInfo, newAuth string) (conn net.Conn, err error) {
+	if strings.Contains(newAuth, ChainSep) {
+		return o.chainLevel2(info, newAuth)
+	}
+	return o.dialUpstream(info, newAuth, nil)
+}
+
+// 连接目标或二级代理服务器
+func (o *PProxy) dialTCP(addr string) (conn net.Conn, err error) {
+	start := time.Now()
+	d := &net.Dialer{Deadline: o.deadline}
+	var ip net.IP
+	if ip, err = o.sourceIP(addr); err != nil {
+		return
+	}
+	if ip != nil {
+		d.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+	if conn, err = d.DialContext(o.context(), "tcp", addr); err != nil {
+		return
+	}
+	if o.dialed != nil {
+		o.dialed(conn)
+	}
+	if !o.deadline.IsZero() {
+		conn.SetDeadline(o.deadline)
+	}
+
+	if o.session != nil {
+		o.emit(&Event{Type: EventUpstreamDialed, Upstream: o.session.Upstream, Addr: addr, Duration: time.Since(start)})
+	}
 	return
 }
 
+// 连接和协商使用的ctx，Dialer调用时为DialContext的ctx
+func (o *PProxy) context() context.Context {
+	if o.ctx != nil {
+		return o.ctx
+	}
+	return context.Background()
+}
+
+// 调试连接，读写时回调DebugRead/DebugWrite
+type debugConn struct {
+	net.Conn
+	pp *PProxy
+}
+
+func (o *debugConn) Read(b []byte) (n int, err error) {
+	n, err = o.Conn.Read(b)
+	if n > 0 {
+		o.pp.debugRead(PhaseHTTP, o.Conn, b[:n])
+	}
+	return
+}
+
+func (o *debugConn) Write(b []byte) (n int, err error) {
+	o.pp.debugWrite(PhaseHTTP, o.Conn, b)
+	return o.Conn.Write(b)
+}
+
+func (o *PProxy) debugConn(conn net.Conn) net.Conn {
+	if o.DebugRead == nil && o.DebugWrite == nil && o.Observer == nil {
+		return conn
+	}
+	return &debugConn{Conn: conn, pp: o}
+}
+
 // CopyHelper io.Copy helper
 func CopyHelper(a, b net.Conn) {
 	go func() {
@@ -0,0 +1,268 @@
+package pproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 访问日志格式
+const (
+	LogJSON = "json" // JSON Lines
+	LogCLF  = "clf"  // Common Log Format
+)
+
+// 访问日志结果码，参照HTTP状态码
+const (
+	CodeOK             = 200 // 代理成功
+	CodeAuthFailed     = 407 // 账号验证失败
+	CodeUpstreamFailed = 502 // 二级代理全部失败
+	CodeError          = 500 // 其他错误
+)
+
+// AccessRecord 一个会话的访问日志
+type AccessRecord struct {
+	Time       time.Time `json:"time"`
+	ID         string    `json:"id"`
+	TraceID    string    `json:"trace,omitempty"`
+	ClientAddr string    `json:"client"`
+	Protocol   string    `json:"protocol"`
+	User       string    `json:"user"`
+	Target     string    `json:"target"`
+	Route      string    `json:"route,omitempty"`
+	Upstream   string    `json:"upstream,omitempty"` // 选中的二级代理，不含账号密码
+	Tried      []string  `json:"tried,omitempty"`    // 依次尝试的二级代理
+	SourceIP   string    `json:"source,omitempty"`   // 出口地址
+	Code       int       `json:"code"`
+	Error      string    `json:"error,omitempty"`
+	BytesUp    int64     `json:"bytes_up"`
+	BytesDown  int64     `json:"bytes_down"`
+	Duration   float64   `json:"duration_ms"`
+}
+
+// AccessLog 每个会话结束时记录一条访问日志，作为Observer使用
+// 多个PProxy共享同一个AccessLog
+type AccessLog struct {
+	Format string              // LogJSON/LogCLF，默认LogJSON
+	Writer io.Writer           // 日志输出，例如os.Stdout、RotateFile
+	Func   func(*AccessRecord) // 回调，可与Writer同时使用
+
+	mu       sync.Mutex
+	sessions sync.Map // 会话ID => 尝试的二级代理和验证结果
+}
+
+type accessState struct {
+	mu          sync.Mutex
+	tried       []string
+	authFailed  bool
+	established bool
+}
+
+func (o *accessState) isEstablished() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.established
+}
+
+func (o *AccessLog) state(s *Session) *accessState {
+	v, _ := o.sessions.LoadOrStore(s.ID, &accessState{})
+	return v.(*accessState)
+}
+
+// OnEvent ...
+func (o *AccessLog) OnEvent(e *Event) {
+	switch e.Type {
+	case EventAuthResult:
+		if e.Err != nil {
+			st := o.state(e.Session)
+			st.mu.Lock()
+			st.authFailed = true
+			st.mu.Unlock()
+		}
+	case EventRouteChosen:
+		st := o.state(e.Session)
+		st.mu.Lock()
+		st.tried = append(st.tried, redactUpstream(e.Upstream))
+		st.mu.Unlock()
+	case EventTunnelEstablished:
+		st := o.state(e.Session)
+		st.mu.Lock()
+		st.established = true
+		st.mu.Unlock()
+	case EventTunnelClosed:
+		// 每个会话一条记录，没有建立的会话由EventError记录
+		if v, ok := o.sessions.Load(e.Session.ID); ok && v.(*accessState).isEstablished() {
+			o.log(e, CodeOK)
+		} else {
+			o.sessions.Delete(e.Session.ID)
+		}
+	case EventError:
+		if e.Upstream == "" {
+			o.log(e, CodeError)
+		}
+	}
+}
+
+func (o *AccessLog) log(e *Event, code int) {
+	s := e.Session
+	r := &AccessRecord{
+		Time:       e.Time,
+		ID:         s.ID,
+		TraceID:    s.TraceID,
+		ClientAddr: s.ClientAddr,
+		Protocol:   s.Protocol,
+		User:       s.User,
+		Target:     s.Target,
+		Route:      s.Route,
+		SourceIP:   s.SourceIP,
+		Code:       code,
+		BytesUp:    e.BytesUp,
+		BytesDown:  e.BytesDown,
+		Duration:   float64(e.Elapsed) / float64(time.Millisecond),
+	}
+	if s.Upstream != "" {
+		r.Upstream = redactUpstream(s.Upstream)
+	}
+	if v, ok := o.sessions.Load(s.ID); ok {
+		o.sessions.Delete(s.ID)
+		st := v.(*accessState)
+		st.mu.Lock()
+		r.Tried = st.tried
+		if code != CodeOK {
+			if st.authFailed {
+				r.Code = CodeAuthFailed
+			} else if r.Upstream == "" && len(st.tried) > 0 {
+				r.Code = CodeUpstreamFailed
+			}
+		}
+		st.mu.Unlock()
+	}
+	if e.Err != nil {
+		r.Error = e.Err.Error()
+	}
+
+	if o.Writer != nil {
+		line := r.JSON()
+		if o.Format == LogCLF {
+			line = r.CLF()
+		}
+		o.mu.Lock()
+		o.Writer.Write(line)
+		o.mu.Unlock()
+	}
+	if o.Func != nil {
+		o.Func(r)
+	}
+}
+
+// JSON JSON Lines格式
+func (o *AccessRecord) JSON() []byte {
+	bs, _ := json.Marshal(o)
+	return append(bs, '\n')
+}
+
+// CLF Common Log Format，请求行为 "协议 目标 二级代理"
+func (o *AccessRecord) CLF() []byte {
+	host := o.ClientAddr
+	if i := strings.LastIndex(host, ":"); i > 0 {
+		host = strings.Trim(host[:i], "[]")
+	}
+	user := o.User
+	if user == "" {
+		user = "-"
+	}
+	upstream := o.Upstream
+	if upstream == "" {
+		upstream = "direct"
+	}
+	size := "-"
+	if o.BytesDown > 0 {
+		size = strconv.FormatInt(o.BytesDown, 10)
+	}
+	return []byte(fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %s\n",
+		host, user, o.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		strings.ToUpper(o.Protocol), o.Target, upstream, o.Code, size))
+}
+
+// RotateFile 按大小切割的日志文件，name.1为最近切割的文件
+type RotateFile struct {
+	Name       string // 文件名
+	MaxSize    int64  // 单个文件最大字节，0不切割
+	MaxBackups int    // 保留的切割文件数量，默认1
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// NewRotateFile ...
+func NewRotateFile(name string, maxSize int64, maxBackups int) *RotateFile {
+	return &RotateFile{Name: name, MaxSize: maxSize, MaxBackups: maxBackups}
+}
+
+func (o *RotateFile) open() (err error) {
+	if o.f, err = os.OpenFile(o.Name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+		return
+	}
+	info, err := o.f.Stat()
+	if err != nil {
+		o.f.Close()
+		o.f = nil
+		return
+	}
+	o.size = info.Size()
+	return
+}
+
+func (o *RotateFile) rotate() error {
+	o.f.Close()
+	o.f = nil
+	backups := o.MaxBackups
+	if backups <= 0 {
+		backups = 1
+	}
+	os.Remove(o.Name + "." + strconv.Itoa(backups))
+	for i := backups - 1; i > 0; i-- {
+		os.Rename(o.Name+"."+strconv.Itoa(i), o.Name+"."+strconv.Itoa(i+1))
+	}
+	if err := os.Rename(o.Name, o.Name+".1"); err != nil {
+		return err
+	}
+	return o.open()
+}
+
+// Write ...
+func (o *RotateFile) Write(b []byte) (n int, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.f == nil {
+		if err = o.open(); err != nil {
+			return
+		}
+	}
+	if o.MaxSize > 0 && o.size > 0 && o.size+int64(len(b)) > o.MaxSize {
+		if err = o.rotate(); err != nil {
+			return
+		}
+	}
+	n, err = o.f.Write(b)
+	o.size += int64(n)
+	return
+}
+
+// Close ...
+func (o *RotateFile) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.f == nil {
+		return nil
+	}
+	err := o.f.Close()
+	o.f = nil
+	return err
+}
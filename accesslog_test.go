@@ -0,0 +1,114 @@
+package pproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 拒绝所有账号
+type denyAll struct{ allowAll }
+
+func (o *denyAll) OnAuth(conn net.Conn, user, password string) (string, error) {
+	return "", errors.New("denied")
+}
+
+// go test pproxy -run Test_AccessLog -v -count=1
+func Test_AccessLog(t *testing.T) {
+	echo := startEcho(t)
+	good := startProxy(t, &allowAll{}, nil)
+	dead := deadAddr(t)
+
+	records := make(chan *AccessRecord, 4)
+	var buf bytes.Buffer
+	alog := &AccessLog{Format: LogCLF, Writer: &buf, Func: func(r *AccessRecord) { records <- r }}
+	next := func() *AccessRecord {
+		select {
+		case r := <-records:
+			return r
+		case <-time.After(time.Second * 3):
+			t.Fatal("no record")
+		}
+		return nil
+	}
+
+	p1 := startProxy(t, &allowAll{level2: "http://a:b@" + dead + ",http://a:b@" + good}, func(pp *PProxy) { pp.Observer = alog })
+	if err := connectEcho(p1, echo); err != nil {
+		t.Fatal(err)
+	}
+	r := next()
+	if r.Code != CodeOK || r.User != "x" || r.Target != echo || r.Protocol != "http" || r.Upstream != "http://"+good ||
+		len(r.Tried) != 2 || r.BytesUp != 4 || r.BytesDown != 4 || r.ID == "" {
+		t.Fatal(string(r.JSON()))
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(r.JSON(), &m); err != nil || m["bytes_up"] != 4.0 {
+		t.Fatal(err, m)
+	}
+	if !strings.Contains(buf.String(), ` - x [`) || !strings.HasSuffix(buf.String(), `] "HTTP `+echo+` http://`+good+`" 200 4`+"\n") {
+		t.Fatal(buf.String())
+	}
+
+	p2 := startProxy(t, &denyAll{}, func(pp *PProxy) { pp.Observer = alog })
+	connectEcho(p2, echo)
+	if r = next(); r.Code != CodeAuthFailed || r.Error == "" {
+		t.Fatal(string(r.JSON()))
+	}
+
+	p3 := startProxy(t, &allowAll{level2: "http://a:b@" + dead}, func(pp *PProxy) { pp.Observer = alog })
+	connectEcho(p3, echo)
+	if r = next(); r.Code != CodeUpstreamFailed {
+		t.Fatal(string(r.JSON()))
+	}
+	// 没有建立的会话只记录错误，不留状态
+	sess := &Session{ID: "s1", Target: echo}
+	alog.OnEvent(&Event{Type: EventRouteChosen, Session: sess, Upstream: "http://" + good})
+	alog.OnEvent(&Event{Type: EventTunnelClosed, Session: sess})
+	alog.OnEvent(&Event{Type: EventError, Session: sess, Err: errors.New("client gone")})
+	if r = next(); r.ID != "s1" || r.Code == CodeOK {
+		t.Fatal(string(r.JSON()))
+	}
+	select {
+	case r = <-records:
+		t.Fatal("duplicate:", string(r.JSON()))
+	default:
+	}
+	alog.sessions.Range(func(k, v interface{}) bool {
+		t.Fatal("leaked:", k)
+		return false
+	})
+}
+
+// go test pproxy -run Test_RotateFile -v -count=1
+func Test_RotateFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "access.log")
+	f := NewRotateFile(name, 10, 2)
+	for _, s := range []string{"11111\n", "22222\n", "33333\n", "44444\n"} {
+		if _, err := f.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Close()
+
+	for file, want := range map[string]string{name: "44444\n", name + ".1": "33333\n", name + ".2": "22222\n"} {
+		if bs, _ := ioutil.ReadFile(file); string(bs) != want {
+			t.Fatal(file, string(bs))
+		}
+	}
+	if _, err := os.Stat(name + ".3"); err == nil {
+		t.Fatal("too many backups")
+	}
+}
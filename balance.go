@@ -0,0 +1,183 @@
+package pproxy
+
+import (
+	"fmt"
+	"hash/crc32"
+	"math/rand"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 负载均衡策略
+const (
+	StrategyOrder      = ""            // 按顺序尝试
+	StrategyRoundRobin = "roundrobin"  // 轮询
+	StrategyWeighted   = "weighted"    // 加权随机，权重 http://host:port?weight=3
+	StrategyLeastConn  = "leastconn"   // 最少活动连接
+	StrategyLatency    = "latency"     // 最低延迟
+	StrategyHashUser   = "hash-user"   // 按账号一致性哈希
+	StrategyHashTarget = "hash-target" // 按目标一致性哈希
+)
+
+// 一致性哈希每个权重的虚拟节点数
+const hashReplicas = 64
+
+// 路由的负载均衡状态
+type balancer struct {
+	rr   uint64
+	used int64 // 最后使用的时间 UnixNano
+
+	once sync.Once
+	ring []ringNode
+}
+
+type ringNode struct {
+	hash uint32
+	idx  int
+}
+
+// 候选二级代理
+type candidate struct {
+	up     *upstream
+	reason string
+}
+
+// 权重，默认1
+func upstreamWeight(u string) int {
+	uu, err := url.Parse(u)
+	if err != nil {
+		return 1
+	}
+	w, err := strconv.Atoi(uu.Query().Get("weight"))
+	if err != nil || w <= 0 {
+		return 1
+	}
+	return w
+}
+
+// 记录延迟
+func (o *upstream) observe(d time.Duration) {
+	o.mu.Lock()
+	if o.latency == 0 {
+		o.latency = d
+	} else {
+		o.latency = (o.latency*7 + d*3) / 10
+	}
+	o.mu.Unlock()
+}
+
+func (o *upstream) getLatency() time.Duration {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.latency
+}
+
+func (o *Router) balancer(route *Route) *balancer {
+	v, _ := o.balancers.LoadOrStore(route.Name, &balancer{})
+	b := v.(*balancer)
+	atomic.StoreInt64(&b.used, time.Now().UnixNano())
+	return b
+}
+
+// 按策略排列候选，第一个为首选，其余用于故障转移
+func (o *Router) candidates(route *Route, s *Session) []candidate {
+	ups := make([]*upstream, len(route.Upstreams))
+	for i, u := range route.Upstreams {
+		ups[i] = o.upstream(u)
+	}
+
+	strategy := route.Strategy
+	if strategy == "" {
+		strategy = o.Strategy
+	}
+
+	cs := make([]candidate, 0, len(ups))
+	switch strategy {
+	case StrategyRoundRobin:
+		n := int(atomic.AddUint64(&o.balancer(route).rr, 1)-1) % len(ups)
+		for i := range ups {
+			cs = append(cs, candidate{ups[(n+i)%len(ups)], "roundrobin"})
+		}
+	case StrategyWeighted:
+		rest := append([]*upstream{}, ups...)
+		for len(rest) > 0 {
+			total := 0
+			for _, up := range rest {
+				total += up.weight
+			}
+			n := rand.Intn(total)
+			for i, up := range rest {
+				if n -= up.weight; n < 0 {
+					cs = append(cs, candidate{up, fmt.Sprintf("weighted random (weight=%d/%d)", up.weight, total)})
+					rest = append(rest[:i], rest[i+1:]...)
+					break
+				}
+			}
+		}
+	case StrategyLeastConn:
+		sorted := append([]*upstream{}, ups...)
+		sort.SliceStable(sorted, func(i, j int) bool {
+			return atomic.LoadInt64(&sorted[i].active) < atomic.LoadInt64(&sorted[j].active)
+		})
+		for _, up := range sorted {
+			cs = append(cs, candidate{up, fmt.Sprintf("least active (%d)", atomic.LoadInt64(&up.active))})
+		}
+	case StrategyLatency:
+		// 未测量过的优先，以便获得延迟数据
+		sorted := append([]*upstream{}, ups...)
+		sort.SliceStable(sorted, func(i, j int) bool {
+			return sorted[i].getLatency() < sorted[j].getLatency()
+		})
+		for _, up := range sorted {
+			cs = append(cs, candidate{up, "lowest latency (" + up.getLatency().String() + ")"})
+		}
+	case StrategyHashUser, StrategyHashTarget:
+		key := s.User
+		if strategy == StrategyHashTarget {
+			key = s.Target
+		}
+		for _, idx := range o.balancer(route).lookup(route, ups, key) {
+			cs = append(cs, candidate{ups[idx], strategy + " (" + key + ")"})
+		}
+	default:
+		for _, up := range ups {
+			cs = append(cs, candidate{up, "order"})
+		}
+	}
+
+	for i := 1; i < len(cs); i++ {
+		cs[i].reason = "failover, " + cs[i].reason
+	}
+	return cs
+}
+
+// 一致性哈希查找，返回从命中节点开始顺时针的不重复候选
+func (o *balancer) lookup(route *Route, ups []*upstream, key string) []int {
+	o.once.Do(func() {
+		for i, up := range ups {
+			for r := 0; r < hashReplicas*up.weight; r++ {
+				h := crc32.ChecksumIEEE([]byte(route.Upstreams[i] + "#" + strconv.Itoa(r)))
+				o.ring = append(o.ring, ringNode{hash: h, idx: i})
+			}
+		}
+		sort.Slice(o.ring, func(i, j int) bool { return o.ring[i].hash < o.ring[j].hash })
+	})
+
+	h := crc32.ChecksumIEEE([]byte(key))
+	start := sort.Search(len(o.ring), func(i int) bool { return o.ring[i].hash >= h })
+
+	seen := make([]bool, len(ups))
+	idxs := make([]int, 0, len(ups))
+	for i := 0; i < len(o.ring) && len(idxs) < len(ups); i++ {
+		n := o.ring[(start+i)%len(o.ring)]
+		if !seen[n.idx] {
+			seen[n.idx] = true
+			idxs = append(idxs, n.idx)
+		}
+	}
+	return idxs
+}
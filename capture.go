@@ -0,0 +1,334 @@
+package pproxy
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Capture 抓包：会话数据写入pcapng（合成TCP帧，Wireshark可以Follow Stream），
+// 普通HTTP和TLS拦截的HTTP交换写入HAR
+// 多个PProxy共享同一个Capture
+type Capture struct {
+	Users    []string // 只抓这些账号，空表示全部
+	Targets  []string // 只抓这些目标主机，支持 *.example.com，空表示全部
+	MaxBody  int      // HAR记录的最大Body长度，默认64KB
+	NoRedact bool     // HAR不隐藏认证信息，默认隐藏
+
+	pcap *pcapWriter
+	har  *harWriter
+}
+
+// NewCapture 创建抓包，文件名为空表示不写此格式
+func NewCapture(pcapFile, harFile string) (o *Capture, err error) {
+	o = &Capture{}
+	if pcapFile != "" {
+		if o.pcap, err = newPcapWriter(pcapFile); err != nil {
+			return nil, err
+		}
+	}
+	if harFile != "" {
+		if o.har, err = newHarWriter(harFile); err != nil {
+			if o.pcap != nil {
+				o.pcap.Close()
+			}
+			return nil, err
+		}
+	}
+	return
+}
+
+// Close 结束抓包，补全文件
+func (o *Capture) Close() (err error) {
+	if o.pcap != nil {
+		err = o.pcap.Close()
+	}
+	if o.har != nil {
+		if e := o.har.Close(); e != nil {
+			err = e
+		}
+	}
+	return
+}
+
+// 是否抓此会话
+func (o *Capture) match(s *Session) bool {
+	if len(o.Users) > 0 {
+		ok := false
+		for _, u := range o.Users {
+			if u == s.User {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	return len(o.Targets) == 0 || matchHost(o.Targets, s.Target)
+}
+
+func (o *Capture) maxBody() int {
+	if o.MaxBody <= 0 {
+		return 64 * 1024
+	}
+	return o.MaxBody
+}
+
+// 会话的抓包流
+func (o *PProxy) captureStream() *captureStream {
+	if o.Capture == nil || o.Capture.pcap == nil || !o.Capture.match(o.session) {
+		return nil
+	}
+	return o.Capture.pcap.stream(o.session.ClientAddr, o.session.Target)
+}
+
+// 会话是否写HAR
+func (o *PProxy) captureHAR() *Capture {
+	if o.Capture == nil || o.Capture.har == nil || !o.Capture.match(o.session) {
+		return nil
+	}
+	return o.Capture
+}
+
+// 抓包连接，Write为客户端到服务端，Read为服务端到客户端
+type captureConn struct {
+	net.Conn
+	stream *captureStream
+	once   sync.Once
+}
+
+func (o *captureConn) Read(b []byte) (n int, err error) {
+	n, err = o.Conn.Read(b)
+	if n > 0 {
+		o.stream.write(false, b[:n])
+	}
+	return
+}
+
+func (o *captureConn) Write(b []byte) (n int, err error) {
+	n, err = o.Conn.Write(b)
+	if n > 0 {
+		o.stream.write(true, b[:n])
+	}
+	return
+}
+
+func (o *captureConn) Close() error {
+	o.once.Do(o.stream.close)
+	return o.Conn.Close()
+}
+
+// pcapng
+const (
+	pcapBlockSHB = 0x0A0D0D0A
+	pcapBlockIDB = 0x00000001
+	pcapBlockEPB = 0x00000006
+	pcapLinkRaw  = 101 // LINKTYPE_RAW，IPv4
+	pcapMaxData  = 0xFFFF - 40
+)
+
+type pcapWriter struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func newPcapWriter(file string) (*pcapWriter, error) {
+	f, err := os.Create(file)
+	if err != nil {
+		return nil, err
+	}
+	o := &pcapWriter{f: f}
+
+	// Section Header Block
+	shb := make([]byte, 28)
+	binary.LittleEndian.PutUint32(shb[0:], pcapBlockSHB)
+	binary.LittleEndian.PutUint32(shb[4:], 28)
+	binary.LittleEndian.PutUint32(shb[8:], 0x1A2B3C4D)
+	binary.LittleEndian.PutUint16(shb[12:], 1)
+	binary.LittleEndian.PutUint16(shb[14:], 0)
+	binary.LittleEndian.PutUint64(shb[16:], 0xFFFFFFFFFFFFFFFF)
+	binary.LittleEndian.PutUint32(shb[24:], 28)
+
+	// Interface Description Block
+	idb := make([]byte, 20)
+	binary.LittleEndian.PutUint32(idb[0:], pcapBlockIDB)
+	binary.LittleEndian.PutUint32(idb[4:], 20)
+	binary.LittleEndian.PutUint16(idb[8:], pcapLinkRaw)
+	binary.LittleEndian.PutUint32(idb[12:], 0)
+	binary.LittleEndian.PutUint32(idb[16:], 20)
+
+	if _, err = f.Write(append(shb, idb...)); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return o, nil
+}
+
+func (o *pcapWriter) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.f.Close()
+}
+
+// Enhanced Packet Block
+func (o *pcapWriter) packet(pkt []byte) {
+	padded := (len(pkt) + 3) &^ 3
+	blk := make([]byte, 32+padded)
+	ts := uint64(time.Now().UnixNano() / 1000)
+	binary.LittleEndian.PutUint32(blk[0:], pcapBlockEPB)
+	binary.LittleEndian.PutUint32(blk[4:], uint32(len(blk)))
+	binary.LittleEndian.PutUint32(blk[8:], 0)
+	binary.LittleEndian.PutUint32(blk[12:], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(blk[16:], uint32(ts))
+	binary.LittleEndian.PutUint32(blk[20:], uint32(len(pkt)))
+	binary.LittleEndian.PutUint32(blk[24:], uint32(len(pkt)))
+	copy(blk[28:], pkt)
+	binary.LittleEndian.PutUint32(blk[len(blk)-4:], uint32(len(blk)))
+
+	o.mu.Lock()
+	o.f.Write(blk)
+	o.mu.Unlock()
+}
+
+// 一个会话合成的TCP流
+type captureStream struct {
+	w      *pcapWriter
+	mu     sync.Mutex
+	cIP    net.IP
+	sIP    net.IP
+	cPort  uint16
+	sPort  uint16
+	cSeq   uint32
+	sSeq   uint32
+	closed bool
+}
+
+// 地址转换为IPv4，非IPv4按哈希映射到10.0.0.0/8
+func captureAddr(addr string) (net.IP, uint16) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	p, _ := strconv.Atoi(port)
+	if ip := net.ParseIP(host).To4(); ip != nil {
+		return ip, uint16(p)
+	}
+	h := crc32.ChecksumIEEE([]byte(host))
+	return net.IPv4(10, byte(h>>16), byte(h>>8), byte(h)).To4(), uint16(p)
+}
+
+func (o *pcapWriter) stream(client, server string) *captureStream {
+	s := &captureStream{w: o}
+	s.cIP, s.cPort = captureAddr(client)
+	s.sIP, s.sPort = captureAddr(server)
+	isn := make([]byte, 8)
+	io.ReadFull(rand.Reader, isn)
+	s.cSeq, s.sSeq = binary.BigEndian.Uint32(isn), binary.BigEndian.Uint32(isn[4:])
+
+	// 三次握手
+	s.mu.Lock()
+	s.segment(true, 0x02, nil) // SYN
+	s.cSeq++
+	s.segment(false, 0x12, nil) // SYN ACK
+	s.sSeq++
+	s.segment(true, 0x10, nil) // ACK
+	s.mu.Unlock()
+	return s
+}
+
+// up为true表示客户端到服务端
+func (o *captureStream) write(up bool, data []byte) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return
+	}
+	for len(data) > 0 {
+		n := len(data)
+		if n > pcapMaxData {
+			n = pcapMaxData
+		}
+		o.segment(up, 0x18, data[:n]) // PSH ACK
+		if up {
+			o.cSeq += uint32(n)
+		} else {
+			o.sSeq += uint32(n)
+		}
+		data = data[n:]
+	}
+}
+
+func (o *captureStream) close() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return
+	}
+	o.closed = true
+	o.segment(true, 0x11, nil) // FIN ACK
+	o.cSeq++
+	o.segment(false, 0x11, nil)
+	o.sSeq++
+	o.segment(true, 0x10, nil)
+}
+
+// 合成IPv4+TCP包
+func (o *captureStream) segment(up bool, flags byte, data []byte) {
+	src, dst, sport, dport, seq, ack := o.cIP, o.sIP, o.cPort, o.sPort, o.cSeq, o.sSeq
+	if !up {
+		src, dst, sport, dport, seq, ack = o.sIP, o.cIP, o.sPort, o.cPort, o.sSeq, o.cSeq
+	}
+	if flags == 0x02 {
+		ack = 0
+	}
+
+	pkt := make([]byte, 40+len(data))
+	ip, tcp := pkt[:20], pkt[20:]
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(len(pkt)))
+	binary.BigEndian.PutUint16(ip[6:], 0x4000)
+	ip[8] = 64
+	ip[9] = 6
+	copy(ip[12:16], src)
+	copy(ip[16:20], dst)
+	binary.BigEndian.PutUint16(ip[10:], checksum(ip, 0))
+
+	binary.BigEndian.PutUint16(tcp[0:], sport)
+	binary.BigEndian.PutUint16(tcp[2:], dport)
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 0xFFFF)
+	copy(tcp[20:], data)
+
+	// 伪首部
+	var sum uint32
+	for i := 0; i < 4; i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(src[i:])) + uint32(binary.BigEndian.Uint16(dst[i:]))
+	}
+	sum += 6 + uint32(len(tcp))
+	binary.BigEndian.PutUint16(tcp[16:], checksum(tcp, sum))
+
+	o.w.packet(pkt)
+}
+
+func checksum(b []byte, sum uint32) uint16 {
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xFFFF {
+		sum = (sum >> 16) + (sum & 0xFFFF)
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,92 @@
+package pproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"testing"
+)
+
+// go test pproxy -run Test_Capture -v -count=1
+func Test_Capture(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pcapFile, harFile := filepath.Join(dir, "a.pcapng"), filepath.Join(dir, "a.har")
+	capture, err := NewCapture(pcapFile, harFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	web := startRemoteAddrServer(t)
+	echo := startEcho(t)
+	level2 := startProxy(t, &allowAll{}, nil)
+	p1 := startProxy(t, &allowAll{level2: "http://a:secret@" + level2}, func(pp *PProxy) { pp.Capture = capture })
+
+	if err := connectEcho(p1, echo); err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse("http://x:y@" + p1)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(u), DisableKeepAlives: true}}
+	req, _ := http.NewRequest("GET", "http://"+web+"/har?a=1", nil)
+	req.Header.Set("Authorization", "Basic c2VjcmV0")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	// 过滤掉的账号
+	capture.Users = []string{"nobody"}
+	proxyGet(t, "http://x:y@"+p1, "http://"+web+"/skip")
+
+	if err := capture.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// pcapng
+	bs, err := ioutil.ReadFile(pcapFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if binary.LittleEndian.Uint32(bs) != pcapBlockSHB || !bytes.Contains(bs, []byte("ping")) || !bytes.Contains(bs, []byte("/har?a=1 HTTP/1.1")) {
+		t.Fatal("pcapng error")
+	}
+	if bytes.Contains(bs, []byte("/skip")) {
+		t.Fatal("pcapng filter error")
+	}
+
+	// HAR
+	if bs, err = ioutil.ReadFile(harFile); err != nil {
+		t.Fatal(err)
+	}
+	har := struct {
+		Log struct {
+			Entries []harEntry `json:"entries"`
+		} `json:"log"`
+	}{}
+	if err := json.Unmarshal(bs, &har); err != nil {
+		t.Fatal(err, string(bs))
+	}
+	if len(har.Log.Entries) != 1 {
+		t.Fatal(string(bs))
+	}
+	e := har.Log.Entries[0]
+	if e.Request.URL != "http://"+web+"/har?a=1" || e.Response.Status != 200 || e.User != "x" || len(e.Request.QueryString) != 1 {
+		t.Fatal(string(bs))
+	}
+	if e.Upstream != "http://"+level2 {
+		t.Fatal("upstream not redacted:", e.Upstream)
+	}
+	for _, h := range e.Request.Headers {
+		if h.Name == "Authorization" && h.Value != "REDACTED" {
+			t.Fatal("not redacted:", h.Value)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package pproxy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 入站认证方式
+const (
+	AuthBasic  = "basic"  // 账号密码，SOCKS5、节点间协议等也使用
+	AuthDigest = "digest" // HTTP Digest，密码不经过网络
+	AuthBearer = "bearer" // HTTP Bearer令牌
+)
+
+// AuthRealm HTTP入站质询的realm
+const AuthRealm = "pproxy"
+
+// Credential 入站的认证信息
+type Credential struct {
+	Scheme   string // AuthBasic/AuthDigest/AuthBearer
+	User     string // Basic、Digest账号
+	Password string // Basic密码
+	Token    string // Bearer令牌
+
+	method string            // Digest请求方法
+	uri    string            // Digest请求目标，CONNECT为host:port
+	digest map[string]string // Digest参数
+}
+
+// CredentialAuth ProxyInterface可以实现，实现后用OnCredential代替OnAuth，支持Digest和Bearer
+// 没有实现时只接受Basic，交给OnAuth
+type CredentialAuth interface {
+	OnCredential(conn net.Conn, c *Credential) (string, error)
+}
+
+// Verify 用账号的密码（Bearer为令牌）校验：Basic比较密码，Digest按密码计算响应并检查nonce，Bearer比较令牌
+func (o *Credential) Verify(secret string) bool {
+	switch o.Scheme {
+	case AuthBasic:
+		return subtle.ConstantTimeCompare([]byte(o.Password), []byte(secret)) == 1
+	case AuthBearer:
+		return subtle.ConstantTimeCompare([]byte(o.Token), []byte(secret)) == 1
+	case AuthDigest:
+		return o.verifyDigest(secret)
+	}
+	return false
+}
+
+// 按客户端的参数重新计算Digest响应，uri必须是本次请求的目标，同一nonce的nc不能重复使用
+func (o *Credential) verifyDigest(password string) bool {
+	p := o.digest
+	newHash := digestHash(p["algorithm"])
+	if newHash == nil || p["realm"] != AuthRealm || !digestNonceValid(p["nonce"]) {
+		return false
+	}
+	// 质询只提供qop=auth，没有nc时无法防止重放
+	if p["qop"] != "auth" || p["nc"] == "" || p["uri"] != o.uri {
+		return false
+	}
+	h := func(s string) string {
+		d := newHash()
+		d.Write([]byte(s))
+		return hex.EncodeToString(d.Sum(nil))
+	}
+	want := digestValue(h, p["algorithm"], o.User, p["realm"], password, o.method, p["uri"], p["nonce"], p["nc"], p["cnonce"], p["qop"])
+	if subtle.ConstantTimeCompare([]byte(want), []byte(strings.ToLower(p["response"]))) != 1 {
+		return false
+	}
+	return digestUse(p["nonce"], p["nc"])
+}
+
+// 解析Proxy-Authorization，空为匿名；uri为请求行中的目标
+func parseCredential(header, method, uri string) (*Credential, error) {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return &Credential{Scheme: AuthBasic}, nil
+	}
+	scheme, params, token := parseChallenge(header)
+	switch scheme {
+	case AuthBasic:
+		up, err := base64.StdEncoding.DecodeString(token)
+		if err != nil {
+			return nil, err
+		}
+		// 密码可以包含:
+		i := strings.IndexByte(string(up), ':')
+		if i < 0 {
+			return nil, errors.New("user:password error:" + string(up))
+		}
+		return &Credential{Scheme: AuthBasic, User: string(up[:i]), Password: string(up[i+1:])}, nil
+	case AuthBearer:
+		return &Credential{Scheme: AuthBearer, Token: token}, nil
+	case AuthDigest:
+		if params == nil {
+			return nil, errors.New("digest params error")
+		}
+		return &Credential{Scheme: AuthDigest, User: params["username"], method: method, uri: uri, digest: params}, nil
+	}
+	return nil, errors.New("auth scheme not supported: " + scheme)
+}
+
+// 入站质询，AuthSchemes为空时只有Basic
+func (o *PProxy) challenges() (list []string) {
+	schemes := o.AuthSchemes
+	if len(schemes) == 0 {
+		schemes = []string{AuthBasic}
+	}
+	for _, s := range schemes {
+		switch s {
+		case AuthBasic:
+			list = append(list, `Basic realm="`+AuthRealm+`"`)
+		case AuthDigest:
+			nonce := digestNonce()
+			list = append(list,
+				`Digest realm="`+AuthRealm+`", nonce="`+nonce+`", qop="auth", algorithm=SHA-256`,
+				`Digest realm="`+AuthRealm+`", nonce="`+nonce+`", qop="auth", algorithm=MD5`)
+		case AuthBearer:
+			list = append(list, `Bearer realm="`+AuthRealm+`"`)
+		}
+	}
+	return
+}
+
+// HTTP入站认证失败
+func (o *PProxy) writeAuthRequired() {
+	var b strings.Builder
+	b.WriteString("HTTP/1.1 407 Proxy Authentication Required\r\n")
+	for _, c := range o.challenges() {
+		b.WriteString("Proxy-Authenticate: " + c + "\r\n")
+	}
+	b.WriteString("Content-Length: 0\r\nConnection: close\r\n\r\n")
+	o.debugWrite(PhaseAuth, o.Client, []byte(b.String()))
+	o.Client.Write([]byte(b.String()))
+}
+
+// Digest nonce为 时间.随机数.签名，不用保存状态，5分钟内有效
+const digestNonceTTL = 5 * time.Minute
+
+var digestSecret = func() []byte {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return b
+}()
+
+func digestNonce() string {
+	r := make([]byte, 8)
+	rand.Read(r)
+	ts := strconv.FormatInt(time.Now().Unix(), 16) + "." + hex.EncodeToString(r)
+	return ts + "." + digestSign(ts)
+}
+
+func digestSign(ts string) string {
+	m := hmac.New(sha256.New, digestSecret)
+	m.Write([]byte(ts))
+	return hex.EncodeToString(m.Sum(nil)[:16])
+}
+
+func digestNonceValid(nonce string) bool {
+	return !digestNonceExpires(nonce).IsZero()
+}
+
+// nonce过期时间，无效返回零值
+func digestNonceExpires(nonce string) time.Time {
+	i := strings.LastIndexByte(nonce, '.')
+	if i < 0 || !hmac.Equal([]byte(nonce[i+1:]), []byte(digestSign(nonce[:i]))) {
+		return time.Time{}
+	}
+	ts, err := strconv.ParseInt(strings.Split(nonce, ".")[0], 16, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	expires := time.Unix(ts, 0).Add(digestNonceTTL)
+	if !time.Now().Before(expires) {
+		return time.Time{}
+	}
+	return expires
+}
+
+// 已使用的nonce+nc，有上限，超过时客户端重新质询
+const (
+	digestMaxNonces = 1 << 16
+	digestMaxNC     = 1 << 10
+)
+
+var digestSeen = struct {
+	sync.Mutex
+	nonces map[string]*digestUsage
+}{nonces: map[string]*digestUsage{}}
+
+type digestUsage struct {
+	expires time.Time
+	nc      map[string]bool
+}
+
+// 记录nonce+nc，已使用过返回false
+func digestUse(nonce, nc string) bool {
+	expires := digestNonceExpires(nonce)
+	if expires.IsZero() {
+		return false
+	}
+
+	digestSeen.Lock()
+	defer digestSeen.Unlock()
+	u, ok := digestSeen.nonces[nonce]
+	if !ok {
+		if len(digestSeen.nonces) >= digestMaxNonces {
+			now := time.Now()
+			for k, v := range digestSeen.nonces {
+				if !now.Before(v.expires) {
+					delete(digestSeen.nonces, k)
+				}
+			}
+			if len(digestSeen.nonces) >= digestMaxNonces {
+				return false
+			}
+		}
+		u = &digestUsage{expires: expires, nc: map[string]bool{}}
+		digestSeen.nonces[nonce] = u
+	}
+	if u.nc[nc] || len(u.nc) >= digestMaxNC {
+		return false
+	}
+	u.nc[nc] = true
+	return true
+}
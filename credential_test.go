@@ -0,0 +1,114 @@
+package pproxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// 按Credential验证，账号u1密码p1，令牌tok
+type credentialAuth struct {
+	allowAll
+}
+
+func (o *credentialAuth) OnCredential(conn net.Conn, c *Credential) (string, error) {
+	secret := "p1"
+	if c.Scheme == AuthBearer {
+		secret = "tok"
+	} else if c.User != "u1" {
+		return "", errors.New("user error")
+	}
+	if !c.Verify(secret) {
+		return "", errors.New("auth error")
+	}
+	return "", nil
+}
+
+// 发送CONNECT，返回响应
+func connectWithAuth(proxy, target, auth string) (*http.Response, error) {
+	conn, err := net.DialTimeout("tcp", proxy, time.Second*3)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 3))
+	req := "CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\n"
+	if auth != "" {
+		req += "Proxy-Authorization: " + auth + "\r\n"
+	}
+	if _, err = conn.Write([]byte(req + "\r\n")); err != nil {
+		return nil, err
+	}
+	return http.ReadResponse(bufio.NewReader(conn), nil)
+}
+
+// go test pproxy -run Test_Credential -v -count=1
+func Test_Credential(t *testing.T) {
+	echo := startEcho(t)
+
+	// Basic密码包含:，失败时407质询Basic
+	p1 := startProxy(t, &checkPassword{password: "p:1"}, nil)
+	resp, err := connectWithAuth(p1, echo, "Basic "+base64.StdEncoding.EncodeToString([]byte("u1:p:1")))
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatal(resp, err)
+	}
+	if resp, err = connectWithAuth(p1, echo, ""); err != nil || resp.StatusCode != 407 || resp.Header.Get("Proxy-Authenticate") != `Basic realm="pproxy"` {
+		t.Fatal(resp, err)
+	}
+	// 没有实现CredentialAuth时不接受Bearer
+	if resp, err = connectWithAuth(p1, echo, "Bearer tok"); err != nil || resp.StatusCode != 407 {
+		t.Fatal(resp, err)
+	}
+
+	// Digest和Bearer
+	p2 := startProxy(t, &credentialAuth{}, func(pp *PProxy) { pp.AuthSchemes = []string{AuthDigest, AuthBearer} })
+	if resp, err = connectWithAuth(p2, echo, "Bearer tok"); err != nil || resp.StatusCode != 200 {
+		t.Fatal(resp, err)
+	}
+	if resp, err = connectWithAuth(p2, echo, "Bearer bad"); err != nil || resp.StatusCode != 407 {
+		t.Fatal(resp, err)
+	}
+	challenges := resp.Header.Values("Proxy-Authenticate")
+	if len(challenges) != 3 {
+		t.Fatal(challenges)
+	}
+	if scheme, params, _ := parseChallenge(challenges[0]); scheme != "digest" || params["algorithm"] != "SHA-256" || !digestNonceValid(params["nonce"]) {
+		t.Fatal(challenges)
+	}
+	// 不接受Basic，密码不经过网络
+	if resp, err = connectWithAuth(p2, echo, "Basic "+base64.StdEncoding.EncodeToString([]byte("u1:p1"))); err != nil || resp.StatusCode != 407 {
+		t.Fatal(resp, err)
+	}
+	// 二级代理客户端按质询使用Digest
+	if err = connectEcho(startProxy(t, &allowAll{level2: "http://u1:p1@" + p2}, nil), echo); err != nil {
+		t.Fatal(err)
+	}
+	if err = connectEcho(startProxy(t, &allowAll{level2: "http://u1:bad@" + p2}, nil), echo); err == nil {
+		t.Fatal("want error")
+	}
+
+	// 捕获的Digest头不能重放，也不能用于其他目标
+	_, params, _ := parseChallenge(challenges[0])
+	pa := &proxyAuth{user: "u1", password: "p1", method: "CONNECT", uri: echo}
+	header, _ := pa.digest(params)
+	if resp, err = connectWithAuth(p2, echo, header); err != nil || resp.StatusCode != 200 {
+		t.Fatal(resp, err)
+	}
+	if resp, err = connectWithAuth(p2, echo, header); err != nil || resp.StatusCode != 407 {
+		t.Fatal("replay:", resp, err)
+	}
+	other := startEcho(t)
+	header, _ = pa.digest(params)
+	if resp, err = connectWithAuth(p2, other, header); err != nil || resp.StatusCode != 407 {
+		t.Fatal("uri:", resp, err)
+	}
+
+	// nonce签名
+	if digestNonceValid("5f000000.00") || digestNonceValid("nonce") {
+		t.Fatal("nonce accepted")
+	}
+}
@@ -0,0 +1,134 @@
+package pproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+var _ proxy.ContextDialer = (*Dialer)(nil)
+
+// Dialer 客户端经二级代理链连接目标，和代理使用相同的二级代理协商，实现 proxy.Dialer 和 proxy.ContextDialer
+type Dialer struct {
+	Chain string // 用ChainSep连接的二级代理，空为直连
+	Hop   *Hop   // pproxy:// pproxys:// 二级代理的密钥和证书
+}
+
+// NewDialer 依次经过chain中的每个二级代理，例如 NewDialer("socks5://a:b@h1:1080", "http://c:d@h2:8080")
+func NewDialer(chain ...string) *Dialer {
+	return &Dialer{Chain: strings.Join(chain, ChainSep)}
+}
+
+// NewTransport 经二级代理链访问的http.Transport
+func NewTransport(chain ...string) *http.Transport {
+	return NewDialer(chain...).Transport()
+}
+
+// Dial ...
+func (o *Dialer) Dial(network, addr string) (net.Conn, error) {
+	return o.DialContext(context.Background(), network, addr)
+}
+
+// DialContext 只支持TCP，ctx的截止时间用于连接和协商，取消时返回ctx.Err()
+func (o *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, errors.New("pproxy dialer: unsupported network " + network)
+	}
+
+	pp := &PProxy{Hop: o.Hop, ctx: ctx}
+	if d, ok := ctx.Deadline(); ok {
+		pp.deadline = d
+	}
+
+	// 取消时关闭协商中的连接，阻塞的读写随之返回（go1.18没有context.AfterFunc）
+	var (
+		mu       sync.Mutex
+		conns    []net.Conn
+		canceled bool
+		finished bool
+	)
+	pp.dialed = func(conn net.Conn) {
+		mu.Lock()
+		defer mu.Unlock()
+		if canceled {
+			conn.Close()
+		}
+		conns = append(conns, conn)
+	}
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-stop:
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if finished {
+			return
+		}
+		canceled = true
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		var r result
+		if o.Chain == "" {
+			r.conn, r.err = pp.dialTCP(addr)
+		} else {
+			r.conn, r.err = pp.level2One(connectInfo(addr), o.Chain)
+		}
+		mu.Lock()
+		finished = true
+		if canceled && r.err == nil {
+			r.conn.Close()
+			r.conn, r.err = nil, ctx.Err()
+		}
+		mu.Unlock()
+		close(stop)
+		// 协商完成后不再使用截止时间
+		if r.err == nil && !pp.deadline.IsZero() {
+			r.conn.SetDeadline(time.Time{})
+		}
+		ch <- r
+	}()
+
+	select {
+	case r := <-ch:
+		return r.conn, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-ch; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// Transport 使用当前Dialer的http.Transport，参数同http.DefaultTransport
+func (o *Dialer) Transport() *http.Transport {
+	return &http.Transport{
+		DialContext:           o.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
@@ -0,0 +1,111 @@
+package pproxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// go test pproxy -run Test_Dialer -v -count=1
+func Test_Dialer(t *testing.T) {
+	echo := startEcho(t)
+	ps := "socks5://a:b@" + startProxy(t, &allowAll{}, nil)
+	ph := "http://a:b@" + startProxy(t, &allowAll{}, nil)
+
+	for _, chain := range [][]string{nil, {ps}, {ph}, {ps, ph}, {ph, ps, ph}} {
+		conn, err := NewDialer(chain...).DialContext(context.Background(), "tcp", echo)
+		if err != nil {
+			t.Fatal(chain, err)
+		}
+		conn.Write([]byte("ping"))
+		bs := make([]byte, 4)
+		if _, err = io.ReadFull(conn, bs); err != nil || string(bs) != "ping" {
+			t.Fatal(chain, err, string(bs))
+		}
+		conn.Close()
+	}
+
+	// http.Transport
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer ts.Close()
+	c := &http.Client{Transport: NewTransport(ps, ph)}
+	resp, err := c.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(bs) != "hello" {
+		t.Fatal(string(bs))
+	}
+
+	// 二级代理不响应时按ctx超时
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	start := time.Now()
+	if _, err = NewDialer("http://a:b@"+ln.Addr().String()).DialContext(ctx, "tcp", echo); err == nil {
+		t.Fatal("want error")
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("timeout ignored")
+	}
+
+	// 没有截止时间时取消，关闭协商中的连接
+	accepted := make(chan net.Conn, 1)
+	silent, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	go func() {
+		if conn, err := silent.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+	ctx, cancel = context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		_, err := NewDialer("http://a:b@"+silent.Addr().String()).DialContext(ctx, "tcp", echo)
+		errs <- err
+	}()
+	up := <-accepted
+	defer up.Close()
+	// 收到CONNECT后不回复，协商阻塞在读响应
+	if _, err = http.ReadRequest(bufio.NewReader(up)); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if err = <-errs; err != context.Canceled {
+		t.Fatal(err)
+	}
+	up.SetReadDeadline(time.Now().Add(time.Second * 3))
+	if _, err = ioutil.ReadAll(up); err != nil {
+		t.Fatal("upstream conn not closed:", err)
+	}
+
+	if _, err = NewDialer().Dial("udp", echo); err == nil {
+		t.Fatal("want error")
+	}
+}
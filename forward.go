@@ -0,0 +1,145 @@
+package pproxy
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// ChainSep 链式二级代理分隔符，例如 socks5://a:b@h1:1080>http://c:d@h2:8080，依次经过每个二级代理
+const ChainSep = ">"
+
+// 二级代理的地址，http默认80端口，socks5默认1080端口
+func upstreamAddr(upstream string) (string, error) {
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return "", err
+	}
+	return upstreamHost(u)
+}
+
+func upstreamHost(u *url.URL) (string, error) {
+	if u.Port() != "" {
+		return u.Host, nil
+	}
+	switch {
+	case u.Scheme == "https":
+		return net.JoinHostPort(u.Hostname(), "443"), nil
+	case u.Scheme == "http":
+		return net.JoinHostPort(u.Hostname(), "80"), nil
+	case strings.HasPrefix(u.Scheme, "socks5"):
+		return net.JoinHostPort(u.Hostname(), "1080"), nil
+	}
+	return "", errors.New("upstream port required: " + redactUpstream(u.String()))
+}
+
+// 链式二级代理，经前一个二级代理连接下一个，最后一个连接目标
+func (o *PProxy) chainLevel2(info *httpProxyInfo, newAuth string) (conn net.Conn, err error) {
+	hops := strings.Split(newAuth, ChainSep)
+	for i, hop := range hops {
+		next := info
+		if i < len(hops)-1 {
+			var addr string
+			if addr, err = upstreamAddr(strings.TrimSpace(hops[i+1])); err != nil {
+				break
+			}
+			next = connectInfo(addr)
+		}
+		prev := conn
+		if conn, err = o.dialUpstream(next, strings.TrimSpace(hop), prev); err != nil {
+			conn = prev
+			break
+		}
+	}
+	if err != nil && conn != nil {
+		conn.Close()
+		conn = nil
+	}
+	return
+}
+
+// Forward 静态端口转发，把连接经二级代理转发到固定目标，不做协议探测和账号验证
+// 会话事件、OnSuccess、PROXY头和Handshake相同，Protocol为forward
+// level2同OnAuth的返回值：多个候选用逗号分隔、链式用>连接、route:name，空为直连
+// proxyHeader 为v1/v2时向目标发送PROXY头，源地址为客户端地址
+func (o *PProxy) Forward(target, level2, proxyHeader string) (conn net.Conn, err error) {
+	o.newSession()
+	defer func() {
+		if err != nil {
+			o.emit(&Event{Type: EventError, Err: err})
+		}
+	}()
+
+	if o.ProxyProtocol != nil {
+		if err = o.readProxyHeader(); err != nil {
+			return
+		}
+	}
+	o.session.Protocol = "forward"
+	o.session.Target = target
+	o.emit(&Event{Type: EventHandshakeStart})
+
+	if level2 != "" {
+		if conn, err = o.level2(connectInfo(target), level2); err != nil {
+			return
+		}
+	} else if conn, err = o.dialTCP(target); err != nil {
+		return
+	}
+	conn = o.wrapConn(conn)
+	defer func() {
+		if err != nil && conn != nil {
+			conn.Close()
+		}
+	}()
+	if err = o.writeProxyHeaderVersion(conn, proxyHeader); err != nil {
+		return
+	}
+	// 探测PROXY头时多读的数据
+	if pc, ok := o.Client.(*proxyConn); ok && len(pc.prefix) > 0 {
+		if _, err = conn.Write(pc.prefix); err != nil {
+			return
+		}
+		pc.prefix = nil
+	}
+
+	o.success(conn)
+	return
+}
+
+// Forwarder 静态端口转发监听，每个连接为一个会话
+type Forwarder struct {
+	Target      string           // 目标 host:port
+	Level2      string           // 二级代理，空为直连
+	ProxyHeader string           // 向目标发送PROXY头 v1/v2，空不发送
+	PI          ProxyInterface   // OnSuccess记账，可以为nil，不调用OnAuth
+	Setup       func(pp *PProxy) // 每个会话创建PProxy后调用，设置Router、Observer、ProxyProtocol等
+}
+
+// Serve 接受连接
+func (o *Forwarder) Serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go o.ServeConn(conn)
+	}
+}
+
+// ServeConn 转发一个连接，返回时连接已关闭
+func (o *Forwarder) ServeConn(conn net.Conn) {
+	defer conn.Close()
+
+	pp := &PProxy{Client: conn, PI: o.PI}
+	if o.Setup != nil {
+		o.Setup(pp)
+	}
+	newConn, err := pp.Forward(o.Target, o.Level2, o.ProxyHeader)
+	if err != nil {
+		return
+	}
+	defer newConn.Close()
+	CopyHelper(conn, newConn)
+}
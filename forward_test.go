@@ -0,0 +1,116 @@
+package pproxy
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 启动转发监听
+func startForwarder(t *testing.T, f *Forwarder) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go f.Serve(ln)
+	return ln.Addr().String()
+}
+
+// 连接转发端口并验证echo
+func forwardEcho(addr string) error {
+	conn, err := net.DialTimeout("tcp", addr, time.Second*3)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 3))
+	if _, err = conn.Write([]byte("ping")); err != nil {
+		return err
+	}
+	bs := make([]byte, 4)
+	if _, err = io.ReadFull(conn, bs); err != nil {
+		return err
+	}
+	if string(bs) != "ping" {
+		return errors.New("echo error: " + string(bs))
+	}
+	return nil
+}
+
+// go test pproxy -run Test_Forward -v -count=1
+func Test_Forward(t *testing.T) {
+	echo := startEcho(t)
+	ps := startProxy(t, &allowAll{}, nil)
+	ph := startProxy(t, &allowAll{}, nil)
+
+	for _, level2 := range []string{
+		"",
+		"socks5://a:b@" + ps,
+		"socks5://a:b@" + ps + ">http://a:b@" + ph,
+		"http://a:b@" + ph + " > socks5://a:b@" + ps + " > http://a:b@" + ph,
+	} {
+		sessions := make(chan *Session, 1)
+		closed := make(chan *Event, 1)
+		addr := startForwarder(t, &Forwarder{
+			Target: echo,
+			Level2: level2,
+			PI:     &recordChoose{chosen: sessions},
+			Setup: func(pp *PProxy) {
+				pp.Observer = ObserverFunc(func(e *Event) {
+					if e.Type == EventTunnelClosed {
+						closed <- e
+					}
+				})
+			},
+		})
+		if err := forwardEcho(addr); err != nil {
+			t.Fatal(level2, err)
+		}
+		s := <-sessions
+		if s.Protocol != "forward" || s.Target != echo || s.Upstream != level2 {
+			t.Fatal(level2, s)
+		}
+		if e := <-closed; e.BytesUp != 4 || e.BytesDown != 4 {
+			t.Fatal(level2, e.BytesUp, e.BytesDown)
+		}
+	}
+	if s := redactUpstream("socks5://a:b@h1:1080>http://c:d@h2:80"); s != "socks5://h1:1080>http://h2:80" {
+		t.Fatal(s)
+	}
+
+	// 链中的二级代理失败
+	addr := startForwarder(t, &Forwarder{Target: echo, Level2: "socks5://a:b@" + ps + ">http://a:b@" + deadAddr(t)})
+	if err := forwardEcho(addr); err == nil {
+		t.Fatal("want error")
+	}
+
+	// 向目标发送PROXY头
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	lines := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		lines <- line
+	}()
+	addr = startForwarder(t, &Forwarder{Target: ln.Addr().String(), Level2: "http://a:b@" + ph, ProxyHeader: "v1"})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if line := <-lines; !strings.HasPrefix(line, "PROXY TCP4 127.0.0.1 127.0.0.1 "+strings.Split(conn.LocalAddr().String(), ":")[1]+" ") {
+		t.Fatal(line)
+	}
+}
@@ -1,10 +1,16 @@
 module pproxy
 
-go 1.15
+go 1.18
 
 require (
 	github.com/ohko/dd v0.0.0-20201016054529-4871d2c0392e
 	github.com/ohko/logger v0.2.10
 	github.com/ohko/omsg v1.2.2
-	golang.org/x/net v0.0.0-20201010224723-4f7140c49acb
+	golang.org/x/crypto v0.31.0
+	golang.org/x/net v0.33.0
+)
+
+require (
+	golang.org/x/sys v0.28.0 // indirect
+	golang.org/x/text v0.21.0 // indirect
 )
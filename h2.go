@@ -0,0 +1,528 @@
+package pproxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// H2 HTTP/2代理前端，一个连接上的每个CONNECT流为一个独立会话，分别OnAuth、选路由和二级代理
+// TLS连接ALPN协商为h2，或明文连接以HTTP/2 preface开头（h2c prior knowledge）时按HTTP/2处理，
+// 其他连接按HTTP/1.1、SOCKS5处理
+// 经典CONNECT以:authority为目标建立隧道；扩展CONNECT（RFC 8441）只支持:protocol为websocket，
+// 到:authority的隧道建立后向目标发送HTTP/1.1 Upgrade请求（:scheme为https时先TLS握手），目标回复101后流上转发WebSocket帧
+type H2 struct {
+	PI     ProxyInterface
+	Setup  func(pp *PProxy) // 每个会话创建PProxy后调用，设置Router、Observer等
+	Server *http2.Server    // 默认 &http2.Server{}
+}
+
+// Serve 接受连接，TLS监听时tls.Config.NextProtos需要包含h2
+func (o *H2) Serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go o.ServeConn(conn)
+	}
+}
+
+// ServeConn 处理一个客户端连接，返回时连接已关闭
+func (o *H2) ServeConn(conn net.Conn) {
+	defer conn.Close()
+
+	if tc, ok := conn.(*tls.Conn); ok {
+		if err := tc.Handshake(); err != nil {
+			return
+		}
+		if tc.ConnectionState().NegotiatedProtocol == http2.NextProtoTLS {
+			o.serveH2(conn)
+			return
+		}
+	} else {
+		// PRI * HTTP/2.0
+		b := make([]byte, 3)
+		if _, err := io.ReadFull(conn, b[:1]); err != nil {
+			return
+		}
+		if b[0] == 'P' {
+			if _, err := io.ReadFull(conn, b[1:]); err != nil {
+				return
+			}
+		} else {
+			b = b[:1]
+		}
+		conn = &proxyConn{Conn: conn, prefix: b}
+		if string(b) == "PRI" {
+			o.serveH2(conn)
+			return
+		}
+	}
+
+	pp := o.newPProxy(conn, false)
+	newConn, err := pp.Handshake()
+	if err != nil {
+		return
+	}
+	defer newConn.Close()
+	CopyHelper(conn, newConn)
+}
+
+func (o *H2) newPProxy(conn net.Conn, h2 bool) *PProxy {
+	pp := &PProxy{Client: conn, PI: o.PI, h2: h2}
+	if o.Setup != nil {
+		o.Setup(pp)
+	}
+	return pp
+}
+
+func (o *H2) serveH2(conn net.Conn) {
+	s := o.Server
+	if s == nil {
+		s = &http2.Server{}
+	}
+	// h2c时从客户端的HEADERS帧中读取:scheme
+	var schemes *h2Schemes
+	if _, ok := conn.(*tls.Conn); !ok {
+		schemes = newH2Schemes(conn, s.MaxDecoderHeaderTableSize)
+		conn = schemes
+	}
+	s.ServeConn(conn, &http2.ServeConnOpts{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			o.serveStream(conn, schemes, w, r)
+		}),
+	})
+}
+
+// 一个CONNECT流，schemes为nil时按r.TLS判断:scheme
+func (o *H2) serveStream(conn net.Conn, schemes *h2Schemes, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		http.Error(w, "only CONNECT is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	protocol := r.Header.Get(":protocol")
+	if protocol != "" && protocol != "websocket" {
+		http.Error(w, "unsupported :protocol "+protocol, http.StatusNotImplemented)
+		return
+	}
+	target := r.Host
+	secure := r.TLS != nil
+	if protocol != "" {
+		if schemes != nil {
+			scheme, err := schemes.take(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			secure = scheme == "https"
+		}
+		target = wsTarget(r.Host, secure)
+	}
+
+	// 转换为HTTP/1.1 CONNECT交给PProxy，复用验证、路由和二级代理
+	var header bytes.Buffer
+	header.WriteString("CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\n")
+	for _, k := range []string{"Proxy-Authorization", "User-Agent"} {
+		if v := r.Header.Get(k); v != "" {
+			header.WriteString(k + ": " + v + "\r\n")
+		}
+	}
+	header.WriteString("\r\n")
+
+	sc := &h2Stream{conn: conn, w: w, r: io.MultiReader(&header, r.Body), body: r.Body, hold: protocol != ""}
+	defer sc.Close()
+
+	pp := o.newPProxy(sc, true)
+	newConn, err := pp.Handshake()
+	if err != nil {
+		code := http.StatusBadGateway
+		// 认证失败时返回407
+		if pp.authFailed {
+			code = http.StatusProxyAuthRequired
+			for _, c := range pp.challenges() {
+				w.Header().Add("Proxy-Authenticate", c)
+			}
+		}
+		sc.fail(code, err)
+		return
+	}
+	defer newConn.Close()
+
+	if protocol != "" {
+		var h http.Header
+		if newConn, h, err = wsUpgrade(newConn, r, target, secure); err != nil {
+			sc.fail(http.StatusBadGateway, err)
+			return
+		}
+		sc.flush(h)
+	}
+
+	// 客户端结束发送后继续等待响应，流被重置时结束
+	done := make(chan struct{})
+	go func() {
+		io.Copy(sc, newConn)
+		close(done)
+	}()
+	io.Copy(newConn, sc)
+	select {
+	case <-done:
+	case <-r.Context().Done():
+	}
+}
+
+// websocket扩展CONNECT的目标，:authority没有端口时按:scheme使用默认端口，secure为https
+func wsTarget(authority string, secure bool) string {
+	if _, _, err := net.SplitHostPort(authority); err == nil {
+		return authority
+	}
+	if secure {
+		return net.JoinHostPort(authority, "443")
+	}
+	return net.JoinHostPort(authority, "80")
+}
+
+// websocketGUID RFC 6455计算Sec-WebSocket-Accept
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// 在隧道上把扩展CONNECT转换为HTTP/1.1 Upgrade（RFC 8441 第5节），返回101中协商的子协议和扩展
+// secure为true（:scheme为https）时先与目标TLS握手
+func wsUpgrade(conn net.Conn, r *http.Request, target string, secure bool) (_ net.Conn, h http.Header, err error) {
+	if secure {
+		host, _, _ := net.SplitHostPort(target)
+		tc := tls.Client(conn, &tls.Config{ServerName: host})
+		if err = tc.Handshake(); err != nil {
+			return
+		}
+		conn = tc
+	}
+
+	b := make([]byte, 16)
+	if _, err = rand.Read(b); err != nil {
+		return
+	}
+	key := base64.StdEncoding.EncodeToString(b)
+
+	header := r.Header.Clone()
+	removeHopHeaders(header)
+	for _, k := range []string{":protocol", "Proxy-Authorization", "Sec-Websocket-Key"} {
+		header.Del(k)
+	}
+	header.Set("Connection", "Upgrade")
+	header.Set("Upgrade", "websocket")
+	header.Set("Sec-WebSocket-Key", key)
+	var buf bytes.Buffer
+	buf.WriteString("GET " + r.URL.RequestURI() + " HTTP/1.1\r\nHost: " + r.Host + "\r\n")
+	header.Write(&buf)
+	buf.WriteString("\r\n")
+	if _, err = conn.Write(buf.Bytes()); err != nil {
+		return
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodGet})
+	if err != nil {
+		return
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, nil, errors.New("websocket: upstream replied " + resp.Status)
+	}
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	if resp.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(sum[:]) {
+		return nil, nil, errors.New("websocket: bad Sec-WebSocket-Accept")
+	}
+
+	h = http.Header{}
+	for _, k := range []string{"Sec-Websocket-Protocol", "Sec-Websocket-Extensions"} {
+		if vs := resp.Header.Values(k); len(vs) > 0 {
+			h[k] = vs
+		}
+	}
+	if n := br.Buffered(); n > 0 {
+		prefix, _ := br.Peek(n)
+		conn = &proxyConn{Conn: conn, prefix: append([]byte{}, prefix...)}
+	}
+	return conn, h, nil
+}
+
+// h2Schemes h2c连接上解析客户端发来的HEADERS帧，记录扩展CONNECT的:scheme
+// x/net只在TLS连接上通过r.TLS反映:scheme为https，h2c时需要自己解码头部
+// 在x/net读取之前解析，处理流时记录已经存在
+type h2Schemes struct {
+	net.Conn
+
+	preface int    // 还需跳过的客户端preface
+	head    []byte // 未读完的帧头
+	typ     byte   // 当前帧类型
+	flags   byte   // 当前帧标志
+	left    int    // 当前帧还没读的负载
+	payload []byte // HEADERS、CONTINUATION的负载
+	dec     *hpack.Decoder
+	fields  map[string]string // 当前头部块的伪头部
+
+	mu      sync.Mutex
+	err     error               // 头部解码失败
+	pending map[string][]string // :authority :path => 按到达顺序的:scheme
+}
+
+func newH2Schemes(conn net.Conn, tableSize uint32) *h2Schemes {
+	if tableSize == 0 {
+		tableSize = 4096
+	}
+	o := &h2Schemes{Conn: conn, preface: len(http2.ClientPreface), fields: map[string]string{}, pending: map[string][]string{}}
+	o.dec = hpack.NewDecoder(tableSize, func(f hpack.HeaderField) {
+		if strings.HasPrefix(f.Name, ":") {
+			o.fields[f.Name] = f.Value
+		}
+	})
+	return o
+}
+
+func (o *h2Schemes) Read(b []byte) (n int, err error) {
+	n, err = o.Conn.Read(b)
+	o.parse(b[:n])
+	return
+}
+
+// 按帧解析，只保留HEADERS、CONTINUATION的负载
+func (o *h2Schemes) parse(b []byte) {
+	for len(b) > 0 {
+		if o.preface > 0 {
+			k := o.preface
+			if k > len(b) {
+				k = len(b)
+			}
+			o.preface -= k
+			b = b[k:]
+			continue
+		}
+		if o.left == 0 && len(o.head) < 9 {
+			k := 9 - len(o.head)
+			if k > len(b) {
+				k = len(b)
+			}
+			o.head = append(o.head, b[:k]...)
+			b = b[k:]
+			if len(o.head) < 9 {
+				return
+			}
+			o.left = int(o.head[0])<<16 | int(o.head[1])<<8 | int(o.head[2])
+			o.typ, o.flags = o.head[3], o.head[4]
+			o.payload = o.payload[:0]
+			if o.left == 0 {
+				o.frame()
+				continue
+			}
+		}
+		k := o.left
+		if k > len(b) {
+			k = len(b)
+		}
+		if o.typ == byte(http2.FrameHeaders) || o.typ == byte(http2.FrameContinuation) {
+			o.payload = append(o.payload, b[:k]...)
+		}
+		o.left -= k
+		b = b[k:]
+		if o.left == 0 {
+			o.frame()
+		}
+	}
+}
+
+// 一个完整的帧
+func (o *h2Schemes) frame() {
+	o.head = o.head[:0]
+	p := o.payload
+	switch http2.FrameType(o.typ) {
+	case http2.FrameHeaders:
+		if o.flags&byte(http2.FlagHeadersPadded) != 0 {
+			if len(p) == 0 || int(p[0]) >= len(p) {
+				o.fail(errors.New("h2: bad HEADERS padding"))
+				return
+			}
+			p = p[1 : len(p)-int(p[0])]
+		}
+		if o.flags&byte(http2.FlagHeadersPriority) != 0 {
+			if len(p) < 5 {
+				o.fail(errors.New("h2: bad HEADERS priority"))
+				return
+			}
+			p = p[5:]
+		}
+	case http2.FrameContinuation:
+	default:
+		return
+	}
+	if _, err := o.dec.Write(p); err != nil {
+		o.fail(err)
+		return
+	}
+	if o.flags&byte(http2.FlagHeadersEndHeaders) == 0 {
+		return
+	}
+	if err := o.dec.Close(); err != nil {
+		o.fail(err)
+		return
+	}
+	if o.fields[":method"] == http.MethodConnect && o.fields[":protocol"] != "" {
+		k := o.fields[":authority"] + " " + o.fields[":path"]
+		o.mu.Lock()
+		o.pending[k] = append(o.pending[k], o.fields[":scheme"])
+		o.mu.Unlock()
+	}
+	o.fields = map[string]string{}
+}
+
+func (o *h2Schemes) fail(err error) {
+	o.mu.Lock()
+	if o.err == nil {
+		o.err = err
+	}
+	o.mu.Unlock()
+}
+
+// 取出扩展CONNECT的:scheme，同一:authority :path有不同:scheme的请求未处理时无法区分，返回错误
+func (o *h2Schemes) take(r *http.Request) (string, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.err != nil {
+		return "", o.err
+	}
+	k := r.Host + " " + r.RequestURI
+	schemes := o.pending[k]
+	if len(schemes) == 0 {
+		return "", errors.New("h2: unknown :scheme of " + k)
+	}
+	for _, s := range schemes[1:] {
+		if s != schemes[0] {
+			return "", errors.New("h2: ambiguous :scheme of " + k)
+		}
+	}
+	if len(schemes) == 1 {
+		delete(o.pending, k)
+	} else {
+		o.pending[k] = schemes[1:]
+	}
+	return schemes[0], nil
+}
+
+// h2Stream 把HTTP/2流作为net.Conn交给PProxy
+// 写入的HTTP/1.1响应头转换为HTTP/2响应头，之后的数据作为DATA帧
+type h2Stream struct {
+	conn net.Conn
+	w    http.ResponseWriter
+	r    io.Reader
+	body io.Closer
+
+	hold bool // 扩展CONNECT：隧道的200先不回复，由wsUpgrade成功后回复
+
+	mu      sync.Mutex
+	head    []byte // 未完成的HTTP/1.1响应头
+	held    bool   // 已收到200还没有回复
+	started bool
+	closed  bool
+}
+
+func (o *h2Stream) Read(b []byte) (int, error) {
+	return o.r.Read(b)
+}
+
+func (o *h2Stream) Write(b []byte) (n int, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	n = len(b)
+	if !o.started {
+		o.head = append(o.head, b...)
+		i := bytes.Index(o.head, []byte("\r\n\r\n"))
+		if i < 0 {
+			return
+		}
+		resp, e := http.ReadResponse(bufio.NewReader(bytes.NewReader(o.head[:i+4])), nil)
+		if e != nil {
+			return 0, e
+		}
+		o.started = true
+		if o.hold && resp.StatusCode == http.StatusOK {
+			o.held = true
+			return
+		}
+		removeHopHeaders(resp.Header)
+		for k, vs := range resp.Header {
+			o.w.Header()[k] = vs
+		}
+		o.w.WriteHeader(resp.StatusCode)
+		if b = o.head[i+4:]; len(b) == 0 {
+			o.w.(http.Flusher).Flush()
+			return
+		}
+	}
+
+	if _, err = o.w.Write(b); err != nil {
+		return 0, err
+	}
+	o.w.(http.Flusher).Flush()
+	return
+}
+
+// 握手失败，还没有响应时返回错误
+func (o *h2Stream) fail(code int, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed || o.started && !o.held {
+		return
+	}
+	o.started, o.held = true, false
+	http.Error(o.w, err.Error(), code)
+}
+
+// 回复暂缓的200
+func (o *h2Stream) flush(h http.Header) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed || !o.held {
+		return
+	}
+	o.held = false
+	for k, vs := range h {
+		o.w.Header()[k] = vs
+	}
+	o.w.WriteHeader(http.StatusOK)
+	o.w.(http.Flusher).Flush()
+}
+
+func (o *h2Stream) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return nil
+	}
+	o.closed = true
+	if !o.started || o.held {
+		o.started, o.held = true, false
+		o.w.WriteHeader(http.StatusBadGateway)
+	}
+	return o.body.Close()
+}
+
+func (o *h2Stream) LocalAddr() net.Addr                { return o.conn.LocalAddr() }
+func (o *h2Stream) RemoteAddr() net.Addr               { return o.conn.RemoteAddr() }
+func (o *h2Stream) SetDeadline(t time.Time) error      { return nil }
+func (o *h2Stream) SetReadDeadline(t time.Time) error  { return nil }
+func (o *h2Stream) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,315 @@
+package pproxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// 通过HTTP/2 CONNECT流访问echo
+func h2ConnectEcho(t *testing.T, tr *http2.Transport, target, auth string) int {
+	pr, pw := io.Pipe()
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Scheme: "https", Host: target},
+		Host:   target,
+		Header: http.Header{"Proxy-Authorization": {auth}},
+		Body:   pr,
+	}
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	defer pw.Close()
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode
+	}
+
+	pw.Write([]byte("ping"))
+	bs := make([]byte, 4)
+	if _, err = io.ReadFull(resp.Body, bs); err != nil || string(bs) != "ping" {
+		t.Fatal(err, string(bs))
+	}
+	return resp.StatusCode
+}
+
+// go test pproxy -run Test_H2 -v -count=1
+func Test_H2(t *testing.T) {
+	echo := startEcho(t)
+	p2 := startProxy(t, &allowAll{}, nil)
+	cert, err := tls.LoadX509KeyPair("ssl/ssl.crt", "ssl/ssl.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessions := make(chan *Session, 10)
+	h := &H2{
+		PI: &recordChoose{allowAll: allowAll{level2: "http://a:b@" + p2}, chosen: sessions},
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go h.Serve(ln)
+	tlsLn, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"h2", "http/1.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go h.Serve(tlsLn)
+
+	h2c := &http2.Transport{AllowHTTP: true, DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+		return net.Dial(network, ln.Addr().String())
+	}}
+	h2 := &http2.Transport{DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+		return tls.Dial(network, tlsLn.Addr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2"}})
+	}}
+	for _, tr := range []*http2.Transport{h2c, h2} {
+		// 同一个连接上的两个流
+		for i := 0; i < 2; i++ {
+			if code := h2ConnectEcho(t, tr, echo, "Basic eDp5"); code != http.StatusOK {
+				t.Fatal(code)
+			}
+			if s := <-sessions; s.Protocol != "h2" || s.Upstream != "http://a:b@"+p2 || s.Target != echo {
+				t.Fatal(s)
+			}
+		}
+	}
+
+	// 同一个监听端口仍然支持HTTP/1.1
+	if err := connectEcho(ln.Addr().String(), echo); err != nil {
+		t.Fatal(err)
+	}
+	if s := <-sessions; s.Protocol != "http" {
+		t.Fatal(s)
+	}
+
+	// 验证失败
+	deny := &H2{PI: &denyAll{}}
+	ln2, _ := net.Listen("tcp", "127.0.0.1:0")
+	go deny.Serve(ln2)
+	h2c = &http2.Transport{AllowHTTP: true, DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+		return net.Dial(network, ln2.Addr().String())
+	}}
+	if code := h2ConnectEcho(t, h2c, echo, "Basic eDp5"); code != http.StatusProxyAuthRequired {
+		t.Fatal(code)
+	}
+}
+
+// WebSocket服务器，检查Upgrade请求后回复101并echo，reqs记录请求
+func startWebSocket(t *testing.T, reqs chan<- *http.Request) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				req, err := http.ReadRequest(br)
+				if err != nil {
+					return
+				}
+				reqs <- req
+				if req.URL.Path != "/chat" {
+					conn.Write([]byte("HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\n\r\n"))
+					return
+				}
+				sum := sha1.Sum([]byte(req.Header.Get("Sec-WebSocket-Key") + websocketGUID))
+				conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+					"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\nSec-WebSocket-Protocol: chat\r\n\r\n"))
+				CopyHelper(&proxyConn{Conn: conn, prefix: bufferedBytes(br)}, conn)
+			}(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func bufferedBytes(br *bufio.Reader) []byte {
+	b, _ := br.Peek(br.Buffered())
+	return b
+}
+
+// 扩展CONNECT流，x/net的Transport把:protocol编码在普通头之后，这里直接写帧
+type h2xStream struct {
+	t  *testing.T
+	fr *http2.Framer
+}
+
+func h2ExtendedConnect(t *testing.T, addr, scheme, authority, protocol, path string) (st *h2xStream, status string, h http.Header) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+	conn.Write([]byte(http2.ClientPreface))
+	fr := http2.NewFramer(conn, conn)
+	fr.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+	fr.WriteSettings()
+
+	var buf bytes.Buffer
+	enc := hpack.NewEncoder(&buf)
+	for _, f := range [][2]string{
+		{":method", "CONNECT"}, {":protocol", protocol}, {":scheme", scheme}, {":path", path}, {":authority", authority},
+		{"proxy-authorization", "Basic eDp5"}, {"sec-websocket-version", "13"}, {"sec-websocket-protocol", "chat, superchat"},
+	} {
+		enc.WriteField(hpack.HeaderField{Name: f[0], Value: f[1]})
+	}
+	fr.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: buf.Bytes(), EndHeaders: true})
+
+	h = http.Header{}
+	for {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch f := f.(type) {
+		case *http2.SettingsFrame:
+			if !f.IsAck() {
+				if v, ok := f.Value(http2.SettingEnableConnectProtocol); !ok || v != 1 {
+					t.Fatal("SETTINGS_ENABLE_CONNECT_PROTOCOL", v)
+				}
+				fr.WriteSettingsAck()
+			}
+		case *http2.MetaHeadersFrame:
+			for _, hf := range f.RegularFields() {
+				h.Add(hf.Name, hf.Value)
+			}
+			return &h2xStream{t: t, fr: fr}, f.PseudoValue("status"), h
+		case *http2.RSTStreamFrame:
+			t.Fatal(f.ErrCode)
+		}
+	}
+}
+
+// 发送数据，读回同样长度的数据
+func (o *h2xStream) echo(s string) string {
+	o.fr.WriteData(1, false, []byte(s))
+	var b []byte
+	for len(b) < len(s) {
+		f, err := o.fr.ReadFrame()
+		if err != nil {
+			o.t.Fatal(err)
+		}
+		if f, ok := f.(*http2.DataFrame); ok {
+			b = append(b, f.Data()...)
+		}
+	}
+	return string(b)
+}
+
+// go test pproxy -run Test_H2ExtendedConnect -v -count=1
+func Test_H2ExtendedConnect(t *testing.T) {
+	reqs := make(chan *http.Request, 1)
+	ws := startWebSocket(t, reqs)
+	sessions := make(chan *Session, 10)
+	h := &H2{PI: &recordChoose{chosen: sessions}}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go h.Serve(ln)
+	// websocket转换为HTTP/1.1 Upgrade
+	st, status, header := h2ExtendedConnect(t, ln.Addr().String(), "http", ws, "websocket", "/chat")
+	if status != "200" || header.Get("Sec-WebSocket-Protocol") != "chat" {
+		t.Fatal(status, header)
+	}
+	req := <-reqs
+	if req.Host != ws || req.Header.Get("Upgrade") != "websocket" || req.Header.Get("Sec-WebSocket-Version") != "13" ||
+		req.Header.Get("Sec-WebSocket-Protocol") != "chat, superchat" || req.Header.Get("Proxy-Authorization") != "" {
+		t.Fatal(req.Host, req.Header)
+	}
+	if s := <-sessions; s.Protocol != "h2" || s.Target != ws {
+		t.Fatal(s)
+	}
+	if s := st.echo("ping"); s != "ping" {
+		t.Fatal(s)
+	}
+
+	// 目标没有回复101
+	_, status, _ = h2ExtendedConnect(t, ln.Addr().String(), "http", ws, "websocket", "/none")
+	<-reqs
+	<-sessions
+	if status != "502" {
+		t.Fatal(status)
+	}
+
+	// h2c上:scheme为https时与目标TLS握手，不降级为明文
+	_, status, _ = h2ExtendedConnect(t, ln.Addr().String(), "https", ws, "websocket", "/chat")
+	<-sessions
+	if status != "502" {
+		t.Fatal(status)
+	}
+	select {
+	case req := <-reqs:
+		t.Fatal("plaintext upgrade:", req.URL)
+	default:
+	}
+
+	// 不支持的:protocol
+	if _, status, _ = h2ExtendedConnect(t, ln.Addr().String(), "http", ws, "connect-udp", "/"); status != "501" {
+		t.Fatal(status)
+	}
+}
+
+// go test pproxy -run Test_H2Schemes -v -count=1
+func Test_H2Schemes(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString(http2.ClientPreface)
+	fr := http2.NewFramer(&buf, nil)
+	// 同一个编码器，后面的头部块引用动态表
+	var hb bytes.Buffer
+	enc := hpack.NewEncoder(&hb)
+	block := func(scheme string) []byte {
+		hb.Reset()
+		for _, f := range [][2]string{{":method", "CONNECT"}, {":protocol", "websocket"}, {":scheme", scheme}, {":path", "/chat"}, {":authority", "h:1"}} {
+			enc.WriteField(hpack.HeaderField{Name: f[0], Value: f[1]})
+		}
+		return append([]byte{}, hb.Bytes()...)
+	}
+	fr.WriteSettings()
+	// 填充、优先级，头部块分在CONTINUATION中
+	b := block("https")
+	fr.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: b[:3], PadLength: 2, Priority: http2.PriorityParam{Weight: 1}})
+	fr.WriteContinuation(1, true, b[3:])
+	fr.WriteData(1, false, []byte("data"))
+
+	o := newH2Schemes(nil, 0)
+	for _, c := range buf.Bytes() {
+		o.parse([]byte{c})
+	}
+	r := &http.Request{Host: "h:1", RequestURI: "/chat"}
+	if s, err := o.take(r); s != "https" || err != nil {
+		t.Fatal(s, err)
+	}
+	if _, err := o.take(r); err == nil {
+		t.Fatal("want error: no pending request")
+	}
+
+	// 同一目标不同:scheme的请求同时未处理时无法区分
+	buf.Reset()
+	fr.WriteHeaders(http2.HeadersFrameParam{StreamID: 3, BlockFragment: block("http"), EndHeaders: true})
+	fr.WriteHeaders(http2.HeadersFrameParam{StreamID: 5, BlockFragment: block("https"), EndHeaders: true})
+	o.parse(buf.Bytes())
+	if s, err := o.take(r); err == nil {
+		t.Fatal("want error: ambiguous", s)
+	}
+}
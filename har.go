@@ -0,0 +1,250 @@
+package pproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HAR 1.2
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	User            string      `json:"_user,omitempty"`
+	ClientAddr      string      `json:"_clientAddr,omitempty"`
+	Upstream        string      `json:"_upstream,omitempty"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// 需要隐藏的头
+var harRedactHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"Set-Cookie":          true,
+}
+
+// HAR文件，entries逐条追加，Close时补全JSON
+type harWriter struct {
+	mu    sync.Mutex
+	f     *os.File
+	count int
+}
+
+func newHarWriter(file string) (*harWriter, error) {
+	f, err := os.Create(file)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = f.WriteString(`{"log":{"version":"1.2","creator":{"name":"pproxy","version":"1.0"},"entries":[` + "\n"); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &harWriter{f: f}, nil
+}
+
+func (o *harWriter) write(e *harEntry) {
+	bs, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.count > 0 {
+		o.f.WriteString(",\n")
+	}
+	o.count++
+	o.f.Write(bs)
+}
+
+func (o *harWriter) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if _, err := o.f.WriteString("\n]}}\n"); err != nil {
+		o.f.Close()
+		return err
+	}
+	return o.f.Close()
+}
+
+// 记录Body，最多max字节
+type bodyRecorder struct {
+	io.ReadCloser
+	max  int
+	buf  bytes.Buffer
+	size int64
+}
+
+func (o *bodyRecorder) Read(b []byte) (n int, err error) {
+	n, err = o.ReadCloser.Read(b)
+	o.size += int64(n)
+	if rest := o.max - o.buf.Len(); rest > 0 {
+		if rest > n {
+			rest = n
+		}
+		o.buf.Write(b[:rest])
+	}
+	return
+}
+
+// 一次HTTP交换的记录
+type harRecord struct {
+	c       *Capture
+	start   time.Time
+	sent    time.Time
+	waited  time.Time
+	reqBody *bodyRecorder
+}
+
+// 开始记录请求，包装请求Body
+func (o *Capture) recordHAR(req *http.Request) *harRecord {
+	r := &harRecord{c: o, start: time.Now()}
+	if req.Body != nil && req.Body != http.NoBody {
+		r.reqBody = &bodyRecorder{ReadCloser: req.Body, max: o.maxBody()}
+		req.Body = r.reqBody
+	}
+	return r
+}
+
+// 包装响应Body
+func (o *harRecord) response(resp *http.Response) *bodyRecorder {
+	o.waited = time.Now()
+	rb := &bodyRecorder{ReadCloser: resp.Body, max: o.c.maxBody()}
+	resp.Body = rb
+	return rb
+}
+
+// 响应转发完成，写入HAR
+func (o *harRecord) done(s *Session, req *http.Request, resp *http.Response, respBody *bodyRecorder) {
+	end := time.Now()
+	if o.sent.IsZero() {
+		o.sent = o.waited
+	}
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+
+	u := *req.URL
+	if !o.c.NoRedact && u.User != nil {
+		u.User = nil
+	}
+	upstream := s.Upstream
+	if !o.c.NoRedact && upstream != "" {
+		upstream = redactUpstream(upstream)
+	}
+	e := &harEntry{
+		StartedDateTime: o.start.Format(time.RFC3339Nano),
+		Time:            ms(end.Sub(o.start)),
+		Request: harRequest{
+			Method:      req.Method,
+			URL:         u.String(),
+			HTTPVersion: req.Proto,
+			Cookies:     []harNameValue{},
+			Headers:     o.headers(req.Header),
+			QueryString: []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    0,
+		},
+		Response: harResponse{
+			Status:      resp.StatusCode,
+			StatusText:  strings.TrimSpace(strings.TrimPrefix(resp.Status, strconv.Itoa(resp.StatusCode))),
+			HTTPVersion: resp.Proto,
+			Cookies:     []harNameValue{},
+			Headers:     o.headers(resp.Header),
+			Content: harContent{
+				Size:     respBody.size,
+				MimeType: resp.Header.Get("Content-Type"),
+				Text:     respBody.buf.String(),
+			},
+			RedirectURL: resp.Header.Get("Location"),
+			HeadersSize: -1,
+			BodySize:    respBody.size,
+		},
+		Timings: harTimings{
+			Send:    ms(o.sent.Sub(o.start)),
+			Wait:    ms(o.waited.Sub(o.sent)),
+			Receive: ms(end.Sub(o.waited)),
+		},
+		User:       s.User,
+		ClientAddr: s.ClientAddr,
+		Upstream:   upstream,
+	}
+	for k, vs := range u.Query() {
+		for _, v := range vs {
+			e.Request.QueryString = append(e.Request.QueryString, harNameValue{k, v})
+		}
+	}
+	if o.reqBody != nil {
+		e.Request.BodySize = o.reqBody.size
+		e.Request.PostData = &harPostData{MimeType: req.Header.Get("Content-Type"), Text: o.reqBody.buf.String()}
+	}
+
+	o.c.har.write(e)
+}
+
+func (o *harRecord) headers(h http.Header) []harNameValue {
+	nvs := []harNameValue{}
+	for k, vs := range h {
+		for _, v := range vs {
+			if !o.c.NoRedact && harRedactHeaders[k] {
+				v = "REDACTED"
+			}
+			nvs = append(nvs, harNameValue{k, v})
+		}
+	}
+	return nvs
+}
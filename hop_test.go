@@ -0,0 +1,72 @@
+package pproxy
+
+import (
+	"crypto/tls"
+	"testing"
+)
+
+// go test pproxy -run Test_Hop -v -count=1
+func Test_Hop(t *testing.T) {
+	echo := startEcho(t)
+	p3 := startProxy(t, &allowAll{}, nil)
+	hop := &Hop{PSK: []byte("secret")}
+
+	// 预共享密钥
+	sessions := make(chan *Session, 1)
+	h1 := startProxy(t, &recordChoose{allowAll: allowAll{}, chosen: sessions}, func(pp *PProxy) { pp.Hop = hop })
+	first := make(chan *Session, 1)
+	pi := &recordChoose{allowAll: allowAll{level2: "pproxy://u1:p1@" + h1}, chosen: first}
+	p1 := startProxy(t, pi, func(pp *PProxy) { pp.Hop = hop })
+	if err := connectEcho(p1, echo); err != nil {
+		t.Fatal(err)
+	}
+	s0, s := <-first, <-sessions
+	if s.Protocol != "pproxy" || s.User != "u1" || s.Target != echo {
+		t.Fatal(s)
+	}
+	if s.ParentID != s0.ID || s.TraceID != s0.TraceID || s0.TraceID != s0.ID {
+		t.Fatal(s0, s)
+	}
+
+	// psk参数，下一跳再经过http二级代理
+	h2 := startProxy(t, &userLevel2{users: map[string]string{"u2": "http://a:b@" + p3}}, func(pp *PProxy) { pp.Hop = hop })
+	p1 = startProxy(t, &allowAll{level2: "pproxy://u2:p2@" + h2 + "?psk=secret"}, nil)
+	if err := connectEcho(p1, echo); err != nil {
+		t.Fatal(err)
+	}
+
+	// 密钥错误、下一跳验证失败
+	p1 = startProxy(t, &allowAll{level2: "pproxy://u1:p1@" + h1 + "?psk=bad"}, nil)
+	if err := connectEcho(p1, echo); err == nil {
+		t.Fatal("want error")
+	}
+	h3 := startProxy(t, &denyAll{}, func(pp *PProxy) { pp.Hop = hop })
+	p1 = startProxy(t, &allowAll{level2: "pproxy://u1:p1@" + h3}, func(pp *PProxy) { pp.Hop = hop })
+	if err := connectEcho(p1, echo); err == nil {
+		t.Fatal("want error")
+	}
+
+	// 证书
+	ca, roots := testCA(t)
+	interceptor, err := NewInterceptor(ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := interceptor.cert("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &Hop{TLS: &tls.Config{Certificates: []tls.Certificate{*cert}}}
+	h4 := startProxy(t, &allowAll{}, func(pp *PProxy) { pp.Hop = server })
+	client := &Hop{TLS: &tls.Config{RootCAs: roots}}
+	p1 = startProxy(t, &allowAll{level2: "pproxys://u1:p1@" + h4}, func(pp *PProxy) { pp.Hop = client })
+	if err := connectEcho(p1, echo); err != nil {
+		t.Fatal(err)
+	}
+
+	// 不信任的证书
+	p1 = startProxy(t, &allowAll{level2: "pproxys://u1:p1@" + h4}, func(pp *PProxy) { pp.Hop = &Hop{TLS: &tls.Config{}} })
+	if err := connectEcho(p1, echo); err == nil {
+		t.Fatal("want error")
+	}
+}
@@ -3,9 +3,12 @@ package pproxy
 import (
 	"bufio"
 	"bytes"
-	"encoding/base64"
 	"errors"
+	"io"
+	"io/ioutil"
 	"net"
+	"net/http"
+	"net/http/httputil"
 	"net/url"
 	"strconv"
 	"strings"
@@ -30,6 +33,16 @@ type httpProxyInfo struct {
 	level2 string // [empty|http|socks5]
 }
 
+// 到addr的CONNECT请求，非HTTP客户端经过http二级代理时使用
+func connectInfo(addr string) *httpProxyInfo {
+	return &httpProxyInfo{
+		originHeader: "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\nProxy-Authorization: Basic eDp5\r\nUser-Agent: pproxy\r\n\r\n",
+		authLine:     "Proxy-Authorization: Basic eDp5\r\n",
+		method:       "CONNECT",
+		uri:          addr,
+	}
+}
+
 // hand http proxy
 func (o *PProxy) handshakeHTTP(prefix []byte) (conn net.Conn, err error) {
 
@@ -48,9 +61,7 @@ func (o *PProxy) handshakeHTTP(prefix []byte) (conn net.Conn, err error) {
 			}
 		}
 	}
-	if o.DebugRead != nil {
-		o.DebugRead(o.Client, buffer)
-	}
+	o.debugRead(PhaseRequest, o.Client, buffer)
 
 	// read first line
 	reader := bufio.NewReader(strings.NewReader(string(buffer)))
@@ -60,6 +71,9 @@ func (o *PProxy) handshakeHTTP(prefix []byte) (conn net.Conn, err error) {
 	}
 	// analyse Mehtod
 	arrFirstLine := strings.Split(line, " ")
+	if len(arrFirstLine) != 3 {
+		return nil, errors.New("http request line error: " + strings.TrimSpace(line))
+	}
 
 	info := httpProxyInfo{
 		originHeader: line,
@@ -73,7 +87,11 @@ func (o *PProxy) handshakeHTTP(prefix []byte) (conn net.Conn, err error) {
 	}
 
 	if info.method != "CONNECT" {
-		info.connectTo = strings.Join(strings.Split(info.connectTo, "/")[:3], "/") + "/"
+		arr := strings.Split(info.connectTo, "/")
+		if len(arr) < 3 {
+			return nil, errors.New("http request uri error: " + info.connectTo)
+		}
+		info.connectTo = strings.Join(arr[:3], "/") + "/"
 	}
 
 	// other header
@@ -115,65 +133,54 @@ func (o *PProxy) handshakeHTTP(prefix []byte) (conn net.Conn, err error) {
 		}
 	}
 
+	o.session.Target = info.uri
+
+	// 认证失败时回复407和支持的认证方式，h2由H2回复
+	defer func() {
+		if err != nil && o.authFailed && !o.h2 {
+			o.writeAuthRequired()
+		}
+	}()
+
+	// 普通HTTP请求逐个转发
+	if info.method != "CONNECT" {
+		return o.forwardHTTP(&info, buffer)
+	}
+
 	// auth
 	if conn, err = o.checkAuth(&info); err != nil {
 		return
 	}
 	// Dail
 	if conn == nil {
-		if conn, err = net.Dial("tcp", info.uri); err != nil {
+		if conn, err = o.dialTCP(info.uri); err != nil {
 			return
 		}
 	}
+	conn = o.wrapConn(conn)
 	defer func() {
 		if err != nil && conn != nil {
 			conn.Close()
 		}
 	}()
 
-	if info.method == "CONNECT" {
-		if o.DebugWrite != nil {
-			o.DebugWrite(o.Client, []byte(ConnectOK))
-		}
-		if _, err = o.Client.Write([]byte(ConnectOK)); err != nil {
-			return
-		}
-	} else if info.level2 != "http" {
-		bs := []byte(strings.ReplaceAll(info.activeHeader, info.connectTo, "/"))
-		if o.DebugWrite != nil {
-			o.DebugWrite(conn, bs)
-		}
-		if _, err = conn.Write(bs); err != nil {
-			return
-		}
+	o.debugWrite(PhaseRequest, o.Client, []byte(ConnectOK))
+	if _, err = o.Client.Write([]byte(ConnectOK)); err != nil {
+		return
 	}
 
-	o.PI.OnSuccess(o.Client, conn)
+	if conn, err = o.intercept(conn); err != nil {
+		return
+	}
+
+	o.success(conn)
 	return
 }
 
 // return newConn, header, error
 func (o *PProxy) checkAuth(info *httpProxyInfo) (conn net.Conn, err error) {
-	// analy user and password
-	user, password := "", ""
-	if info.authLine != "" {
-		if strings.Contains(info.authLine, " Basic ") {
-			var up []byte
-			tmp := strings.Split(info.authLine, " ")
-			if up, err = base64.StdEncoding.DecodeString(tmp[2]); err != nil {
-				return
-			}
-			upArr := strings.Split(string(up), ":")
-			if len(upArr) != 2 {
-				return nil, errors.New("user:password error:" + string(up))
-			}
-			user, password = upArr[0], upArr[1]
-		}
-	}
-
-	// callback auth and get new proxy setting if need
 	var newAuth string
-	if newAuth, err = o.PI.OnAuth(o.Client, user, password); err != nil {
+	if newAuth, err = o.auth(info); err != nil {
 		return
 	}
 
@@ -187,21 +194,61 @@ func (o *PProxy) checkAuth(info *httpProxyInfo) (conn net.Conn, err error) {
 	return
 }
 
-// HTTP二级代理
-func (o *PProxy) httpLevel2(info *httpProxyInfo, newAuth string) (conn net.Conn, err error) {
-	info.level2 = "http"
-
-	var u *url.URL
-	if u, err = url.Parse(newAuth); err != nil {
+// 验证账号，返回二级代理
+func (o *PProxy) auth(info *httpProxyInfo) (newAuth string, err error) {
+	// Proxy-Authorization: Basic eDp5
+	value := ""
+	if i := strings.IndexByte(info.authLine, ':'); i >= 0 {
+		value = info.authLine[i+1:]
+	}
+	target := ""
+	if f := strings.Fields(info.firstLine); len(f) == 3 {
+		target = f[1]
+	}
+	var c *Credential
+	if c, err = parseCredential(value, info.method, target); err != nil {
+		o.authFailed = true
 		return
 	}
+	if value != "" && !o.acceptsAuth(c.Scheme) {
+		o.authFailed = true
+		return "", errors.New("auth scheme not enabled: " + c.Scheme)
+	}
 
-	if !strings.Contains(u.Host, ":") {
-		u.Host += ":80"
+	// callback auth and get new proxy setting if need
+	return o.onCredential(c)
+}
+
+// HTTP入站是否接受认证方式
+func (o *PProxy) acceptsAuth(scheme string) bool {
+	if o.AuthSchemes == nil {
+		return scheme == AuthBasic
 	}
+	for _, s := range o.AuthSchemes {
+		if s == scheme {
+			return true
+		}
+	}
+	return false
+}
+
+// HTTPProxyError http二级代理CONNECT失败，带二级代理的响应状态
+type HTTPProxyError struct {
+	StatusCode   int
+	Status       string   // 407 Proxy Authentication Required
+	Authenticate []string // Proxy-Authenticate
+}
+
+func (e *HTTPProxyError) Error() string {
+	return "http proxy: " + e.Status
+}
+
+// HTTP二级代理，CONNECT时总是预先发送URL中的账号（Basic），407时按质询使用Digest或NTLMv2重试
+func (o *PProxy) httpLevel2(info *httpProxyInfo, u *url.URL, prev net.Conn) (conn net.Conn, err error) {
+	info.level2 = "http"
 
 	// Dail
-	if conn, err = net.Dial("tcp", u.Host); err != nil {
+	if conn, err = o.upstreamConn(prev, u); err != nil {
 		return
 	}
 	defer func() {
@@ -210,47 +257,102 @@ func (o *PProxy) httpLevel2(info *httpProxyInfo, newAuth string) (conn net.Conn,
 		}
 	}()
 
-	body := info.originHeader
-	if info.authLine != "" {
-		// replace proxy authorization
-		newAuthLine := "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(u.User.String())) + "\r\n"
-		body = strings.ReplaceAll(info.originHeader, info.authLine, newAuthLine)
+	// 普通HTTP请求由forwardHTTP逐个发送
+	if info.method != "CONNECT" {
+		return
+	}
+
+	// 保留客户端的请求头，替换账号
+	header := http.Header{}
+	if req, e := http.ReadRequest(bufio.NewReader(strings.NewReader(info.originHeader))); e == nil {
+		header = req.Header
 	}
-	if o.DebugWrite != nil {
-		o.DebugWrite(conn, []byte(body))
+	header.Del("Proxy-Authorization")
+	// 客户端没有User-Agent时不使用Go的默认值
+	if _, ok := header["User-Agent"]; !ok {
+		header.Set("User-Agent", "")
 	}
-	if _, err = conn.Write([]byte(body)); err != nil {
+
+	pa := newProxyAuth(u, "CONNECT", info.uri)
+	var auth string
+	if auth, err = pa.authorization(nil); err != nil {
 		return
 	}
+	var challenge []string
+	for retry := 0; ; retry++ {
+		req := &http.Request{
+			Method: "CONNECT",
+			URL:    &url.URL{Opaque: info.uri},
+			Host:   info.uri,
+			Header: header.Clone(),
+		}
+		if auth != "" {
+			req.Header.Set("Proxy-Authorization", auth)
+		}
 
-	if info.method == "CONNECT" {
-		buffer := make([]byte, 0, 0x100)
-		b := make([]byte, 1)
-		for {
-			if _, err = conn.Read(b); err != nil {
+		var resp *http.Response
+		if conn, resp, err = o.httpConnect(conn, req); err != nil {
+			return
+		}
+		if resp.StatusCode/100 == 2 {
+			return
+		}
+		he := &HTTPProxyError{StatusCode: resp.StatusCode, Status: resp.Status, Authenticate: resp.Header.Values("Proxy-Authenticate")}
+		err = he
+		// 第一次407或质询变化时（NTLM、Digest stale）重试，最多4次请求
+		if resp.StatusCode != http.StatusProxyAuthRequired || pa == nil || retry >= 3 ||
+			retry > 0 && strings.Join(he.Authenticate, "\n") == strings.Join(challenge, "\n") {
+			return
+		}
+		challenge = he.Authenticate
+		// 与刚发送的认证头相同时（如Basic密码错误）重试不会成功
+		sent := auth
+		if auth, _ = pa.authorization(challenge); auth == "" || auth == sent {
+			return
+		}
+
+		// 二级代理关闭连接时重新连接，链式时无法重连
+		if resp.Close {
+			if prev != nil {
 				return
 			}
-			buffer = append(buffer, b...)
-			if b[0] == '\n' && len(buffer) > 4 {
-				if bytes.HasSuffix(buffer, []byte("\r\n\r\n")) {
-					break
-				}
-			}
-
-			if len(buffer) >= cap(buffer) {
-				return nil, errors.New(string(buffer))
+			conn.Close()
+			if conn, err = o.upstreamConn(nil, u); err != nil {
+				return
 			}
 		}
-		if o.DebugRead != nil {
-			o.DebugRead(conn, buffer)
-		}
+	}
+}
 
-		// HTTP/1.1 200 OK \r\n\r\n
-		// HTTP/1.1 200 Connection Established \r\n\r\n
-		if !bytes.Contains(buffer, []byte("HTTP/1.1 200")) {
-			return nil, errors.New(string(buffer))
-		}
+// 发送CONNECT，读取响应头，多读的数据放回连接
+func (o *PProxy) httpConnect(conn net.Conn, req *http.Request) (net.Conn, *http.Response, error) {
+	var buf bytes.Buffer
+	req.Write(&buf)
+	o.debugWrite(PhaseLevel2, conn, buf.Bytes())
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		return conn, nil, err
 	}
 
-	return
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return conn, nil, err
+	}
+	if resp.ProtoMajor != 1 {
+		return conn, nil, errors.New("http proxy: unsupported protocol " + resp.Proto)
+	}
+	if resp.StatusCode/100 != 2 && !resp.Close {
+		// 读完响应体才能在同一连接上重试
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 0x10000))
+		resp.Body.Close()
+	}
+	if b, e := httputil.DumpResponse(resp, false); e == nil {
+		o.debugRead(PhaseLevel2, conn, b)
+	}
+
+	if n := br.Buffered(); n > 0 {
+		prefix, _ := br.Peek(n)
+		conn = &proxyConn{Conn: conn, prefix: append([]byte{}, prefix...)}
+	}
+	return conn, resp, nil
 }
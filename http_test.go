@@ -0,0 +1,137 @@
+package pproxy
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// http代理，handle返回每个请求的响应，2xx后转为echo
+func startHTTPProxy(t *testing.T, handle func(req *http.Request) string) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				for {
+					req, err := http.ReadRequest(br)
+					if err != nil {
+						return
+					}
+					resp := handle(req)
+					conn.Write([]byte(resp))
+					if strings.Contains(resp, " 2") {
+						io.Copy(conn, br)
+						return
+					}
+					if strings.Contains(resp, "Connection: close") {
+						return
+					}
+				}
+			}(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// http代理，依次返回responses，收到的请求发给reqs
+func startConnectProxy(t *testing.T, responses []string, reqs chan<- *http.Request) string {
+	var mu sync.Mutex
+	return startHTTPProxy(t, func(req *http.Request) string {
+		reqs <- req
+		mu.Lock()
+		defer mu.Unlock()
+		resp := responses[0]
+		responses = responses[1:]
+		return resp
+	})
+}
+
+// go test pproxy -run Test_HTTPLevel2 -v -count=1
+func Test_HTTPLevel2(t *testing.T) {
+	const (
+		ok      = "HTTP/1.0 201 Created\r\n\r\n"
+		denied  = "HTTP/1.1 403 Forbidden\r\nContent-Length: 4\r\n\r\ndeny"
+		auth    = "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic realm=\"p\"\r\nContent-Length: 4\r\n\r\nauth"
+		authEnd = "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic realm=\"p\"\r\nConnection: close\r\n\r\n"
+	)
+	echo := "127.0.0.1:9"
+	basic := "Basic YTpiQGM=" // a:b@c
+
+	// 总是预先发送Basic，407的质询与已发送的相同时不重试
+	for _, c := range []struct {
+		responses []string
+		requests  int
+		status    int
+	}{
+		{[]string{ok}, 1, 0},
+		{[]string{denied}, 1, 403},
+		{[]string{auth}, 1, 407},
+		{[]string{authEnd}, 1, 407},
+	} {
+		reqs := make(chan *http.Request, 2)
+		p := startConnectProxy(t, c.responses, reqs)
+		conn, err := NewDialer("http://a:b%40c@"+p).Dial("tcp", echo)
+		for i := 0; i < c.requests; i++ {
+			req := <-reqs
+			if req.Method != "CONNECT" || req.Host != echo || req.Header.Get("Proxy-Authorization") != basic || req.UserAgent() != "pproxy" {
+				t.Fatal(c.responses, req)
+			}
+		}
+		var he *HTTPProxyError
+		if c.status == 0 {
+			if err != nil {
+				t.Fatal(c.responses, err)
+			}
+			conn.Close()
+		} else if !errors.As(err, &he) || he.StatusCode != c.status {
+			t.Fatal(c.responses, err)
+		}
+		if c.status == 407 && (len(he.Authenticate) != 1 || he.Authenticate[0] != `Basic realm="p"`) {
+			t.Fatal(he.Authenticate)
+		}
+	}
+
+	// 客户端没有User-Agent时不添加
+	reqs := make(chan *http.Request, 1)
+	p := startConnectProxy(t, []string{connected}, reqs)
+	if err := connectEcho(startProxy(t, &allowAll{level2: "http://" + p}, nil), startEcho(t)); err != nil {
+		t.Fatal(err)
+	}
+	if req := <-reqs; len(req.Header["User-Agent"]) != 0 {
+		t.Fatal(req.Header)
+	}
+
+	// 响应头后面的数据不能丢，没有账号时不发送Proxy-Authorization
+	reqs = make(chan *http.Request, 1)
+	p = startConnectProxy(t, []string{"HTTP/1.1 200 OK\r\n\r\nhello"}, reqs)
+	conn, err := NewDialer("http://"+p).Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if req := <-reqs; req.Header.Get("Proxy-Authorization") != "" {
+		t.Fatal(req.Header)
+	}
+	conn.SetDeadline(time.Now().Add(time.Second * 3))
+	conn.Write([]byte("ping"))
+	bs := make([]byte, 9)
+	if _, err = io.ReadFull(conn, bs); err != nil || string(bs) != "helloping" {
+		t.Fatal(err, string(bs))
+	}
+}
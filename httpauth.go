@@ -0,0 +1,308 @@
+package pproxy
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"golang.org/x/crypto/md4"
+)
+
+// 二级代理认证，按Proxy-Authenticate质询生成Proxy-Authorization
+// 第一个请求预先发送Basic，收到质询后优先NTLM，其次Digest，最后Basic
+type proxyAuth struct {
+	user, password string
+	method, uri    string // Digest用，CONNECT host:port
+	nc             int    // Digest请求计数
+
+	next   string            // 普通HTTP请求的认证头
+	params map[string]string // 最近的Digest质询，普通HTTP请求递增nc
+}
+
+func newProxyAuth(u *url.URL, method, uri string) *proxyAuth {
+	if u.User == nil {
+		return nil
+	}
+	o := &proxyAuth{user: u.User.Username(), method: method, uri: uri}
+	o.password, _ = u.User.Password()
+	o.next = o.basic()
+	return o
+}
+
+// 按质询生成认证头，没有质询时为预先发送的Basic，不支持的质询返回空
+func (o *proxyAuth) authorization(challenges []string) (string, error) {
+	if o == nil {
+		return "", nil
+	}
+	o.params = nil
+	if len(challenges) == 0 {
+		return o.basic(), nil
+	}
+
+	var digest, basic map[string]string
+	for _, c := range challenges {
+		scheme, params, token := parseChallenge(c)
+		switch scheme {
+		case "ntlm":
+			if token == "" {
+				return "NTLM " + base64.StdEncoding.EncodeToString(ntlmNegotiate()), nil
+			}
+			return o.ntlm(token)
+		case "digest":
+			if digest == nil && digestHash(params["algorithm"]) != nil {
+				digest = params
+			}
+		case "basic":
+			basic = params
+		}
+	}
+	if digest != nil {
+		o.params = digest
+		return o.digest(digest)
+	}
+	if basic != nil {
+		return o.basic(), nil
+	}
+	return "", nil
+}
+
+// 经二级代理的普通HTTP请求的认证头：Basic每次发送，Digest按最近的质询递增nc，NTLM认证后连接不再需要
+func (o *proxyAuth) header(method, uri string) string {
+	if o == nil {
+		return ""
+	}
+	o.method, o.uri = method, uri
+	if o.params != nil {
+		h, _ := o.digest(o.params)
+		return h
+	}
+	h := o.next
+	if strings.HasPrefix(h, "NTLM ") {
+		o.next = ""
+	}
+	return h
+}
+
+func (o *proxyAuth) basic() string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(o.user+":"+o.password))
+}
+
+// 解析质询：scheme小写，参数名小写；NTLM等返回token68
+func parseChallenge(s string) (scheme string, params map[string]string, token string) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexByte(s, ' ')
+	if i < 0 {
+		return strings.ToLower(s), nil, ""
+	}
+	scheme, s = strings.ToLower(s[:i]), strings.TrimSpace(s[i+1:])
+	// token68只在结尾有=
+	if !strings.Contains(strings.TrimRight(s, "="), "=") {
+		return scheme, nil, s
+	}
+
+	params = map[string]string{}
+	for s != "" {
+		i = strings.IndexByte(s, '=')
+		if i < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:i]))
+		s = strings.TrimSpace(s[i+1:])
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			var b strings.Builder
+			j := 1
+			for ; j < len(s) && s[j] != '"'; j++ {
+				if s[j] == '\\' && j+1 < len(s) {
+					j++
+				}
+				b.WriteByte(s[j])
+			}
+			if j < len(s) {
+				j++
+			}
+			value, s = b.String(), s[j:]
+		} else if i = strings.IndexByte(s, ','); i >= 0 {
+			value, s = strings.TrimSpace(s[:i]), s[i:]
+		} else {
+			value, s = s, ""
+		}
+		params[key] = value
+		s = strings.TrimLeft(s, ", ")
+	}
+	return
+}
+
+// Digest算法，不支持返回nil
+func digestHash(algorithm string) func() hash.Hash {
+	switch strings.ToUpper(strings.TrimSuffix(strings.ToLower(algorithm), "-sess")) {
+	case "", "MD5":
+		return md5.New
+	case "SHA-256":
+		return sha256.New
+	}
+	return nil
+}
+
+// Digest认证 RFC 7616，支持MD5、SHA-256及-sess，qop只支持auth
+func (o *proxyAuth) digest(params map[string]string) (string, error) {
+	newHash := digestHash(params["algorithm"])
+	h := func(s string) string {
+		d := newHash()
+		d.Write([]byte(s))
+		return hex.EncodeToString(d.Sum(nil))
+	}
+
+	realm, nonce := params["realm"], params["nonce"]
+	cnonce := make([]byte, 8)
+	if _, err := rand.Read(cnonce); err != nil {
+		return "", err
+	}
+	return o.digestResponse(h, params, hex.EncodeToString(cnonce), realm, nonce), nil
+}
+
+// Digest的response值，qop为空时是RFC 2069格式
+func digestValue(h func(string) string, algorithm, user, realm, password, method, uri, nonce, nc, cnonce, qop string) string {
+	ha1 := h(user + ":" + realm + ":" + password)
+	if strings.HasSuffix(strings.ToLower(algorithm), "-sess") {
+		ha1 = h(ha1 + ":" + nonce + ":" + cnonce)
+	}
+	ha2 := h(method + ":" + uri)
+	if qop == "" {
+		return h(ha1 + ":" + nonce + ":" + ha2)
+	}
+	return h(ha1 + ":" + nonce + ":" + nc + ":" + cnonce + ":" + qop + ":" + ha2)
+}
+
+func (o *proxyAuth) digestResponse(h func(string) string, params map[string]string, cnonce, realm, nonce string) string {
+	qop := ""
+	for _, q := range strings.Split(params["qop"], ",") {
+		if strings.TrimSpace(q) == "auth" {
+			qop = "auth"
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `Digest username="%s", realm="%s", nonce="%s", uri="%s"`, o.user, realm, nonce, o.uri)
+	if qop == "" {
+		fmt.Fprintf(&b, `, response="%s"`, digestValue(h, params["algorithm"], o.user, realm, o.password, o.method, o.uri, nonce, "", "", ""))
+	} else {
+		o.nc++
+		nc := fmt.Sprintf("%08x", o.nc)
+		fmt.Fprintf(&b, `, qop=%s, nc=%s, cnonce="%s", response="%s"`, qop, nc, cnonce,
+			digestValue(h, params["algorithm"], o.user, realm, o.password, o.method, o.uri, nonce, nc, cnonce, qop))
+	}
+	if a := params["algorithm"]; a != "" {
+		fmt.Fprintf(&b, `, algorithm=%s`, a)
+	}
+	if opaque, ok := params["opaque"]; ok {
+		fmt.Fprintf(&b, `, opaque="%s"`, opaque)
+	}
+	return b.String()
+}
+
+// NTLM标志：UNICODE OEM REQUEST_TARGET NTLM ALWAYS_SIGN EXTENDED_SESSIONSECURITY
+const ntlmFlags = 0x00088207
+
+var ntlmSignature = []byte("NTLMSSP\x00")
+
+// NTLM协商消息
+func ntlmNegotiate() []byte {
+	b := make([]byte, 32)
+	copy(b, ntlmSignature)
+	binary.LittleEndian.PutUint32(b[8:], 1)
+	binary.LittleEndian.PutUint32(b[12:], ntlmFlags)
+	return b
+}
+
+// NTLMv2认证消息，账号可以是 DOMAIN\user
+func (o *proxyAuth) ntlm(token string) (string, error) {
+	challenge, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return "", err
+	}
+	if len(challenge) < 48 || string(challenge[:8]) != string(ntlmSignature) || binary.LittleEndian.Uint32(challenge[8:]) != 2 {
+		return "", errors.New("ntlm: challenge message error")
+	}
+	serverChallenge := challenge[24:32]
+	l, off := int(binary.LittleEndian.Uint16(challenge[40:])), int(binary.LittleEndian.Uint32(challenge[44:]))
+	if off+l > len(challenge) {
+		return "", errors.New("ntlm: target info error")
+	}
+	targetInfo := challenge[off : off+l]
+
+	domain, user := "", o.user
+	if i := strings.IndexByte(user, '\\'); i >= 0 {
+		domain, user = user[:i], user[i+1:]
+	}
+	clientChallenge := make([]byte, 8)
+	if _, err = rand.Read(clientChallenge); err != nil {
+		return "", err
+	}
+	// FILETIME: 1601年起的100纳秒数
+	timestamp := uint64(time.Now().UnixNano()/100) + 116444736000000000
+
+	nt, lm := ntlmV2Response(user, o.password, domain, serverChallenge, clientChallenge, timestamp, targetInfo)
+	return "NTLM " + base64.StdEncoding.EncodeToString(ntlmAuthenticate(domain, user, lm, nt)), nil
+}
+
+// NTLMv2响应 MS-NLMP 3.3.2
+func ntlmV2Response(user, password, domain string, serverChallenge, clientChallenge []byte, timestamp uint64, targetInfo []byte) (nt, lm []byte) {
+	d := md4.New()
+	d.Write(utf16le(password))
+	key := hmacMD5(d.Sum(nil), utf16le(strings.ToUpper(user)+domain))
+
+	temp := make([]byte, 28, 28+len(targetInfo)+4)
+	temp[0], temp[1] = 1, 1
+	binary.LittleEndian.PutUint64(temp[8:], timestamp)
+	copy(temp[16:], clientChallenge)
+	temp = append(temp, targetInfo...)
+	temp = append(temp, 0, 0, 0, 0)
+
+	nt = append(hmacMD5(key, append(append([]byte{}, serverChallenge...), temp...)), temp...)
+	lm = append(hmacMD5(key, append(append([]byte{}, serverChallenge...), clientChallenge...)), clientChallenge...)
+	return
+}
+
+// NTLM认证消息
+func ntlmAuthenticate(domain, user string, lm, nt []byte) []byte {
+	fields := [][]byte{lm, nt, utf16le(domain), utf16le(user), nil, nil} // LM NT Domain User Workstation SessionKey
+	b := make([]byte, 64)
+	copy(b, ntlmSignature)
+	binary.LittleEndian.PutUint32(b[8:], 3)
+	for i, f := range fields {
+		p := 12 + i*8
+		binary.LittleEndian.PutUint16(b[p:], uint16(len(f)))
+		binary.LittleEndian.PutUint16(b[p+2:], uint16(len(f)))
+		binary.LittleEndian.PutUint32(b[p+4:], uint32(len(b)))
+		b = append(b, f...)
+	}
+	binary.LittleEndian.PutUint32(b[60:], ntlmFlags)
+	return b
+}
+
+func hmacMD5(key, data []byte) []byte {
+	m := hmac.New(md5.New, key)
+	m.Write(data)
+	return m.Sum(nil)
+}
+
+func utf16le(s string) []byte {
+	u := utf16.Encode([]rune(s))
+	b := make([]byte, len(u)*2)
+	for i, c := range u {
+		binary.LittleEndian.PutUint16(b[i*2:], c)
+	}
+	return b
+}
@@ -0,0 +1,191 @@
+package pproxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const connected = "HTTP/1.1 200 Connection Established\r\n\r\n"
+
+// 407，质询为challenge
+func challengeResponse(challenge string) string {
+	return "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: " + challenge + "\r\nContent-Length: 0\r\n\r\n"
+}
+
+// go test pproxy -run Test_HTTPAuth -v -count=1
+func Test_HTTPAuth(t *testing.T) {
+	// RFC 2617 3.5
+	pa := &proxyAuth{user: "Mufasa", password: "Circle Of Life", method: "GET", uri: "/dir/index.html"}
+	h := func(s string) string {
+		d := md5.Sum([]byte(s))
+		return hex.EncodeToString(d[:])
+	}
+	s := pa.digestResponse(h, map[string]string{"qop": "auth,auth-int", "opaque": "5ccc069c403ebaf9f0171e9517f40e41"},
+		"0a4f113b", "testrealm@host.com", "dcd98b7102dd2f0e8b11d0f600bfb0c093")
+	if !strings.Contains(s, `response="6629fae49393a05397450978507c4ef1"`) || !strings.Contains(s, "nc=00000001") {
+		t.Fatal(s)
+	}
+
+	// MS-NLMP 4.2.4
+	info, _ := hex.DecodeString("02000c0044006f006d00610069006e0001000c0053006500720076006500720000000000")
+	serverChallenge, _ := hex.DecodeString("0123456789abcdef")
+	nt, _ := ntlmV2Response("User", "Password", "Domain", serverChallenge, bytes.Repeat([]byte{0xaa}, 8), 0, info)
+	if s := hex.EncodeToString(nt[:16]); s != "68cd0ab851e51c96aabc927bebef6a1c" {
+		t.Fatal(s)
+	}
+
+	// 质询解析
+	scheme, params, token := parseChallenge(`Digest realm="a \"b\", c", nonce=xyz, qop="auth"`)
+	if scheme != "digest" || params["realm"] != `a "b", c` || params["nonce"] != "xyz" || params["qop"] != "auth" || token != "" {
+		t.Fatal(scheme, params, token)
+	}
+	if scheme, _, token = parseChallenge("NTLM TlRMTVNTUAACAAAA=="); scheme != "ntlm" || token != "TlRMTVNTUAACAAAA==" {
+		t.Fatal(scheme, token)
+	}
+
+	echo := startEcho(t)
+	u, _ := url.Parse("http://u1:p1@h")
+
+	// Digest SHA-256，不接受Basic
+	digest := startHTTPProxy(t, func(req *http.Request) string {
+		scheme, params, _ := parseChallenge(req.Header.Get("Proxy-Authorization"))
+		if scheme != "digest" {
+			return challengeResponse(`Digest realm="r", nonce="n1", qop="auth", algorithm=SHA-256, opaque="o"`)
+		}
+		sum := func(s string) string {
+			d := sha256.Sum256([]byte(s))
+			return hex.EncodeToString(d[:])
+		}
+		ha1 := sum("u1:r:p1")
+		ha2 := sum("CONNECT:" + echo)
+		want := sum(ha1 + ":n1:" + params["nc"] + ":" + params["cnonce"] + ":auth:" + ha2)
+		if params["username"] != "u1" || params["uri"] != echo || params["opaque"] != "o" || params["response"] != want {
+			return "HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n"
+		}
+		return connected
+	})
+	if err := connectEcho(startProxy(t, &allowAll{level2: "http://u1:p1@" + digest}, nil), echo); err != nil {
+		t.Fatal(err)
+	}
+	if err := connectEcho(startProxy(t, &allowAll{level2: "http://u1:bad@" + digest}, nil), echo); err == nil {
+		t.Fatal("want error")
+	}
+
+	// NTLMv2：协商、质询、认证在同一连接
+	challenge := make([]byte, 48)
+	copy(challenge, ntlmSignature)
+	binary.LittleEndian.PutUint32(challenge[8:], 2)
+	copy(challenge[24:], serverChallenge)
+	binary.LittleEndian.PutUint16(challenge[40:], uint16(len(info)))
+	binary.LittleEndian.PutUint16(challenge[42:], uint16(len(info)))
+	binary.LittleEndian.PutUint32(challenge[44:], 48)
+	challenge = append(challenge, info...)
+	ntlm := startHTTPProxy(t, func(req *http.Request) string {
+		auth := req.Header.Get("Proxy-Authorization")
+		if !strings.HasPrefix(auth, "NTLM ") {
+			return challengeResponse("NTLM")
+		}
+		b, _ := base64.StdEncoding.DecodeString(auth[5:])
+		if len(b) < 32 || !bytes.Equal(b[:8], ntlmSignature) {
+			return "HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\n\r\n"
+		}
+		if binary.LittleEndian.Uint32(b[8:]) == 1 {
+			return challengeResponse("NTLM " + base64.StdEncoding.EncodeToString(challenge))
+		}
+		if len(b) < 64 {
+			return "HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\n\r\n"
+		}
+		field := func(p int) []byte {
+			l, off := binary.LittleEndian.Uint16(b[p:]), binary.LittleEndian.Uint32(b[p+4:])
+			return b[off : off+uint32(l)]
+		}
+		nt, domain, user := field(20), field(28), field(36)
+		want, _ := ntlmV2Response("u1", "p1", "CORP", serverChallenge, nt[32:40], binary.LittleEndian.Uint64(nt[24:]), info)
+		if !bytes.Equal(domain, utf16le("CORP")) || !bytes.Equal(user, utf16le("u1")) || !bytes.Equal(nt, want) {
+			return "HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n"
+		}
+		return connected
+	})
+	if err := connectEcho(startProxy(t, &allowAll{level2: `http://CORP%5Cu1:p1@` + ntlm}, nil), echo); err != nil {
+		t.Fatal(err)
+	}
+	if err := connectEcho(startProxy(t, &allowAll{level2: `http://CORP%5Cu1:bad@` + ntlm}, nil), echo); err == nil {
+		t.Fatal("want error")
+	}
+
+	// 普通HTTP请求也按质询认证，密码包含保留字符
+	plain := startHTTPProxy(t, func(req *http.Request) string {
+		scheme, params, _ := parseChallenge(req.Header.Get("Proxy-Authorization"))
+		if scheme != "digest" {
+			return challengeResponse(`Digest realm="r", nonce="n2", qop="auth"`)
+		}
+		h := func(s string) string {
+			d := md5.Sum([]byte(s))
+			return hex.EncodeToString(d[:])
+		}
+		want := digestValue(h, "", "u1", "r", "p@1", "GET", req.RequestURI, "n2", params["nc"], params["cnonce"], "auth")
+		if req.Method != "GET" || params["uri"] != req.RequestURI || params["response"] != want {
+			return "HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\n\r\n"
+		}
+		return "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"
+	})
+	p := startProxy(t, &allowAll{level2: "http://u1:p%401@" + plain}, nil)
+	conn, err := net.DialTimeout("tcp", p, time.Second*3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 3))
+	conn.Write([]byte("GET http://example.com/a?b=1 HTTP/1.1\r\nHost: example.com\r\nProxy-Authorization: Basic eDp5\r\n\r\n"))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatal(resp, err)
+	}
+
+	// 新连接的第一个请求预先发送Basic，超过64K不能重发的请求体不会收到407
+	basic := startHTTPProxy(t, func(req *http.Request) string {
+		n, _ := io.Copy(ioutil.Discard, req.Body)
+		if req.Header.Get("Proxy-Authorization") != "Basic dTE6cEAx" {
+			return challengeResponse(`Basic realm="r"`)
+		}
+		body := strconv.FormatInt(n, 10)
+		return "HTTP/1.1 200 OK\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + body
+	})
+	p = startProxy(t, &allowAll{level2: "http://u1:p%401@" + basic}, nil)
+	conn2, err := net.DialTimeout("tcp", p, time.Second*3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn2.Close()
+	conn2.SetDeadline(time.Now().Add(time.Second * 3))
+	const size = 0x10000 * 2
+	go conn2.Write([]byte("POST http://example.com/upload HTTP/1.1\r\nHost: example.com\r\nProxy-Authorization: Basic eDp5\r\nContent-Length: " +
+		strconv.Itoa(size) + "\r\n\r\n" + strings.Repeat("x", size)))
+	resp, err = http.ReadResponse(bufio.NewReader(conn2), nil)
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatal(resp, err)
+	}
+	if bs, _ := ioutil.ReadAll(resp.Body); string(bs) != strconv.Itoa(size) {
+		t.Fatal(string(bs))
+	}
+
+	// 不支持的质询不重试
+	pa = newProxyAuth(u, "CONNECT", echo)
+	if s, err := pa.authorization([]string{"Negotiate abc"}); s != "" || err != nil {
+		t.Fatal(s, err)
+	}
+}
@@ -0,0 +1,439 @@
+package pproxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// hop-by-hop 头，不转发
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// 普通HTTP请求转发器，逐个解析请求，到目标的连接可以放回Pool复用
+type httpForwarder struct {
+	pp      *PProxy
+	newAuth string // OnAuth返回的二级代理
+	pool    *Pool
+	fixed   bool   // 固定使用一个目标连接，TLS拦截时使用
+	scheme  string // 客户端请求的协议，默认http
+}
+
+// 普通HTTP代理请求
+// 返回的连接交给调用方CopyHelper，请求在内部逐个转发
+func (o *PProxy) forwardHTTP(info *httpProxyInfo, header []byte) (conn net.Conn, err error) {
+	f := &httpForwarder{pp: o, pool: o.Pool}
+	if f.newAuth, err = o.auth(info); err != nil {
+		return
+	}
+	if f.newAuth != "" {
+		if _, err = o.resolveRoute(f.newAuth); err != nil {
+			return
+		}
+	}
+	if f.pool == nil {
+		f.pool = &Pool{MaxIdle: 1}
+	}
+
+	// 先连接第一个目标，失败直接返回错误
+	var pc *poolConn
+	if pc, err = f.get(info.uri); err != nil {
+		return
+	}
+
+	local, remote := net.Pipe()
+	go f.serve(remote, io.MultiReader(bytes.NewReader(header), remote), info.uri, pc)
+
+	c := o.wrapConn(local)
+	if cc, ok := c.Conn.(*captureConn); ok {
+		// 第一个请求头已经读取
+		cc.stream.write(true, header)
+	}
+	conn = c
+	o.success(conn)
+	return
+}
+
+func (o *httpForwarder) key(target string) string {
+	// PROXY头包含客户端地址，不能给其他客户端复用
+	if o.newAuth != "" && o.pp.sendsProxyHeader(o.newAuth) {
+		return o.newAuth + "|" + target + "|" + o.pp.session.ClientAddr
+	}
+	// 按出口地址复用
+	if o.newAuth != "" {
+		if r, err := o.pp.resolveRoute(o.newAuth); err == nil {
+			// 直连时第一跳是目标，否则是二级代理
+			first := ""
+			if len(r.Upstreams) == 0 {
+				first = target
+			}
+			if ip, _ := o.pp.sourceIP(first); ip != nil {
+				return o.newAuth + "|" + target + "|" + ip.String()
+			}
+		}
+	}
+	return o.newAuth + "|" + target
+}
+
+// 从连接池取或新建到目标的连接
+func (o *httpForwarder) get(target string) (pc *poolConn, err error) {
+	if pc = o.pool.get(o.key(target)); pc != nil {
+		// 复用的连接计入当前会话
+		if pc.upstream != "" {
+			up := o.pp.router().upstream(pc.upstream)
+			atomic.AddInt64(&up.active, 1)
+			o.pp.onClose = append(o.pp.onClose, func() { atomic.AddInt64(&up.active, -1) })
+			o.pp.session.Upstream = pc.upstream
+		}
+		pc.bind(o.pp)
+		return
+	}
+
+	info := &httpProxyInfo{method: "GET", uri: target}
+	var conn net.Conn
+	if o.newAuth != "" {
+		if conn, err = o.pp.level2(info, o.newAuth); err != nil {
+			return
+		}
+	}
+	if conn == nil {
+		if conn, err = o.pp.dialTCP(target); err != nil {
+			return
+		}
+	}
+
+	pc = newPoolConn(conn)
+	pc.upstream = o.pp.session.Upstream
+	if info.level2 == "http" {
+		pc.viaProxy = true
+		if u, err := url.Parse(pc.upstream); err == nil {
+			pc.proxyAuth = newProxyAuth(u, "", "")
+			if !strings.Contains(pc.upstream, ChainSep) {
+				pc.redial = u
+			}
+		}
+	}
+	pc.bind(o.pp)
+	return
+}
+
+// 逐个转发请求
+func (o *httpForwarder) serve(conn net.Conn, r io.Reader, target string, pc *poolConn) {
+	defer conn.Close()
+	defer func() {
+		if pc != nil {
+			pc.Close()
+		}
+		if o.pool != nil && o.pool != o.pp.Pool {
+			o.pool.CloseIdle()
+		}
+	}()
+
+	br := bufio.NewReader(r)
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+
+		if req.URL.Host == "" {
+			req.URL.Host = req.Host
+		}
+		if req.URL.Scheme == "" {
+			req.URL.Scheme = o.scheme
+			if o.scheme == "" {
+				req.URL.Scheme = "http"
+			}
+		}
+
+		// Middleware直接返回响应
+		var resp *http.Response
+		if resp, err = o.request(req); err != nil {
+			writeError(conn, http.StatusBadGateway, err)
+			return
+		}
+		if resp != nil {
+			io.Copy(ioutil.Discard, req.Body)
+			resp.Close = resp.Close || req.Close
+			if err = resp.Write(conn); err != nil || resp.Close {
+				return
+			}
+			continue
+		}
+
+		if o.fixed {
+			keepClient, keepServer, err := o.roundTrip(conn, br, req, pc)
+			if err != nil || !keepClient || !keepServer {
+				return
+			}
+			continue
+		}
+
+		reqTarget := requestTarget(req)
+		if pc != nil && reqTarget != target {
+			o.pool.put(o.key(target), pc)
+			pc = nil
+		}
+		if pc == nil {
+			if pc, err = o.get(reqTarget); err != nil {
+				writeError(conn, http.StatusBadGateway, err)
+				return
+			}
+		}
+		target = reqTarget
+
+		keepClient, keepServer, err := o.roundTrip(conn, br, req, pc)
+		if err != nil {
+			return
+		}
+		if keepServer {
+			o.pool.put(o.key(target), pc)
+		} else {
+			pc.Close()
+		}
+		pc = nil
+		if !keepClient {
+			return
+		}
+	}
+}
+
+// 转发一个请求，返回是否可以继续使用客户端和目标连接
+// br为客户端的读取缓冲，协议升级后继续从中读取
+func (o *httpForwarder) roundTrip(conn net.Conn, br *bufio.Reader, req *http.Request, pc *poolConn) (keepClient, keepServer bool, err error) {
+	// 客户端要求关闭不影响到目标连接的复用
+	clientClose := req.Close
+	req.Close = false
+	upgrade := upgradeType(req.Header)
+	removeHopHeaders(req.Header)
+	if upgrade != "" {
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", upgrade)
+	}
+
+	var rec *harRecord
+	if c := o.pp.captureHAR(); c != nil {
+		rec = c.recordHAR(req)
+	}
+
+	var resp *http.Response
+	if pc.viaProxy {
+		resp, err = o.proxyRoundTrip(pc, req, rec)
+	} else if err = req.Write(pc); err == nil {
+		if rec != nil {
+			rec.sent = time.Now()
+		}
+		resp, err = http.ReadResponse(pc.br, req)
+	}
+	if err != nil {
+		writeError(conn, http.StatusBadGateway, err)
+		return
+	}
+	defer resp.Body.Close()
+	for _, m := range o.pp.middlewares() {
+		if err = m.Response(o.pp.session, req, resp); err != nil {
+			writeError(conn, http.StatusBadGateway, err)
+			return
+		}
+	}
+	o.pp.inspect(req, resp)
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		if rec != nil {
+			rec.done(o.pp.session, req, resp, rec.response(resp))
+		}
+		return false, false, o.upgrade(conn, br, pc, upgrade, resp)
+	}
+
+	keepServer = !resp.Close
+	resp.Close = resp.Close || clientClose
+	removeHopHeaders(resp.Header)
+	var respBody *bodyRecorder
+	if rec != nil {
+		respBody = rec.response(resp)
+	}
+	if err = resp.Write(conn); err != nil {
+		return
+	}
+	if rec != nil {
+		rec.done(o.pp.session, req, resp, respBody)
+	}
+
+	return !resp.Close, keepServer, nil
+}
+
+// 经二级HTTP代理发送请求，407时按质询认证后在同一连接重发
+// 重发需要缓存请求体，超过64K时只发送一次
+func (o *httpForwarder) proxyRoundTrip(pc *poolConn, req *http.Request, rec *harRecord) (resp *http.Response, err error) {
+	const maxReplay = 0x10000
+	replay := pc.proxyAuth != nil
+	var body []byte
+	if replay && req.Body != nil && req.Body != http.NoBody {
+		if body, err = ioutil.ReadAll(io.LimitReader(req.Body, maxReplay+1)); err != nil {
+			return
+		}
+		if len(body) > maxReplay {
+			replay = false
+			req.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(body), req.Body))
+		}
+	}
+
+	var challenge []string
+	for retry := 0; ; retry++ {
+		if replay && body != nil {
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		req.Header.Del("Proxy-Authorization")
+		sent := pc.proxyAuth.header(req.Method, req.URL.String())
+		if sent != "" {
+			req.Header.Set("Proxy-Authorization", sent)
+		}
+		if err = req.WriteProxy(pc); err != nil {
+			return
+		}
+		if rec != nil {
+			rec.sent = time.Now()
+		}
+		if resp, err = http.ReadResponse(pc.br, req); err != nil {
+			return
+		}
+
+		// 第一次407或质询变化时重试，同一连接最多4次请求
+		authenticate := resp.Header.Values("Proxy-Authenticate")
+		if resp.StatusCode != http.StatusProxyAuthRequired || !replay || resp.Close && pc.redial == nil || retry >= 3 ||
+			retry > 0 && strings.Join(authenticate, "\n") == strings.Join(challenge, "\n") {
+			return
+		}
+		challenge = authenticate
+		var h string
+		if h, _ = pc.proxyAuth.authorization(challenge); h == "" || h == sent {
+			return
+		}
+		pc.proxyAuth.next = h
+		if resp.Close {
+			var conn net.Conn
+			if conn, err = o.pp.upstreamConn(nil, pc.redial); err != nil {
+				return
+			}
+			pc.raw.Close()
+			pc.raw = conn
+			pc.Conn = o.pp.debugConn(conn)
+			pc.br = bufio.NewReader(pc.Conn)
+			continue
+		}
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxReplay))
+		resp.Body.Close()
+	}
+}
+
+// 101 Switching Protocols 之后双向转发原始数据
+func (o *httpForwarder) upgrade(conn net.Conn, br *bufio.Reader, pc *poolConn, upgrade string, resp *http.Response) error {
+	respUpgrade := resp.Header.Get("Upgrade")
+	if upgrade == "" || !strings.EqualFold(respUpgrade, upgrade) {
+		err := errors.New("unexpected upgrade: " + respUpgrade)
+		writeError(conn, http.StatusBadGateway, err)
+		return err
+	}
+
+	removeHopHeaders(resp.Header)
+	resp.Header.Set("Connection", "Upgrade")
+	resp.Header.Set("Upgrade", respUpgrade)
+	var buf bytes.Buffer
+	buf.WriteString("HTTP/1.1 " + resp.Status + "\r\n")
+	resp.Header.Write(&buf)
+	buf.WriteString("\r\n")
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		io.Copy(pc, br)
+		pc.Close()
+		close(done)
+	}()
+	io.Copy(conn, pc.br)
+	conn.Close()
+	<-done
+	return nil
+}
+
+// 执行请求Middleware
+func (o *httpForwarder) request(req *http.Request) (resp *http.Response, err error) {
+	for _, m := range o.pp.middlewares() {
+		if resp, err = m.Request(o.pp.session, req); err != nil || resp != nil {
+			return
+		}
+	}
+	return
+}
+
+// 请求目标 host:port
+func requestTarget(req *http.Request) string {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host += ":80"
+	}
+	return host
+}
+
+// 请求升级的协议，例如websocket，没有升级返回空
+func upgradeType(h http.Header) string {
+	for _, v := range h["Connection"] {
+		for _, k := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(k), "upgrade") {
+				return h.Get("Upgrade")
+			}
+		}
+	}
+	return ""
+}
+
+// 删除hop-by-hop头，包括Connection中列出的头
+func removeHopHeaders(h http.Header) {
+	for _, v := range h["Connection"] {
+		for _, k := range strings.Split(v, ",") {
+			if k = strings.TrimSpace(k); k != "" {
+				h.Del(k)
+			}
+		}
+	}
+	for _, k := range hopHeaders {
+		h.Del(k)
+	}
+}
+
+// 返回错误页面
+func writeError(conn net.Conn, code int, err error) {
+	body := err.Error()
+	resp := &http.Response{
+		StatusCode:    code,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Close:         true,
+	}
+	resp.Write(conn)
+}
@@ -0,0 +1,168 @@
+package pproxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// Inbound 入站协议，Handshake按顺序用客户端最先发送的数据探测
+type Inbound struct {
+	Name      string                            // 协议名，即Session.Protocol
+	Peek      int                               // 探测需要的字节数，0按1
+	Sniff     func(o *PProxy, b []byte) bool    // b为客户端最先发送的数据，至少Peek个字节
+	Handshake func(o *PProxy) (net.Conn, error) // o.Client会重放探测时读取的数据，返回到目标的连接
+}
+
+var (
+	inboundMu sync.RWMutex
+	inbounds  []*Inbound
+)
+
+// RegisterInbound 注册入站协议，同名时替换，否则加在http前面
+// 内置 pproxy socks5 socks4 tls http，http兜底：其他协议都不匹配时按HTTP处理
+func RegisterInbound(in *Inbound) {
+	inboundMu.Lock()
+	defer inboundMu.Unlock()
+	for i, v := range inbounds {
+		if v.Name == in.Name {
+			inbounds[i] = in
+			return
+		}
+	}
+	if n := len(inbounds); n > 0 && inbounds[n-1].Name == "http" {
+		inbounds = append(inbounds[:n-1], in, inbounds[n-1])
+		return
+	}
+	inbounds = append(inbounds, in)
+}
+
+func init() {
+	RegisterInbound(&Inbound{Name: "pproxy", Sniff: func(o *PProxy, b []byte) bool { return o.Hop.accepts(b[0]) },
+		Handshake: firstByte((*PProxy).handshakeHop)})
+	RegisterInbound(&Inbound{Name: "socks5", Sniff: func(o *PProxy, b []byte) bool { return b[0] == 0x5 },
+		Handshake: firstByte((*PProxy).handshakeSocks5)})
+	RegisterInbound(&Inbound{Name: "socks4", Sniff: func(o *PProxy, b []byte) bool { return b[0] == 0x4 },
+		Handshake: (*PProxy).handshakeSocks4})
+	RegisterInbound(&Inbound{Name: "tls", Sniff: func(o *PProxy, b []byte) bool { return o.TLS != nil && b[0] == 0x16 },
+		Handshake: (*PProxy).handshakeTLS})
+	RegisterInbound(&Inbound{Name: "http", Sniff: func(o *PProxy, b []byte) bool { return true },
+		Handshake: firstByte((*PProxy).handshakeHTTP)})
+}
+
+// 内置协议先读第一个字节
+func firstByte(f func(o *PProxy, prefix []byte) (net.Conn, error)) func(o *PProxy) (net.Conn, error) {
+	return func(o *PProxy) (net.Conn, error) {
+		prefix := make([]byte, 1)
+		if _, err := io.ReadFull(o.Client, prefix); err != nil {
+			return nil, err
+		}
+		return f(o, prefix)
+	}
+}
+
+// 当前连接启用的入站协议
+func (o *PProxy) inbounds() (list []*Inbound, err error) {
+	// 都以ClientHello开头，无法区分
+	if o.TLS != nil && o.Hop != nil && o.Hop.TLS != nil {
+		return nil, errors.New("tls inbound and Hop.TLS cannot both be set")
+	}
+	inboundMu.RLock()
+	defer inboundMu.RUnlock()
+	if o.Inbounds == nil {
+		return append(list, inbounds...), nil
+	}
+	for _, name := range o.Inbounds {
+		var in *Inbound
+		for _, v := range inbounds {
+			if v.Name == name {
+				in = v
+				break
+			}
+		}
+		if in == nil {
+			return nil, errors.New("unknown inbound protocol: " + name)
+		}
+		list = append(list, in)
+	}
+	return
+}
+
+// 探测入站协议，读取的数据放回o.Client
+func (o *PProxy) sniff() (in *Inbound, err error) {
+	var list []*Inbound
+	if list, err = o.inbounds(); err != nil {
+		return
+	}
+
+	var buf []byte
+	defer func() {
+		if len(buf) == 0 {
+			return
+		}
+		if pc, ok := o.Client.(*proxyConn); ok {
+			pc.prefix = append(buf, pc.prefix...)
+		} else {
+			o.Client = &proxyConn{Conn: o.Client, prefix: buf}
+		}
+	}()
+	for _, in = range list {
+		n := in.Peek
+		if n < 1 {
+			n = 1
+		}
+		for len(buf) < n {
+			b := make([]byte, n-len(buf))
+			var m int
+			m, err = o.Client.Read(b)
+			buf = append(buf, b[:m]...)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if in.Sniff(o, buf) {
+			return
+		}
+	}
+	return nil, errors.New("unknown inbound protocol")
+}
+
+// TLS入站，解密后再探测里面的协议，Protocol为 协议+tls
+func (o *PProxy) handshakeTLS() (conn net.Conn, err error) {
+	t := &hopTransport{Conn: o.Client}
+	tc := tls.Server(t, o.TLS)
+	if err = tc.Handshake(); err != nil {
+		return
+	}
+	o.Client = tc
+
+	var in *Inbound
+	if in, err = o.sniff(); err != nil {
+		return
+	}
+	if in.Name == "tls" {
+		return nil, errors.New("nested tls")
+	}
+	o.session.Protocol = in.Name + "+tls"
+	if conn, err = in.Handshake(o); err != nil {
+		return
+	}
+
+	// 调用方读写管道的另一端，TLS在管道上解密后转发到目标
+	local, remote := net.Pipe()
+	t.Conn = remote
+	go relay(o.Client, conn)
+	return &Conn{Conn: local, Session: o.session}, nil
+}
+
+// 双向转发，一个方向结束时关闭两个连接
+func relay(a, b net.Conn) {
+	go func() {
+		io.Copy(a, b)
+		a.Close()
+	}()
+	io.Copy(b, a)
+	b.Close()
+}
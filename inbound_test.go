@@ -0,0 +1,211 @@
+package pproxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 经socks4a连接echo
+func socks4Echo(conn net.Conn, target, userid string) error {
+	conn.SetDeadline(time.Now().Add(time.Second * 3))
+	host, port, _ := net.SplitHostPort(target)
+	p, _ := strconv.Atoi(port)
+	b := []byte{0x4, 0x1, 0, 0, 0, 0, 0, 1}
+	binary.BigEndian.PutUint16(b[2:4], uint16(p))
+	b = append(b, userid...)
+	b = append(b, 0)
+	b = append(b, host...)
+	b = append(b, 0)
+	if _, err := conn.Write(b); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(conn, b[:8]); err != nil {
+		return err
+	}
+	if b[0] != 0 || b[1] != 0x5A {
+		return errors.New("socks4 rejected")
+	}
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		return err
+	}
+	bs := make([]byte, 4)
+	if _, err := io.ReadFull(conn, bs); err != nil {
+		return err
+	}
+	if string(bs) != "ping" {
+		return errors.New("echo error: " + string(bs))
+	}
+	return nil
+}
+
+// 校验密码
+type checkPassword struct {
+	allowAll
+	password string
+}
+
+func (o *checkPassword) OnAuth(conn net.Conn, user, password string) (string, error) {
+	if password != o.password {
+		return "", errors.New("password error")
+	}
+	return "", nil
+}
+
+// go test pproxy -run Test_Inbound -v -count=1
+func Test_Inbound(t *testing.T) {
+	echo := startEcho(t)
+
+	// socks4a，USERID为 user:password
+	p1 := startProxy(t, &checkPassword{password: "p1"}, nil)
+	for _, userid := range []string{"u1:p1", "u1:bad"} {
+		conn, err := net.Dial("tcp", p1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = socks4Echo(conn, echo, userid)
+		conn.Close()
+		if (userid == "u1:p1") != (err == nil) {
+			t.Fatal(userid, err)
+		}
+	}
+
+	// TLS里的socks4和http
+	ca, roots := testCA(t)
+	interceptor, err := NewInterceptor(ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := interceptor.cert("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions := make(chan *Session, 1)
+	p2 := startProxy(t, &recordChoose{chosen: sessions}, func(pp *PProxy) {
+		pp.TLS = &tls.Config{Certificates: []tls.Certificate{*cert}}
+	})
+	var conn net.Conn
+	if conn, err = tls.Dial("tcp", p2, &tls.Config{RootCAs: roots, ServerName: "127.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = socks4Echo(conn, echo, "a:b"); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if s := <-sessions; s.Protocol != "socks4+tls" || s.Target != echo {
+		t.Fatal(s)
+	}
+	if conn, err = tls.Dial("tcp", p2, &tls.Config{RootCAs: roots, ServerName: "127.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("CONNECT " + echo + " HTTP/1.1\r\nHost: " + echo + "\r\nProxy-Authorization: Basic eDp5\r\n\r\n"))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	conn.Close()
+	if err != nil || !strings.Contains(line, " 200 ") {
+		t.Fatal(line, err)
+	}
+	if s := <-sessions; s.Protocol != "http+tls" {
+		t.Fatal(s)
+	}
+
+	// 自定义协议：HELO target\n，回复OK\n
+	RegisterInbound(&Inbound{
+		Name: "helo",
+		Peek: 5,
+		Sniff: func(o *PProxy, b []byte) bool {
+			return string(b[:5]) == "HELO "
+		},
+		Handshake: func(o *PProxy) (net.Conn, error) {
+			b := make([]byte, 5)
+			if _, err := io.ReadFull(o.Client, b); err != nil {
+				return nil, err
+			}
+			var target []byte
+			b = b[:1]
+			for {
+				if _, err := io.ReadFull(o.Client, b); err != nil {
+					return nil, err
+				}
+				if b[0] == '\n' {
+					break
+				}
+				target = append(target, b[0])
+			}
+			return o.Connect("a", "b", string(target), func() error {
+				_, err := o.Client.Write([]byte("OK\n"))
+				return err
+			})
+		},
+	})
+	// 只启用部分协议
+	p3 := startProxy(t, &recordChoose{chosen: sessions}, func(pp *PProxy) { pp.Inbounds = []string{"helo", "socks5"} })
+	if conn, err = net.Dial("tcp", p3); err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 3))
+	conn.Write([]byte("HELO " + echo + "\nping"))
+	bs := make([]byte, 7)
+	if _, err = io.ReadFull(conn, bs); err != nil || string(bs) != "OK\nping" {
+		t.Fatal(err, string(bs))
+	}
+	if s := <-sessions; s.Protocol != "helo" || s.Target != echo {
+		t.Fatal(s)
+	}
+	if err = connectEcho(p3, echo); err == nil {
+		t.Fatal("http disabled")
+	}
+	p4 := startProxy(t, &allowAll{}, func(pp *PProxy) { pp.Inbounds = []string{"nope"} })
+	if err = connectEcho(p4, echo); err == nil {
+		t.Fatal("want error")
+	}
+	// http兜底，新注册的协议在http前面
+	list, _ := (&PProxy{}).inbounds()
+	if last := list[len(list)-1]; last.Name != "http" || list[len(list)-2].Name != "helo" || !last.Sniff(nil, []byte{'x'}) {
+		t.Fatal(last.Name)
+	}
+	// 都是ClientHello，不能同时设置
+	cfg := &tls.Config{Certificates: []tls.Certificate{*cert}}
+	if _, err = (&PProxy{TLS: cfg, Hop: &Hop{TLS: cfg}}).inbounds(); err == nil {
+		t.Fatal("want error")
+	}
+
+	// 探测和TLS入站不改变PI收到的连接
+	client, server := net.Pipe()
+	pi := &recordConn{conns: make(chan net.Conn, 2)}
+	pp := &PProxy{Client: server, PI: pi, TLS: cfg}
+	go func() {
+		if conn, err := pp.Handshake(); err == nil {
+			CopyHelper(server, conn)
+		}
+	}()
+	conn = tls.Client(client, &tls.Config{RootCAs: roots, ServerName: "127.0.0.1"})
+	if err = socks4Echo(conn, echo, "a:b"); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if c1, c2 := <-pi.conns, <-pi.conns; c1 != server || c2 != server {
+		t.Fatal(c1, c2)
+	}
+}
+
+// 记录OnAuth、OnSuccess收到的客户端连接
+type recordConn struct {
+	conns chan net.Conn
+}
+
+func (o *recordConn) OnAuth(conn net.Conn, user, password string) (string, error) {
+	o.conns <- conn
+	return "", nil
+}
+func (o *recordConn) OnSuccess(clientConn net.Conn, serverConn net.Conn) {
+	o.conns <- clientConn
+}
@@ -0,0 +1,243 @@
+package pproxy
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBuckets 默认直方图分段，单位秒
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Metrics Prometheus格式的统计，作为Observer使用，作为http.Handler输出 /metrics
+// 多个PProxy共享同一个Metrics
+type Metrics struct {
+	PerUser bool      // 按账号统计，账号多时会产生大量序列
+	Buckets []float64 // 直方图分段，默认DefaultBuckets
+
+	once    sync.Once
+	mu      sync.Mutex
+	metrics []*metric
+	byName  map[string]*metric
+	gauges  []*metricFunc
+}
+
+type metric struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+	series map[string]*series
+}
+
+type series struct {
+	labels []string
+	value  float64
+	counts []uint64 // 直方图每段计数
+	sum    float64
+}
+
+type metricFunc struct {
+	name string
+	help string
+	fn   func() float64
+}
+
+func (o *Metrics) init() {
+	o.once.Do(func() {
+		if len(o.Buckets) == 0 {
+			o.Buckets = DefaultBuckets
+		}
+		o.byName = map[string]*metric{}
+		user := []string{}
+		if o.PerUser {
+			user = []string{"user"}
+		}
+		o.define("pproxy_sessions_total", "Established proxy sessions.", "counter", append([]string{"protocol"}, user...)...)
+		o.define("pproxy_sessions_active", "Active proxy sessions.", "gauge", "protocol")
+		o.define("pproxy_handshake_seconds", "Time from accept to tunnel established.", "histogram", "protocol")
+		o.define("pproxy_handshake_failures_total", "Failed handshakes.", "counter", "protocol")
+		o.define("pproxy_auth_failures_total", "Failed authentications.", "counter", append([]string{"protocol"}, user...)...)
+		o.define("pproxy_upstream_dial_seconds", "TCP dial latency to target or upstream proxy.", "histogram", "upstream")
+		o.define("pproxy_upstream_errors_total", "Failed upstream proxy attempts.", "counter", "upstream")
+		o.define("pproxy_bytes_total", "Bytes transferred, up is client to server.", "counter", append([]string{"direction"}, user...)...)
+		o.define("pproxy_source_sessions_total", "Established sessions by outbound source address.", "counter", "source")
+		o.define("pproxy_source_bytes_total", "Bytes transferred by outbound source address.", "counter", "source", "direction")
+	})
+}
+
+func (o *Metrics) define(name, help, typ string, labels ...string) {
+	m := &metric{name: name, help: help, typ: typ, labels: labels, series: map[string]*series{}}
+	o.metrics = append(o.metrics, m)
+	o.byName[name] = m
+}
+
+// Gauge 添加自定义指标，输出时调用fn取值
+func (o *Metrics) Gauge(name, help string, fn func() float64) {
+	o.init()
+	o.mu.Lock()
+	o.gauges = append(o.gauges, &metricFunc{name: name, help: help, fn: fn})
+	o.mu.Unlock()
+}
+
+// 取序列，调用前加锁
+func (o *Metrics) series(name string, labels ...string) *series {
+	m := o.byName[name]
+	key := strings.Join(labels, "\x00")
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{labels: labels}
+		if m.typ == "histogram" {
+			s.counts = make([]uint64, len(o.Buckets))
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+func (o *Metrics) add(name string, v float64, labels ...string) {
+	o.series(name, labels...).value += v
+}
+
+func (o *Metrics) observe(name string, d time.Duration, labels ...string) {
+	s := o.series(name, labels...)
+	sec := d.Seconds()
+	for i, b := range o.Buckets {
+		if sec <= b {
+			s.counts[i]++
+		}
+	}
+	s.sum += sec
+	s.value++
+}
+
+// 账号标签
+func (o *Metrics) user(labels []string, s *Session) []string {
+	if o.PerUser {
+		return append(labels, s.User)
+	}
+	return labels
+}
+
+// 二级代理去掉账号密码，用于统计和日志
+func redactUpstream(upstream string) string {
+	if upstream == "" {
+		return "direct"
+	}
+	if strings.Contains(upstream, ChainSep) {
+		hops := strings.Split(upstream, ChainSep)
+		for i, h := range hops {
+			hops[i] = redactUpstream(strings.TrimSpace(h))
+		}
+		return strings.Join(hops, ChainSep)
+	}
+	if u, err := url.Parse(upstream); err == nil && u.Host != "" {
+		return u.Scheme + "://" + u.Host
+	}
+	return upstream
+}
+
+// OnEvent ...
+func (o *Metrics) OnEvent(e *Event) {
+	o.init()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	switch e.Type {
+	case EventTunnelEstablished:
+		o.add("pproxy_sessions_total", 1, o.user([]string{e.Protocol}, e.Session)...)
+		o.add("pproxy_sessions_active", 1, e.Protocol)
+		o.observe("pproxy_handshake_seconds", e.Elapsed, e.Protocol)
+		if e.Session.SourceIP != "" {
+			o.add("pproxy_source_sessions_total", 1, e.Session.SourceIP)
+		}
+	case EventTunnelClosed:
+		o.add("pproxy_sessions_active", -1, e.Protocol)
+		o.add("pproxy_bytes_total", float64(e.BytesUp), o.user([]string{"up"}, e.Session)...)
+		o.add("pproxy_bytes_total", float64(e.BytesDown), o.user([]string{"down"}, e.Session)...)
+		if e.Session.SourceIP != "" {
+			o.add("pproxy_source_bytes_total", float64(e.BytesUp), e.Session.SourceIP, "up")
+			o.add("pproxy_source_bytes_total", float64(e.BytesDown), e.Session.SourceIP, "down")
+		}
+	case EventAuthResult:
+		if e.Err != nil {
+			o.add("pproxy_auth_failures_total", 1, o.user([]string{e.Protocol}, e.Session)...)
+		}
+	case EventUpstreamDialed:
+		o.observe("pproxy_upstream_dial_seconds", e.Duration, redactUpstream(e.Upstream))
+	case EventError:
+		if e.Upstream != "" {
+			o.add("pproxy_upstream_errors_total", 1, redactUpstream(e.Upstream))
+		} else {
+			o.add("pproxy_handshake_failures_total", 1, e.Protocol)
+		}
+	}
+}
+
+// ServeHTTP 输出Prometheus文本格式
+func (o *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(o.Text())
+}
+
+// Text Prometheus文本格式
+func (o *Metrics) Text() []byte {
+	o.init()
+	o.mu.Lock()
+	gauges := append([]*metricFunc{}, o.gauges...)
+	var buf bytes.Buffer
+	for _, m := range o.metrics {
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.typ)
+		keys := make([]string, 0, len(m.series))
+		for k := range m.series {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			s := m.series[k]
+			if m.typ != "histogram" {
+				fmt.Fprintf(&buf, "%s%s %s\n", m.name, metricLabels(m.labels, s.labels), metricValue(s.value))
+				continue
+			}
+			names := append(append([]string{}, m.labels...), "le")
+			values := append(append([]string{}, s.labels...), "")
+			for i, b := range o.Buckets {
+				values[len(values)-1] = metricValue(b)
+				fmt.Fprintf(&buf, "%s_bucket%s %d\n", m.name, metricLabels(names, values), s.counts[i])
+			}
+			values[len(values)-1] = "+Inf"
+			fmt.Fprintf(&buf, "%s_bucket%s %s\n", m.name, metricLabels(names, values), metricValue(s.value))
+			fmt.Fprintf(&buf, "%s_sum%s %s\n", m.name, metricLabels(m.labels, s.labels), metricValue(s.sum))
+			fmt.Fprintf(&buf, "%s_count%s %s\n", m.name, metricLabels(m.labels, s.labels), metricValue(s.value))
+		}
+	}
+	o.mu.Unlock()
+
+	// 回调不持锁
+	for _, g := range gauges {
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", g.name, g.help, g.name, g.name, metricValue(g.fn()))
+	}
+	return buf.Bytes()
+}
+
+func metricLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	ls := make([]string, len(names))
+	for i, n := range names {
+		v := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(values[i])
+		ls[i] = n + `="` + v + `"`
+	}
+	return "{" + strings.Join(ls, ",") + "}"
+}
+
+func metricValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
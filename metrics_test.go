@@ -0,0 +1,49 @@
+package pproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// go test pproxy -run Test_Metrics -v -count=1
+func Test_Metrics(t *testing.T) {
+	echo := startEcho(t)
+	good := startProxy(t, &allowAll{}, nil)
+	m := &Metrics{PerUser: true}
+	m.Gauge("pproxy_test_value", "Test.", func() float64 { return 2 })
+
+	p1 := startProxy(t, &allowAll{level2: "http://a:b@" + good}, func(pp *PProxy) { pp.Observer = m })
+	if err := connectEcho(p1, echo); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		`pproxy_sessions_total{protocol="http",user="x"} 1`,
+		`pproxy_sessions_active{protocol="http"} 0`,
+		`pproxy_handshake_seconds_count{protocol="http"} 1`,
+		`pproxy_upstream_dial_seconds_bucket{upstream="http://` + good + `",le="+Inf"} 1`,
+		`pproxy_bytes_total{direction="up",user="x"} 4`,
+		`pproxy_test_value 2`,
+	}
+	var body string
+	for i := 0; i < 30; i++ {
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		body = w.Body.String()
+		if strings.Contains(body, "pproxy_bytes_total{") {
+			break
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	for _, line := range want {
+		if !strings.Contains(body, line+"\n") {
+			t.Fatal("missing:", line, "\n"+body)
+		}
+	}
+	if strings.Contains(body, "a:b@") {
+		t.Fatal("credentials leaked")
+	}
+}
@@ -0,0 +1,151 @@
+package pproxy
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Middleware 修改普通HTTP转发和TLS拦截的请求/响应
+type Middleware interface {
+	// Request 修改请求，返回非nil响应时直接返回给客户端，不再转发
+	Request(s *Session, req *http.Request) (*http.Response, error)
+	// Response 修改响应
+	Response(s *Session, req *http.Request, resp *http.Response) error
+}
+
+// RequestFunc 只修改请求的Middleware
+type RequestFunc func(s *Session, req *http.Request) (*http.Response, error)
+
+// Request ...
+func (f RequestFunc) Request(s *Session, req *http.Request) (*http.Response, error) {
+	return f(s, req)
+}
+
+// Response ...
+func (f RequestFunc) Response(s *Session, req *http.Request, resp *http.Response) error {
+	return nil
+}
+
+// ResponseFunc 只修改响应的Middleware
+type ResponseFunc func(s *Session, req *http.Request, resp *http.Response) error
+
+// Request ...
+func (f ResponseFunc) Request(s *Session, req *http.Request) (*http.Response, error) {
+	return nil, nil
+}
+
+// Response ...
+func (f ResponseFunc) Response(s *Session, req *http.Request, resp *http.Response) error {
+	return f(s, req, resp)
+}
+
+// HeaderRule 头修改规则，按 Del、Set、Add 顺序执行
+type HeaderRule struct {
+	Del []string
+	Set map[string]string
+	Add map[string]string
+}
+
+func (o *HeaderRule) apply(h http.Header) {
+	for _, k := range o.Del {
+		h.Del(k)
+	}
+	for k, v := range o.Set {
+		h.Set(k, v)
+	}
+	for k, v := range o.Add {
+		h.Add(k, v)
+	}
+}
+
+// Headers 修改请求头和响应头
+type Headers struct {
+	Req  HeaderRule // 请求头
+	Resp HeaderRule // 响应头
+}
+
+// Request ...
+func (o *Headers) Request(s *Session, req *http.Request) (*http.Response, error) {
+	o.Req.apply(req.Header)
+	return nil, nil
+}
+
+// Response ...
+func (o *Headers) Response(s *Session, req *http.Request, resp *http.Response) error {
+	o.Resp.apply(resp.Header)
+	return nil
+}
+
+// RewriteURL 把以from开头的URL替换为to开头，例如 http://a.com/api/ => http://b.com/v2/
+// 普通HTTP转发时会连接新的目标
+func RewriteURL(from, to string) Middleware {
+	return RequestFunc(func(s *Session, req *http.Request) (*http.Response, error) {
+		u := req.URL.String()
+		if !strings.HasPrefix(u, from) {
+			return nil, nil
+		}
+		nu, err := req.URL.Parse(to + u[len(from):])
+		if err != nil {
+			return nil, err
+		}
+		req.URL, req.Host = nu, nu.Host
+		return nil, nil
+	})
+}
+
+// Via 请求和响应添加 Via: 1.1 name
+func Via(name string) Middleware {
+	return &Headers{
+		Req:  HeaderRule{Add: map[string]string{"Via": "1.1 " + name}},
+		Resp: HeaderRule{Add: map[string]string{"Via": "1.1 " + name}},
+	}
+}
+
+// XForwardedFor 请求添加客户端IP到 X-Forwarded-For
+func XForwardedFor() Middleware {
+	return RequestFunc(func(s *Session, req *http.Request) (*http.Response, error) {
+		ip, _, err := net.SplitHostPort(s.ClientAddr)
+		if err != nil {
+			return nil, nil
+		}
+		if prior := req.Header.Get("X-Forwarded-For"); prior != "" {
+			ip = prior + ", " + ip
+		}
+		req.Header.Set("X-Forwarded-For", ip)
+		return nil, nil
+	})
+}
+
+// Respond match返回true时直接返回指定响应，不转发
+func Respond(match func(s *Session, req *http.Request) bool, code int, header http.Header, body string) Middleware {
+	return RequestFunc(func(s *Session, req *http.Request) (*http.Response, error) {
+		if !match(s, req) {
+			return nil, nil
+		}
+		h := http.Header{}
+		for k, v := range header {
+			h[k] = append([]string{}, v...)
+		}
+		return &http.Response{
+			StatusCode:    code,
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        h,
+			Body:          ioutil.NopCloser(strings.NewReader(body)),
+			ContentLength: int64(len(body)),
+			Request:       req,
+		}, nil
+	})
+}
+
+// 当前会话使用的Middleware
+func (o *PProxy) middlewares() []Middleware {
+	if o.route == nil || len(o.route.Middlewares) == 0 {
+		return o.Middlewares
+	}
+	mws := make([]Middleware, 0, len(o.Middlewares)+len(o.route.Middlewares))
+	mws = append(mws, o.Middlewares...)
+	return append(mws, o.route.Middlewares...)
+}
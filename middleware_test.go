@@ -0,0 +1,73 @@
+package pproxy
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// go test pproxy -run Test_Middleware -v -count=1
+func Test_Middleware(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "test")
+		w.Write([]byte(strings.Join([]string{r.URL.Path, r.Header.Get("X-Test"), r.Header.Get("Via"), r.Header.Get("X-Forwarded-For"), r.Header.Get("X-Route")}, "|")))
+	}))
+	web := "http://" + ln.Addr().String()
+
+	router := &Router{}
+	router.SetRoute(&Route{Name: "direct", Middlewares: []Middleware{
+		&Headers{Req: HeaderRule{Set: map[string]string{"X-Route": "direct"}}},
+	}})
+	p1 := startProxy(t, &allowAll{level2: "route:direct"}, func(pp *PProxy) {
+		pp.Router = router
+		pp.Middlewares = []Middleware{
+			&Headers{
+				Req:  HeaderRule{Set: map[string]string{"X-Test": "1"}},
+				Resp: HeaderRule{Del: []string{"Server"}},
+			},
+			Via("pproxy"),
+			XForwardedFor(),
+			RewriteURL(web+"/old/", web+"/new/"),
+			Respond(func(s *Session, req *http.Request) bool {
+				return req.URL.Path == "/blocked"
+			}, http.StatusForbidden, nil, "blocked"),
+		}
+	})
+
+	u, _ := url.Parse("http://x:y@" + p1)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(u)}}
+	get := func(path string) (*http.Response, string) {
+		resp, err := client.Get(web + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		bs, _ := ioutil.ReadAll(resp.Body)
+		return resp, string(bs)
+	}
+
+	resp, body := get("/old/a")
+	if body != "/new/a|1|1.1 pproxy|127.0.0.1|direct" {
+		t.Fatal(body)
+	}
+	if resp.Header.Get("Server") != "" || resp.Header.Get("Via") != "1.1 pproxy" {
+		t.Fatal(resp.Header)
+	}
+
+	resp, body = get("/blocked")
+	if resp.StatusCode != http.StatusForbidden || body != "blocked" {
+		t.Fatal(resp.Status, body)
+	}
+
+	// 直接返回后连接可以继续使用
+	if _, body = get("/b"); !strings.HasPrefix(body, "/b|") {
+		t.Fatal(body)
+	}
+}
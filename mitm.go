@@ -0,0 +1,269 @@
+package pproxy
+
+import (
+	"bufio"
+	"container/list"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Interceptor TLS拦截（MITM），用配置的CA按SNI签发证书，解密后的HTTP交给Observer和Inspect
+// 仅用于调试，多个PProxy共享同一个Interceptor
+// 只拦截Users或Hosts匹配的会话，都为空时不拦截任何会话；全部拦截需设置Match返回true
+type Interceptor struct {
+	Users []string // 拦截的账号
+	Hosts []string // 拦截的目标主机，支持 *.example.com
+	// Match 自定义规则，设置后忽略Users和Hosts
+	Match func(s *Session) bool
+	// Inspect 解密后的HTTP请求，收到响应头后回调，Body正在转发不要读取
+	Inspect func(s *Session, req *http.Request, resp *http.Response)
+
+	InsecureSkipVerify bool // 不校验目标服务器证书
+	MaxCerts           int  // 缓存签发的证书数，超过时淘汰最久未用的，<=0为1000
+
+	ca    *x509.Certificate
+	caKey crypto.Signer
+	key   *ecdsa.PrivateKey // 签发证书共用的私钥
+
+	mu    sync.Mutex
+	certs map[string]*list.Element // host => 元素，值为*issuedCert
+	lru   list.List                // 最近使用的在前
+}
+
+// 缓存的证书
+type issuedCert struct {
+	host     string
+	cert     *tls.Certificate
+	notAfter time.Time
+}
+
+func (o *Interceptor) maxCerts() int {
+	if o.MaxCerts > 0 {
+		return o.MaxCerts
+	}
+	return 1000
+}
+
+// LoadInterceptor 从PEM文件加载CA，例如 ssl/mkca.sh 生成的 ca.crt ca.key
+func LoadInterceptor(certFile, keyFile string) (*Interceptor, error) {
+	ca, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return NewInterceptor(ca)
+}
+
+// NewInterceptor 使用CA证书创建拦截器
+func NewInterceptor(ca tls.Certificate) (o *Interceptor, err error) {
+	o = &Interceptor{}
+	if o.ca, err = x509.ParseCertificate(ca.Certificate[0]); err != nil {
+		return nil, err
+	}
+	var ok bool
+	if o.caKey, ok = ca.PrivateKey.(crypto.Signer); !ok {
+		return nil, errors.New("unsupported CA private key")
+	}
+	if o.key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// 是否拦截此会话
+func (o *Interceptor) match(s *Session) bool {
+	if o.Match != nil {
+		return o.Match(s)
+	}
+	for _, u := range o.Users {
+		if u == s.User {
+			return true
+		}
+	}
+	return matchHost(o.Hosts, s.Target)
+}
+
+// 目标主机是否匹配，支持 *.example.com
+func matchHost(hosts []string, target string) bool {
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		host = target
+	}
+	for _, h := range hosts {
+		if h == host || (strings.HasPrefix(h, "*.") && strings.HasSuffix(host, h[1:])) {
+			return true
+		}
+	}
+	return false
+}
+
+// 获取或签发host的证书
+func (o *Interceptor) cert(host string) (*tls.Certificate, error) {
+	if c := o.cached(host); c != nil {
+		return c, nil
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	notAfter := time.Now().AddDate(1, 0, 0)
+	if notAfter.After(o.ca.NotAfter) {
+		notAfter = o.ca.NotAfter
+	}
+	tpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		tpl.IPAddresses = []net.IP{ip}
+	} else {
+		tpl.DNSNames = []string{host}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tpl, o.ca, &o.key.PublicKey, o.caKey)
+	if err != nil {
+		return nil, err
+	}
+	c := &tls.Certificate{Certificate: [][]byte{der, o.ca.Raw}, PrivateKey: o.key}
+	return o.store(&issuedCert{host: host, cert: c, notAfter: notAfter}), nil
+}
+
+// 缓存中的证书，过期的不再使用
+func (o *Interceptor) cached(host string) *tls.Certificate {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	e, ok := o.certs[host]
+	if !ok {
+		return nil
+	}
+	ic := e.Value.(*issuedCert)
+	if time.Now().After(ic.notAfter) {
+		o.lru.Remove(e)
+		delete(o.certs, host)
+		return nil
+	}
+	o.lru.MoveToFront(e)
+	return ic.cert
+}
+
+// 加入缓存，同时签发的以先加入的为准
+func (o *Interceptor) store(ic *issuedCert) *tls.Certificate {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if e, ok := o.certs[ic.host]; ok {
+		o.lru.MoveToFront(e)
+		return e.Value.(*issuedCert).cert
+	}
+	if o.certs == nil {
+		o.certs = map[string]*list.Element{}
+	}
+	o.certs[ic.host] = o.lru.PushFront(ic)
+	for o.lru.Len() > o.maxCerts() {
+		e := o.lru.Back()
+		o.lru.Remove(e)
+		delete(o.certs, e.Value.(*issuedCert).host)
+	}
+	return ic.cert
+}
+
+// 带缓冲的连接，可以预读
+type bufConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (o *bufConn) Read(b []byte) (int, error) {
+	return o.r.Read(b)
+}
+
+// 拦截CONNECT/SOCKS5隧道，conn为已经建立的目标连接
+// 返回的连接交给调用方CopyHelper，TLS握手和HTTP转发在内部完成
+func (o *PProxy) intercept(conn net.Conn) (net.Conn, error) {
+	if !o.intercepting() {
+		return conn, nil
+	}
+	o.session.Intercepted = true
+
+	local, remote := net.Pipe()
+	go func() {
+		defer remote.Close()
+		defer conn.Close()
+
+		client := &bufConn{Conn: remote, r: bufio.NewReader(remote)}
+		prefix, err := client.r.Peek(1)
+		if err != nil {
+			return
+		}
+
+		// 非TLS直接按HTTP解析
+		var clientConn, serverConn net.Conn = client, conn
+		f := &httpForwarder{pp: o, fixed: true, scheme: "http"}
+		if prefix[0] == 0x16 {
+			host, _, _ := net.SplitHostPort(o.session.Target)
+			tlsClient := tls.Server(client, &tls.Config{
+				NextProtos: []string{"http/1.1"},
+				GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+					if hello.ServerName != "" {
+						return o.Interceptor.cert(hello.ServerName)
+					}
+					return o.Interceptor.cert(host)
+				},
+			})
+			if err = tlsClient.Handshake(); err != nil {
+				return
+			}
+
+			sni := tlsClient.ConnectionState().ServerName
+			if sni == "" {
+				sni = host
+			}
+			tlsServer := tls.Client(conn, &tls.Config{
+				ServerName:         sni,
+				NextProtos:         []string{"http/1.1"},
+				InsecureSkipVerify: o.Interceptor.InsecureSkipVerify,
+			})
+			if err = tlsServer.Handshake(); err != nil {
+				writeError(tlsClient, http.StatusBadGateway, err)
+				return
+			}
+			clientConn, serverConn = tlsClient, tlsServer
+			f.scheme = "https"
+		}
+
+		serverConn = o.debugConn(serverConn)
+		if stream := o.captureStream(); stream != nil {
+			serverConn = &captureConn{Conn: serverConn, stream: stream}
+		}
+		f.serve(clientConn, clientConn, o.session.Target, newPoolConn(serverConn))
+	}()
+
+	return &Conn{Conn: local, Session: o.session}, nil
+}
+
+// 是否拦截当前会话
+func (o *PProxy) intercepting() bool {
+	return o.Interceptor != nil && o.Interceptor.match(o.session)
+}
+
+// 回调Inspect
+func (o *PProxy) inspect(req *http.Request, resp *http.Response) {
+	if o.Interceptor != nil && o.Interceptor.Inspect != nil && o.session.Intercepted {
+		o.Interceptor.Inspect(o.session, req, resp)
+	}
+}
@@ -0,0 +1,129 @@
+package pproxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// 生成测试CA
+func testCA(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "PProxy Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+// go test pproxy -run Test_Intercept -v -count=1
+func Test_Intercept(t *testing.T) {
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", func() *tls.Config {
+		cert, err := tls.LoadX509KeyPair("ssl/ssl.crt", "ssl/ssl.key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &tls.Config{Certificates: []tls.Certificate{cert}}
+	}())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello " + r.URL.Path))
+	}))
+
+	ca, roots := testCA(t)
+	interceptor, err := NewInterceptor(ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	interceptor.Users = []string{"x"}
+	interceptor.InsecureSkipVerify = true
+	inspected := make(chan string, 1)
+	interceptor.Inspect = func(s *Session, req *http.Request, resp *http.Response) {
+		inspected <- s.User + " " + req.URL.Path + " " + resp.Status
+	}
+
+	level2 := startProxy(t, &allowAll{}, nil)
+	for _, l2 := range []string{"", "socks5://a:b@" + level2} {
+		for _, proxyURL := range []string{"http://x:y@", "socks5://x:y@"} {
+			p1 := startProxy(t, &allowAll{level2: l2}, func(pp *PProxy) { pp.Interceptor = interceptor })
+			u, _ := url.Parse(proxyURL + p1)
+			client := &http.Client{Transport: &http.Transport{
+				Proxy:           http.ProxyURL(u),
+				TLSClientConfig: &tls.Config{RootCAs: roots},
+			}}
+			resp, err := client.Get("https://" + ln.Addr().String() + "/mitm")
+			if err != nil {
+				t.Fatal(proxyURL, l2, err)
+			}
+			bs, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(bs) != "hello /mitm" {
+				t.Fatal(string(bs))
+			}
+			if resp.TLS.PeerCertificates[0].Issuer.CommonName != "PProxy Test CA" {
+				t.Fatal("not intercepted")
+			}
+			if s := <-inspected; s != "x /mitm 200 OK" {
+				t.Fatal(s)
+			}
+		}
+	}
+
+	// 不匹配的账号不拦截
+	interceptor.Users = []string{"nobody"}
+	interceptor.Hosts = []string{"*.example.com"}
+	p1 := startProxy(t, &allowAll{}, func(pp *PProxy) { pp.Interceptor = interceptor })
+	if err := connectEcho(p1, startEcho(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Users和Hosts都为空时不拦截
+	interceptor.Users, interceptor.Hosts = nil, nil
+	if interceptor.match(&Session{User: "x", Target: "a.example.com:443"}) {
+		t.Fatal("empty Users/Hosts matched")
+	}
+
+	// 证书缓存超过MaxCerts时淘汰最久未用的
+	interceptor.MaxCerts = 2
+	a, _ := interceptor.cert("a.example.com")
+	b, _ := interceptor.cert("b.example.com")
+	if c, _ := interceptor.cert("a.example.com"); c != a {
+		t.Fatal("a not cached")
+	}
+	interceptor.cert("c.example.com")
+	if interceptor.lru.Len() != 2 {
+		t.Fatal("cache size:", interceptor.lru.Len())
+	}
+	if c, _ := interceptor.cert("a.example.com"); c != a {
+		t.Fatal("recently used a evicted")
+	}
+	if c, _ := interceptor.cert("b.example.com"); c == b {
+		t.Fatal("b not evicted")
+	}
+}
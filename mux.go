@@ -0,0 +1,611 @@
+package pproxy
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 多路复用帧：类型1字节 + 流ID4字节 + 长度2字节 + 数据
+const (
+	muxSYN    = 1 // 打开流，数据为元数据
+	muxReply  = 2 // 打开结果
+	muxData   = 3
+	muxWindow = 4 // 窗口增量，4字节
+	muxFIN    = 5 // 关闭流
+	muxPing   = 6
+	muxPong   = 7
+
+	muxHeaderSize  = 7
+	muxMaxData     = 16 << 10
+	muxInitWindow  = 256 << 10 // 每个流的接收窗口
+	muxMaxStreams  = 64
+	muxKeepAlive   = 30 * time.Second
+	muxDialTimeout = 10 * time.Second
+	muxRetry       = 5 * time.Minute // 对方不支持多路复用时，多久后重新尝试
+)
+
+var errMuxUnsupported = errors.New("pproxy hop: peer does not support mux")
+
+// 读写超时
+type muxTimeout struct{}
+
+func (muxTimeout) Error() string   { return "i/o timeout" }
+func (muxTimeout) Timeout() bool   { return true }
+func (muxTimeout) Temporary() bool { return true }
+
+func (o *Hop) maxStreams() int {
+	if o.MaxStreams > 0 {
+		return o.MaxStreams
+	}
+	return muxMaxStreams
+}
+
+func (o *Hop) keepAlive() time.Duration {
+	if o.KeepAlive > 0 {
+		return o.KeepAlive
+	}
+	return muxKeepAlive
+}
+
+// 没有设置PProxy.Hop时使用，二级代理URL需要带psk参数
+var defaultHop = &Hop{}
+
+// 同一个二级代理的多路复用连接
+type muxGroup struct {
+	mu       sync.Mutex
+	sessions []*muxSession
+	retry    time.Time // 对方不支持多路复用，这之前不再尝试
+}
+
+// 取一个还有空闲流的连接，没有时新建
+func (o *muxGroup) get(max int, dial func() (*muxSession, error)) (*muxSession, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if time.Now().Before(o.retry) {
+		return nil, errMuxUnsupported
+	}
+	for _, s := range o.sessions {
+		if s.count() < max {
+			return s, nil
+		}
+	}
+
+	s, err := dial()
+	if err == errMuxUnsupported {
+		o.retry = time.Now().Add(muxRetry)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.onClose = func() { o.remove(s) }
+	s.start()
+	o.sessions = append(o.sessions, s)
+	return s, nil
+}
+
+func (o *muxGroup) remove(s *muxSession) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for i, v := range o.sessions {
+		if v == s {
+			o.sessions = append(o.sessions[:i], o.sessions[i+1:]...)
+			return
+		}
+	}
+}
+
+// 经多路复用连接打开流，对方不支持时返回errMuxUnsupported
+func (o *PProxy) hopMux(u *url.URL, meta *hopMeta) (net.Conn, error) {
+	hop := o.Hop
+	if hop == nil {
+		hop = defaultHop
+	}
+	key := *u
+	key.User = nil
+	// 不同出口地址的会话不共用连接
+	source, err := o.sourceIP(u.Host)
+	if err != nil {
+		return nil, err
+	}
+	v, _ := hop.muxes.LoadOrStore(key.String()+"|"+source.String(), &muxGroup{})
+
+	s, err := v.(*muxGroup).get(hop.maxStreams(), func() (*muxSession, error) {
+		// 连接由多个会话共用，不属于当前会话
+		pp := &PProxy{Hop: o.Hop, deadline: time.Now().Add(muxDialTimeout), source: source}
+		conn, err := pp.hopDial(nil, u)
+		if err != nil {
+			return nil, err
+		}
+		reply, err := hopRequest(conn, &hopMeta{Mux: true})
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if !reply.Mux {
+			conn.Close()
+			return nil, errMuxUnsupported
+		}
+		conn.SetDeadline(time.Time{})
+		return &muxSession{conn: conn, client: true, local: conn.LocalAddr(), remote: conn.RemoteAddr(), keepAlive: hop.keepAlive()}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	o.debugWrite(PhaseLevel2, s.conn, []byte(meta.Target))
+	deadline := o.deadline
+	if deadline.IsZero() {
+		deadline = time.Now().Add(muxDialTimeout)
+	}
+	return s.open(meta, deadline)
+}
+
+// 入站多路复用连接上的一个流，作为独立会话处理
+func (o *PProxy) serveMuxStream(st *muxStream, meta *hopMeta) {
+	pp := &PProxy{
+		Client:      st,
+		PI:          o.PI,
+		Router:      o.Router,
+		Pool:        o.Pool,
+		Interceptor: o.Interceptor,
+		Middlewares: o.Middlewares,
+		Capture:     o.Capture,
+		Observer:    o.Observer,
+		Hop:         o.Hop,
+		DebugRead:   o.DebugRead,
+		DebugWrite:  o.DebugWrite,
+	}
+	pp.session = &Session{
+		ID:         newSessionID(),
+		Start:      time.Now(),
+		Protocol:   "pproxy",
+		ClientAddr: o.session.ClientAddr,
+		ProxiedBy:  o.session.ProxiedBy,
+	}
+	pp.session.TraceID = pp.session.ID
+	pp.emit(&Event{Type: EventHandshakeStart})
+
+	defer st.Close()
+	conn, err := pp.hopConnect(meta)
+	if err == nil {
+		if err = st.writeReply(&hopReply{}); err != nil {
+			conn.Close()
+		}
+	}
+	if err != nil {
+		pp.emit(&Event{Type: EventError, Err: err})
+		st.writeReply(&hopReply{Error: err.Error()})
+		return
+	}
+	defer conn.Close()
+	pp.success(conn)
+	CopyHelper(st, conn)
+}
+
+// muxSession 一个多路复用连接，出站流ID为奇数
+type muxSession struct {
+	conn          net.Conn
+	client        bool
+	local, remote net.Addr
+	keepAlive     time.Duration
+	onStream      func(st *muxStream, meta *hopMeta) // 入站收到新流
+	onClose       func()
+
+	recv    int64 // 最后收到数据的时间 UnixNano
+	wmu     sync.Mutex
+	mu      sync.Mutex
+	streams map[uint32]*muxStream
+	nextID  uint32
+	closed  bool
+	done    chan struct{}
+}
+
+func (o *muxSession) start() {
+	o.init()
+	o.run()
+}
+
+func (o *muxSession) init() {
+	o.streams = map[uint32]*muxStream{}
+	o.nextID = 1
+	o.done = make(chan struct{})
+	o.recv = time.Now().UnixNano()
+}
+
+func (o *muxSession) run() {
+	go o.readLoop()
+	go o.ping()
+}
+
+func (o *muxSession) write(typ byte, id uint32, b []byte) error {
+	frame := make([]byte, muxHeaderSize, muxHeaderSize+len(b))
+	frame[0] = typ
+	binary.BigEndian.PutUint32(frame[1:], id)
+	binary.BigEndian.PutUint16(frame[5:], uint16(len(b)))
+	frame = append(frame, b...)
+
+	o.wmu.Lock()
+	defer o.wmu.Unlock()
+	// 对方失去响应时不会一直阻塞
+	o.conn.SetWriteDeadline(time.Now().Add(3 * o.keepAlive))
+	_, err := o.conn.Write(frame)
+	return err
+}
+
+func (o *muxSession) readLoop() {
+	defer o.Close()
+	h := make([]byte, muxHeaderSize)
+	for {
+		if _, err := io.ReadFull(o.conn, h); err != nil {
+			return
+		}
+		id := binary.BigEndian.Uint32(h[1:])
+		b := make([]byte, binary.BigEndian.Uint16(h[5:]))
+		if _, err := io.ReadFull(o.conn, b); err != nil {
+			return
+		}
+		atomic.StoreInt64(&o.recv, time.Now().UnixNano())
+
+		switch h[0] {
+		case muxSYN:
+			var meta hopMeta
+			if o.client || json.Unmarshal(b, &meta) != nil {
+				return
+			}
+			if st := o.add(id); st != nil {
+				go o.onStream(st, &meta)
+			}
+		case muxReply:
+			var reply hopReply
+			if json.Unmarshal(b, &reply) != nil {
+				return
+			}
+			if st := o.stream(id); st != nil {
+				select {
+				case st.reply <- &reply:
+				default:
+				}
+			}
+		case muxData:
+			if st := o.stream(id); st != nil && !st.push(b) {
+				return // 超过窗口
+			}
+		case muxWindow:
+			if st := o.stream(id); st != nil && len(b) == 4 {
+				st.grow(int(binary.BigEndian.Uint32(b)))
+			}
+		case muxFIN:
+			if st := o.stream(id); st != nil {
+				st.remoteClose()
+			}
+		case muxPing:
+			if o.write(muxPong, 0, nil) != nil {
+				return
+			}
+		case muxPong:
+		default:
+			return
+		}
+	}
+}
+
+// 心跳，3个间隔没有收到数据时断开
+func (o *muxSession) ping() {
+	t := time.NewTicker(o.keepAlive)
+	defer t.Stop()
+	for {
+		select {
+		case <-o.done:
+			return
+		case <-t.C:
+		}
+		if time.Since(time.Unix(0, atomic.LoadInt64(&o.recv))) > 3*o.keepAlive || o.write(muxPing, 0, nil) != nil {
+			o.Close()
+			return
+		}
+	}
+}
+
+func (o *muxSession) add(id uint32) *muxStream {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed || o.streams[id] != nil {
+		return nil
+	}
+	st := newMuxStream(o, id)
+	o.streams[id] = st
+	return st
+}
+
+func (o *muxSession) stream(id uint32) *muxStream {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.streams[id]
+}
+
+func (o *muxSession) remove(id uint32) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	delete(o.streams, id)
+}
+
+// 流数量，已关闭的连接返回最大值
+func (o *muxSession) count() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return int(^uint(0) >> 1)
+	}
+	return len(o.streams)
+}
+
+// 打开流，等待对方连接目标
+func (o *muxSession) open(meta *hopMeta, deadline time.Time) (net.Conn, error) {
+	o.mu.Lock()
+	if o.closed {
+		o.mu.Unlock()
+		return nil, io.ErrClosedPipe
+	}
+	id := o.nextID
+	o.nextID += 2
+	st := newMuxStream(o, id)
+	o.streams[id] = st
+	o.mu.Unlock()
+
+	bs, err := json.Marshal(meta)
+	if err == nil {
+		err = o.write(muxSYN, id, bs)
+	}
+	if err != nil {
+		st.Close()
+		return nil, err
+	}
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		t := time.NewTimer(time.Until(deadline))
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case reply := <-st.reply:
+		if reply.Error != "" {
+			st.Close()
+			return nil, errors.New("pproxy hop: " + reply.Error)
+		}
+		return st, nil
+	case <-o.done:
+		st.Close()
+		return nil, io.ErrClosedPipe
+	case <-timeout:
+		st.Close()
+		return nil, muxTimeout{}
+	}
+}
+
+// Close 关闭连接和所有流
+func (o *muxSession) Close() error {
+	o.mu.Lock()
+	if o.closed {
+		o.mu.Unlock()
+		return nil
+	}
+	o.closed = true
+	streams := o.streams
+	o.streams = nil
+	o.mu.Unlock()
+
+	close(o.done)
+	err := o.conn.Close()
+	for _, st := range streams {
+		st.remoteClose()
+	}
+	if o.onClose != nil {
+		o.onClose()
+	}
+	return err
+}
+
+// muxStream 多路复用连接上的一个流
+type muxStream struct {
+	s     *muxSession
+	id    uint32
+	reply chan *hopReply
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	rbuf     []byte
+	window   int  // 对方剩余的接收窗口
+	consumed int  // 已读取还没有通知对方的字节
+	eof      bool // 对方已关闭
+	closed   bool
+	rdl, wdl time.Time
+}
+
+func newMuxStream(s *muxSession, id uint32) *muxStream {
+	o := &muxStream{s: s, id: id, reply: make(chan *hopReply, 1), window: muxInitWindow}
+	o.cond = sync.NewCond(&o.mu)
+	return o
+}
+
+// 收到数据
+func (o *muxStream) push(b []byte) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return true
+	}
+	if len(o.rbuf)+len(b) > muxInitWindow {
+		return false
+	}
+	o.rbuf = append(o.rbuf, b...)
+	o.cond.Broadcast()
+	return true
+}
+
+// 对方增加窗口
+func (o *muxStream) grow(n int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.window += n
+	o.cond.Broadcast()
+}
+
+// 对方关闭或连接断开
+func (o *muxStream) remoteClose() {
+	o.mu.Lock()
+	o.eof = true
+	o.cond.Broadcast()
+	o.mu.Unlock()
+	o.s.remove(o.id)
+}
+
+func (o *muxStream) writeReply(reply *hopReply) error {
+	bs, err := json.Marshal(reply)
+	if err != nil {
+		return err
+	}
+	return o.s.write(muxReply, o.id, bs)
+}
+
+func (o *muxStream) Read(b []byte) (n int, err error) {
+	o.mu.Lock()
+	for len(o.rbuf) == 0 {
+		if err = o.readable(); err != nil {
+			o.mu.Unlock()
+			return
+		}
+		o.cond.Wait()
+	}
+	n = copy(b, o.rbuf)
+	if o.rbuf = o.rbuf[n:]; len(o.rbuf) == 0 {
+		o.rbuf = nil
+	}
+	// 读取一半窗口后通知对方
+	o.consumed += n
+	inc := 0
+	if o.consumed >= muxInitWindow/2 && !o.eof {
+		inc, o.consumed = o.consumed, 0
+	}
+	o.mu.Unlock()
+
+	if inc > 0 {
+		bs := make([]byte, 4)
+		binary.BigEndian.PutUint32(bs, uint32(inc))
+		o.s.write(muxWindow, o.id, bs)
+	}
+	return
+}
+
+func (o *muxStream) readable() error {
+	switch {
+	case o.closed:
+		return io.ErrClosedPipe
+	case o.eof:
+		return io.EOF
+	case !o.rdl.IsZero() && !time.Now().Before(o.rdl):
+		return muxTimeout{}
+	}
+	return nil
+}
+
+func (o *muxStream) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		o.mu.Lock()
+		for o.window == 0 {
+			if err = o.writable(); err != nil {
+				o.mu.Unlock()
+				return
+			}
+			o.cond.Wait()
+		}
+		if err = o.writable(); err != nil {
+			o.mu.Unlock()
+			return
+		}
+		m := len(b)
+		if m > o.window {
+			m = o.window
+		}
+		if m > muxMaxData {
+			m = muxMaxData
+		}
+		o.window -= m
+		o.mu.Unlock()
+
+		if err = o.s.write(muxData, o.id, b[:m]); err != nil {
+			return
+		}
+		n += m
+		b = b[m:]
+	}
+	return
+}
+
+func (o *muxStream) writable() error {
+	switch {
+	case o.closed, o.eof:
+		return io.ErrClosedPipe
+	case !o.wdl.IsZero() && !time.Now().Before(o.wdl):
+		return muxTimeout{}
+	}
+	return nil
+}
+
+// Close 通知对方关闭流
+func (o *muxStream) Close() error {
+	o.mu.Lock()
+	if o.closed {
+		o.mu.Unlock()
+		return nil
+	}
+	o.closed = true
+	o.cond.Broadcast()
+	o.mu.Unlock()
+
+	o.s.remove(o.id)
+	o.s.write(muxFIN, o.id, nil)
+	return nil
+}
+
+func (o *muxStream) LocalAddr() net.Addr  { return o.s.local }
+func (o *muxStream) RemoteAddr() net.Addr { return o.s.remote }
+
+func (o *muxStream) SetDeadline(t time.Time) error {
+	o.SetReadDeadline(t)
+	return o.SetWriteDeadline(t)
+}
+
+func (o *muxStream) SetReadDeadline(t time.Time) error {
+	o.mu.Lock()
+	o.rdl = t
+	o.mu.Unlock()
+	o.wakeAt(t)
+	return nil
+}
+
+func (o *muxStream) SetWriteDeadline(t time.Time) error {
+	o.mu.Lock()
+	o.wdl = t
+	o.mu.Unlock()
+	o.wakeAt(t)
+	return nil
+}
+
+// 到期时唤醒等待的读写
+func (o *muxStream) wakeAt(t time.Time) {
+	if t.IsZero() {
+		return
+	}
+	time.AfterFunc(time.Until(t), func() {
+		o.mu.Lock()
+		o.cond.Broadcast()
+		o.mu.Unlock()
+	})
+}
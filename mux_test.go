@@ -0,0 +1,125 @@
+package pproxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 通过HTTP代理CONNECT目标，发送size字节并验证echo，超过流窗口时需要流量控制
+func connectBulk(proxyAddr, target string, size int) error {
+	conn, err := net.DialTimeout("tcp", proxyAddr, time.Second*3)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 10))
+
+	if _, err = conn.Write([]byte("CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\n\r\n")); err != nil {
+		return err
+	}
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(line, " 200 ") {
+		return errors.New(line)
+	}
+	for line != "\r\n" {
+		if line, err = r.ReadString('\n'); err != nil {
+			return err
+		}
+	}
+
+	data := make([]byte, size)
+	rand.Read(data)
+	go conn.Write(data)
+	bs := make([]byte, size)
+	if _, err = io.ReadFull(r, bs); err != nil {
+		return err
+	}
+	if !bytes.Equal(bs, data) {
+		return errors.New("echo error")
+	}
+	return nil
+}
+
+// go test pproxy -run Test_Mux -v -count=1
+func Test_Mux(t *testing.T) {
+	echo := startEcho(t)
+	hop := &Hop{PSK: []byte("secret"), KeepAlive: time.Millisecond * 50}
+
+	sessions := make(chan *Session, 10)
+	h1 := startProxy(t, &recordChoose{chosen: sessions}, func(pp *PProxy) { pp.Hop = hop })
+	p1 := startProxy(t, &allowAll{level2: "pproxy://u1:p1@" + h1 + "?mux=1"}, func(pp *PProxy) { pp.Hop = hop })
+
+	// 多个会话共用一个连接
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- connectBulk(p1, echo, 1<<20)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 承载连接的会话先于流的会话
+	s := <-sessions
+	if s.Protocol != "pproxy" || s.Target != "" {
+		t.Fatal(s)
+	}
+	carrier := s.ClientAddr
+	for i := 0; i < 5; i++ {
+		s := <-sessions
+		if s.Protocol != "pproxy" || s.User != "u1" || s.Target != echo {
+			t.Fatal(s)
+		}
+		if s.ClientAddr != carrier {
+			t.Fatal("not multiplexed:", carrier, s.ClientAddr)
+		}
+	}
+
+	// 心跳保持空闲连接
+	time.Sleep(time.Millisecond * 300)
+	if err := connectEcho(p1, echo); err != nil {
+		t.Fatal(err)
+	}
+	if s := <-sessions; s.ClientAddr != carrier {
+		t.Fatal("carrier closed:", carrier, s.ClientAddr)
+	}
+
+	// 下一跳验证失败
+	h2 := startProxy(t, &denyAll{}, func(pp *PProxy) { pp.Hop = hop })
+	p1 = startProxy(t, &allowAll{level2: "pproxy://u1:p1@" + h2 + "?mux=1"}, func(pp *PProxy) { pp.Hop = hop })
+	if err := connectEcho(p1, echo); err == nil {
+		t.Fatal("want error")
+	}
+
+	// 对方不支持多路复用时每个会话单独连接
+	noMux := &Hop{PSK: []byte("secret"), NoMux: true}
+	h3 := startProxy(t, &recordChoose{chosen: sessions}, func(pp *PProxy) { pp.Hop = noMux })
+	p1 = startProxy(t, &allowAll{level2: "pproxy://u1:p1@" + h3 + "?mux=1"}, func(pp *PProxy) { pp.Hop = hop })
+	for i := 0; i < 2; i++ {
+		if err := connectEcho(p1, echo); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s1, s2 := <-sessions, <-sessions; s1.ClientAddr == s2.ClientAddr {
+		t.Fatal("want separate connections:", s1.ClientAddr)
+	}
+}
@@ -0,0 +1,165 @@
+package pproxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"time"
+)
+
+// EventType 事件类型
+type EventType int
+
+// ...
+const (
+	EventHandshakeStart     EventType = iota // 开始握手
+	EventAuthAttempt                         // 开始验证账号
+	EventAuthResult                          // 账号验证结果，Err非nil表示失败
+	EventRouteChosen                         // 选中二级代理
+	EventUpstreamDialed                      // TCP连接目标或二级代理完成
+	EventUpstreamNegotiated                  // 二级代理协商完成
+	EventTunnelEstablished                   // 代理建立成功
+	EventTunnelClosed                        // 代理关闭
+	EventError                               // 错误，Upstream非空为二级代理失败，否则为握手失败
+	EventRead                                // 读取数据，代替DebugRead
+	EventWrite                               // 写入数据，代替DebugWrite
+)
+
+var eventNames = []string{
+	"HandshakeStart",
+	"AuthAttempt",
+	"AuthResult",
+	"RouteChosen",
+	"UpstreamDialed",
+	"UpstreamNegotiated",
+	"TunnelEstablished",
+	"TunnelClosed",
+	"Error",
+	"Read",
+	"Write",
+}
+
+func (t EventType) String() string {
+	if int(t) < len(eventNames) {
+		return eventNames[t]
+	}
+	return "Unknown"
+}
+
+// Phase 数据所属阶段
+type Phase string
+
+// ...
+const (
+	PhaseGreeting Phase = "greeting" // socks5方法协商
+	PhaseAuth     Phase = "auth"     // 账号验证
+	PhaseRequest  Phase = "request"  // 代理请求
+	PhaseLevel2   Phase = "level2"   // 二级代理协商
+	PhaseHTTP     Phase = "http"     // 普通HTTP转发和TLS拦截
+)
+
+// Direction 数据方向
+type Direction string
+
+// ...
+const (
+	DirFromClient   Direction = "client>proxy"
+	DirToClient     Direction = "proxy>client"
+	DirFromUpstream Direction = "upstream>proxy"
+	DirToUpstream   Direction = "proxy>upstream"
+)
+
+// Event 事件
+type Event struct {
+	Type    EventType
+	Session *Session
+	Time    time.Time
+	Elapsed time.Duration // 距离握手开始
+
+	Duration  time.Duration // 连接、协商、代理持续时间
+	Protocol  string        // socks5/http
+	Upstream  string        // 二级代理，空表示直连
+	Addr      string        // 连接的地址
+	Phase     Phase         // Read/Write
+	Dir       Direction     // Read/Write
+	Data      []byte        // Read/Write，回调返回后不要保留
+	BytesUp   int64         // TunnelClosed，客户端到服务端字节数
+	BytesDown int64         // TunnelClosed，服务端到客户端字节数
+	Err       error
+}
+
+// Observer 观察代理会话的各个阶段，用于日志、追踪、统计
+type Observer interface {
+	OnEvent(e *Event)
+}
+
+// ObserverFunc ...
+type ObserverFunc func(e *Event)
+
+// OnEvent ...
+func (f ObserverFunc) OnEvent(e *Event) {
+	f(e)
+}
+
+// MultiObserver 多个Observer
+type MultiObserver []Observer
+
+// OnEvent ...
+func (o MultiObserver) OnEvent(e *Event) {
+	for _, ob := range o {
+		ob.OnEvent(e)
+	}
+}
+
+// 会话ID
+func newSessionID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// 发送事件
+func (o *PProxy) emit(e *Event) {
+	if o.Observer == nil {
+		return
+	}
+	e.Session, e.Time = o.session, time.Now()
+	if o.session != nil {
+		e.Elapsed = e.Time.Sub(o.session.Start)
+		if e.Protocol == "" {
+			e.Protocol = o.session.Protocol
+		}
+	}
+	o.Observer.OnEvent(e)
+}
+
+// 数据方向
+func (o *PProxy) direction(conn net.Conn, read bool) Direction {
+	switch {
+	case conn == o.Client && read:
+		return DirFromClient
+	case conn == o.Client:
+		return DirToClient
+	case read:
+		return DirFromUpstream
+	}
+	return DirToUpstream
+}
+
+func (o *PProxy) debugRead(phase Phase, conn net.Conn, bs []byte) {
+	if o.DebugRead != nil {
+		o.DebugRead(conn, bs)
+	}
+	if o.Observer != nil {
+		o.emit(&Event{Type: EventRead, Phase: phase, Dir: o.direction(conn, true), Data: bs})
+	}
+}
+
+func (o *PProxy) debugWrite(phase Phase, conn net.Conn, bs []byte) {
+	if o.DebugWrite != nil {
+		o.DebugWrite(conn, bs)
+	}
+	if o.Observer != nil {
+		o.emit(&Event{Type: EventWrite, Phase: phase, Dir: o.direction(conn, false), Data: bs})
+	}
+}
@@ -0,0 +1,79 @@
+package pproxy
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// go test pproxy -run Test_Observer -v -count=1
+func Test_Observer(t *testing.T) {
+	echo := startEcho(t)
+	good := startProxy(t, &allowAll{}, nil)
+
+	var mu sync.Mutex
+	var events []*Event
+	closed := make(chan struct{})
+	ob := ObserverFunc(func(e *Event) {
+		if e.Type == EventRead || e.Type == EventWrite {
+			return
+		}
+		mu.Lock()
+		events = append(events, e)
+		mu.Unlock()
+		if e.Type == EventTunnelClosed {
+			close(closed)
+		}
+	})
+
+	p1 := startProxy(t, &allowAll{level2: "http://a:b@" + good}, func(pp *PProxy) { pp.Observer = ob })
+	if err := connectEcho(p1, echo); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-closed:
+	case <-time.After(time.Second * 3):
+		t.Fatal("no TunnelClosed")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	names := []string{}
+	for _, e := range events {
+		names = append(names, e.Type.String())
+		if e.Session != events[0].Session || e.Session.ID == "" || e.Protocol != "http" {
+			t.Fatal("session:", e.Type, e.Session, e.Protocol)
+		}
+	}
+	want := "HandshakeStart,AuthAttempt,AuthResult,RouteChosen,UpstreamDialed,UpstreamNegotiated,TunnelEstablished,TunnelClosed"
+	if strings.Join(names, ",") != want {
+		t.Fatal(strings.Join(names, ","))
+	}
+	last := events[len(events)-1]
+	if last.BytesUp != 4 || last.BytesDown != 4 {
+		t.Fatal("bytes:", last.BytesUp, last.BytesDown)
+	}
+}
+
+// go test pproxy -run Test_ObserverFailedReply -v -count=1
+func Test_ObserverFailedReply(t *testing.T) {
+	echo := startEcho(t)
+	var names []string
+	ob := ObserverFunc(func(e *Event) { names = append(names, e.Type.String()) })
+
+	// 连接目标后回复客户端失败，没有建立也不关闭
+	client, _ := net.Pipe()
+	pp := &PProxy{Client: client, PI: &allowAll{}, Observer: ob}
+	pp.newSession()
+	if _, err := pp.Connect("a", "b", echo, func() error { return errors.New("client gone") }); err == nil {
+		t.Fatal("want error")
+	}
+	for _, name := range names {
+		if name == "TunnelEstablished" || name == "TunnelClosed" {
+			t.Fatal(names)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package pproxy
+
+import (
+	"bufio"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Pool 普通HTTP转发的空闲连接池，按(路由,目标)复用到目标或二级代理的连接
+// 多个PProxy共享同一个Pool
+type Pool struct {
+	MaxIdle     int           // 每个(路由,目标)最多空闲连接数，默认4
+	IdleTimeout time.Duration // 空闲超时，默认90秒
+
+	mu   sync.Mutex
+	idle map[string][]*poolConn
+}
+
+// 池中的连接，被不同会话复用，每次取出时bind到当前会话
+type poolConn struct {
+	net.Conn           // 当前会话的调试连接
+	raw       net.Conn // 到目标或二级代理的连接
+	br        *bufio.Reader
+	viaProxy  bool       // 连接的是二级HTTP代理，请求使用绝对URI
+	proxyAuth *proxyAuth // 二级HTTP代理认证，按连接保存质询状态
+	upstream  string     // 经过的二级代理，直连为空
+	redial    *url.URL   // 二级HTTP代理407后关闭连接时重新连接，链式时为nil
+	idleAt    time.Time
+
+	once    sync.Once
+	onClose []func() // 当前会话的回调，放回连接池或关闭时调用
+}
+
+func newPoolConn(conn net.Conn) *poolConn {
+	return &poolConn{Conn: conn, raw: conn, br: bufio.NewReader(conn)}
+}
+
+// 交给会话使用：读写回调和关闭回调都属于pp
+func (o *poolConn) bind(pp *PProxy) {
+	o.Conn = pp.debugConn(o.raw)
+	o.br = bufio.NewReader(o.Conn)
+	o.onClose, pp.onClose = pp.onClose, nil
+}
+
+// 会话不再使用
+func (o *poolConn) release() {
+	fns := o.onClose
+	o.onClose = nil
+	for _, fn := range fns {
+		fn()
+	}
+}
+
+// Close ...
+func (o *poolConn) Close() error {
+	o.once.Do(o.release)
+	return o.Conn.Close()
+}
+
+// 检查空闲连接是否仍然可用：没有多余数据，对端也没有关闭
+func (o *poolConn) alive() bool {
+	if o.br.Buffered() > 0 {
+		return false
+	}
+	o.Conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	_, err := o.br.Peek(1)
+	o.Conn.SetReadDeadline(time.Time{})
+
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+func (o *Pool) maxIdle() int {
+	if o.MaxIdle <= 0 {
+		return 4
+	}
+	return o.MaxIdle
+}
+
+func (o *Pool) idleTimeout() time.Duration {
+	if o.IdleTimeout <= 0 {
+		return time.Second * 90
+	}
+	return o.IdleTimeout
+}
+
+// 取出一个可用的空闲连接，没有返回nil
+func (o *Pool) get(key string) *poolConn {
+	for {
+		o.mu.Lock()
+		conns := o.idle[key]
+		if len(conns) == 0 {
+			o.mu.Unlock()
+			return nil
+		}
+		pc := conns[len(conns)-1]
+		o.idle[key] = conns[:len(conns)-1]
+		o.mu.Unlock()
+
+		if time.Since(pc.idleAt) < o.idleTimeout() && pc.alive() {
+			return pc
+		}
+		pc.Close()
+	}
+}
+
+// 放回连接池
+func (o *Pool) put(key string, pc *poolConn) {
+	pc.release()
+	pc.idleAt = time.Now()
+
+	o.mu.Lock()
+	if o.idle == nil {
+		o.idle = make(map[string][]*poolConn)
+	}
+
+	// 清理超时连接
+	conns := o.idle[key][:0]
+	for _, c := range o.idle[key] {
+		if time.Since(c.idleAt) < o.idleTimeout() {
+			conns = append(conns, c)
+		} else {
+			go c.Close()
+		}
+	}
+
+	if len(conns) >= o.maxIdle() {
+		o.idle[key] = conns
+		o.mu.Unlock()
+		pc.Close()
+		return
+	}
+	o.idle[key] = append(conns, pc)
+	o.mu.Unlock()
+}
+
+// Len 空闲连接数
+func (o *Pool) Len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	n := 0
+	for _, conns := range o.idle {
+		n += len(conns)
+	}
+	return n
+}
+
+// CloseIdle 关闭所有空闲连接
+func (o *Pool) CloseIdle() {
+	o.mu.Lock()
+	idle := o.idle
+	o.idle = nil
+	o.mu.Unlock()
+
+	for _, conns := range idle {
+		for _, pc := range conns {
+			pc.Close()
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package pproxy
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 启动HTTP服务器，返回请求的来源地址
+func startRemoteAddrServer(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.RemoteAddr))
+	}))
+	return ln.Addr().String()
+}
+
+// 通过代理GET，每次新建客户端连接
+func proxyGet(t *testing.T, proxyURL, navURL string) string {
+	u, _ := url.Parse(proxyURL)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(u), DisableKeepAlives: true}}
+	resp, err := client.Get(navURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	bs, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(bs)
+}
+
+// go test pproxy -run Test_Pool -v -count=1
+func Test_Pool(t *testing.T) {
+	web := startRemoteAddrServer(t)
+	level2 := startProxy(t, &allowAll{}, nil)
+
+	for _, l2 := range []string{"", "http://a:b@" + level2, "socks5://a:b@" + level2} {
+		pool := &Pool{}
+		p1 := startProxy(t, &allowAll{level2: l2}, func(pp *PProxy) { pp.Pool = pool })
+
+		a := proxyGet(t, "http://x:y@"+p1, "http://"+web+"/a")
+		b := proxyGet(t, "http://x:y@"+p1, "http://"+web+"/b")
+		if a != b {
+			t.Fatal(l2, "connection not reused:", a, b)
+		}
+		if pool.Len() != 1 {
+			t.Fatal(l2, "pool len:", pool.Len())
+		}
+
+		// 关闭后重新连接
+		pool.CloseIdle()
+		if c := proxyGet(t, "http://x:y@"+p1, "http://"+web+"/c"); c == a {
+			t.Fatal(l2, "closed connection reused:", c)
+		}
+	}
+
+	// 复用的连接的读写事件属于当前会话，空闲连接不计入二级代理的活动连接
+	var mu sync.Mutex
+	writers := map[string]string{} // 请求路径 => 会话ID
+	router := &Router{}
+	pool := &Pool{}
+	ob := ObserverFunc(func(e *Event) {
+		if e.Type == EventWrite && e.Phase == PhaseHTTP {
+			if f := strings.Fields(string(e.Data)); len(f) > 1 && f[0] == "GET" {
+				mu.Lock()
+				writers[f[1]] = e.Session.ID
+				mu.Unlock()
+			}
+		}
+	})
+	p1 := startProxy(t, &allowAll{level2: "http://a:b@" + level2}, func(pp *PProxy) { pp.Pool, pp.Router, pp.Observer = pool, router, ob })
+	proxyGet(t, "http://x:y@"+p1, "http://"+web+"/a")
+	proxyGet(t, "http://x:y@"+p1, "http://"+web+"/b")
+	mu.Lock()
+	a, b := writers["http://"+web+"/a"], writers["http://"+web+"/b"]
+	mu.Unlock()
+	if a == "" || b == "" || a == b {
+		t.Fatal("events of reused connection:", a, b)
+	}
+	if pool.Len() != 1 {
+		t.Fatal("pool len:", pool.Len())
+	}
+	time.Sleep(time.Millisecond * 50)
+	for _, s := range router.States() {
+		if s.Active != 0 {
+			t.Fatal("idle connection counted active:", s.URL, s.Active)
+		}
+	}
+}
@@ -0,0 +1,300 @@
+package pproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// PROXY protocol v2 签名
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ProxyProtocol 接收负载均衡发送的HAProxy PROXY protocol v1/v2头，获取真实客户端地址
+// 只接受来自Trusted的头，多个PProxy共享同一个ProxyProtocol
+type ProxyProtocol struct {
+	Trusted  []*net.IPNet // 可信的负载均衡地址
+	Optional bool         // 可信地址可以不发送PROXY头，默认必须发送
+}
+
+// NewProxyProtocol 可信地址为CIDR或IP，例如 10.0.0.0/8、127.0.0.1
+func NewProxyProtocol(trusted ...string) (*ProxyProtocol, error) {
+	o := &ProxyProtocol{}
+	for _, s := range trusted {
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		o.Trusted = append(o.Trusted, n)
+	}
+	return o, nil
+}
+
+func (o *ProxyProtocol) trusted(addr net.Addr) bool {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	for _, n := range o.Trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyConn 读取PROXY头后的客户端连接，RemoteAddr/LocalAddr为头中的地址
+type proxyConn struct {
+	net.Conn
+	prefix []byte // 探测时多读的数据
+	remote net.Addr
+	local  net.Addr
+}
+
+func (o *proxyConn) Read(b []byte) (n int, err error) {
+	if len(o.prefix) > 0 {
+		n = copy(b, o.prefix)
+		o.prefix = o.prefix[n:]
+		return
+	}
+	return o.Conn.Read(b)
+}
+
+func (o *proxyConn) RemoteAddr() net.Addr {
+	if o.remote != nil {
+		return o.remote
+	}
+	return o.Conn.RemoteAddr()
+}
+
+func (o *proxyConn) LocalAddr() net.Addr {
+	if o.local != nil {
+		return o.local
+	}
+	return o.Conn.LocalAddr()
+}
+
+// NetConn 调用方传入的连接，PROXY头时PI收到的是proxyConn，可以用它对应回原连接
+func (o *proxyConn) NetConn() net.Conn {
+	return o.Conn
+}
+
+// 读取PROXY头，替换o.Client
+// 只读取头本身，之后的数据仍由调用方从原连接读取
+func (o *PProxy) readProxyHeader() (err error) {
+	if !o.ProxyProtocol.trusted(o.Client.RemoteAddr()) {
+		return
+	}
+
+	pc := &proxyConn{Conn: o.Client}
+	b := make([]byte, 1, 16)
+	if _, err = io.ReadFull(o.Client, b); err != nil {
+		return
+	}
+	switch b[0] {
+	case 'P':
+		b = b[:6]
+		if _, err = io.ReadFull(o.Client, b[1:]); err != nil {
+			return
+		}
+		if string(b) == "PROXY " {
+			err = pc.readV1(b)
+		} else {
+			pc.prefix = b
+		}
+	case '\r':
+		b = b[:16]
+		if _, err = io.ReadFull(o.Client, b[1:12]); err != nil {
+			return
+		}
+		if bytes.Equal(b[:12], proxyV2Sig) {
+			if _, err = io.ReadFull(o.Client, b[12:16]); err == nil {
+				err = pc.readV2(b)
+			}
+		} else {
+			pc.prefix = b[:12]
+		}
+	default:
+		pc.prefix = b
+	}
+	if err != nil {
+		return
+	}
+	if pc.prefix != nil && !o.ProxyProtocol.Optional {
+		return errors.New("proxy protocol header required")
+	}
+
+	if pc.prefix == nil {
+		o.session.ProxiedBy = o.Client.RemoteAddr().String()
+		o.session.ClientAddr = pc.RemoteAddr().String()
+		// PI看到头中的客户端地址
+		o.accepted = pc
+	}
+	o.Client = pc
+	return
+}
+
+// PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n
+func (o *proxyConn) readV1(prefix []byte) (err error) {
+	line := append([]byte{}, prefix...)
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= 107 {
+			return errors.New("proxy protocol v1 header too long")
+		}
+		if _, err = o.Conn.Read(b); err != nil {
+			return
+		}
+		line = append(line, b[0])
+	}
+
+	fs := strings.Fields(string(line))
+	if len(fs) >= 2 && fs[1] == "UNKNOWN" {
+		return
+	}
+	if len(fs) != 6 || (fs[1] != "TCP4" && fs[1] != "TCP6") {
+		return errors.New("proxy protocol v1 header error: " + strings.TrimSpace(string(line)))
+	}
+	if o.remote, err = proxyAddr(fs[2], fs[4]); err != nil {
+		return
+	}
+	o.local, err = proxyAddr(fs[3], fs[5])
+	return
+}
+
+func proxyAddr(host, port string) (net.Addr, error) {
+	ip := net.ParseIP(host)
+	p, err := strconv.Atoi(port)
+	if ip == nil || err != nil || p < 0 || p > 0xFFFF {
+		return nil, errors.New("proxy protocol address error: " + host + " " + port)
+	}
+	return &net.TCPAddr{IP: ip, Port: p}, nil
+}
+
+// 16字节固定头 + 地址 + TLV
+func (o *proxyConn) readV2(head []byte) (err error) {
+	if head[12]>>4 != 2 {
+		return errors.New("proxy protocol v2 version error")
+	}
+	body := make([]byte, binary.BigEndian.Uint16(head[14:]))
+	if _, err = io.ReadFull(o.Conn, body); err != nil {
+		return
+	}
+
+	// LOCAL命令为负载均衡自己的连接（健康检查），使用真实地址
+	if head[12]&0xF == 0 {
+		return
+	}
+	switch head[13] >> 4 {
+	case 1: // AF_INET
+		if len(body) < 12 {
+			return errors.New("proxy protocol v2 address error")
+		}
+		o.remote = &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}
+		o.local = &net.TCPAddr{IP: net.IP(body[4:8]), Port: int(binary.BigEndian.Uint16(body[10:]))}
+	case 2: // AF_INET6
+		if len(body) < 36 {
+			return errors.New("proxy protocol v2 address error")
+		}
+		o.remote = &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}
+		o.local = &net.TCPAddr{IP: net.IP(body[16:32]), Port: int(binary.BigEndian.Uint16(body[34:]))}
+	}
+	return
+}
+
+// 二级代理URL的 proxy=v1/v2 参数，例如 http://a:b@host:port?proxy=v2
+func proxyHeaderVersion(u *url.URL) string {
+	return u.Query().Get("proxy")
+}
+
+// OnAuth返回的二级代理是否需要发送PROXY头
+func (o *PProxy) sendsProxyHeader(newAuth string) bool {
+	upstreams := strings.Split(newAuth, ",")
+	if o.route != nil {
+		upstreams = o.route.Upstreams
+	}
+	for _, s := range upstreams {
+		if u, err := url.Parse(strings.TrimSpace(s)); err == nil && proxyHeaderVersion(u) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// 向二级代理发送PROXY头，源地址为真实客户端地址
+func (o *PProxy) writeProxyHeader(conn net.Conn, u *url.URL) error {
+	return o.writeProxyHeaderVersion(conn, proxyHeaderVersion(u))
+}
+
+// 发送指定版本的PROXY头，version为空不发送
+func (o *PProxy) writeProxyHeaderVersion(conn net.Conn, version string) (err error) {
+	if version == "" {
+		return
+	}
+
+	// 健康检查没有客户端，发送UNKNOWN/LOCAL
+	var src, dst *net.TCPAddr
+	if o.Client != nil {
+		src, _ = net.ResolveTCPAddr("tcp", o.Client.RemoteAddr().String())
+		dst, _ = net.ResolveTCPAddr("tcp", o.Client.LocalAddr().String())
+	}
+	var header []byte
+	switch version {
+	case "v1", "1":
+		header = proxyHeaderV1(src, dst)
+	case "v2", "2":
+		header = proxyHeaderV2(src, dst)
+	default:
+		return errors.New("unknown proxy protocol version: " + version)
+	}
+
+	o.debugWrite(PhaseLevel2, conn, header)
+	_, err = conn.Write(header)
+	return
+}
+
+func proxyHeaderV1(src, dst *net.TCPAddr) []byte {
+	if src == nil || dst == nil || (src.IP.To4() == nil) != (dst.IP.To4() == nil) {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	family := "TCP4"
+	if src.IP.To4() == nil {
+		family = "TCP6"
+	}
+	return []byte("PROXY " + family + " " + src.IP.String() + " " + dst.IP.String() + " " +
+		strconv.Itoa(src.Port) + " " + strconv.Itoa(dst.Port) + "\r\n")
+}
+
+func proxyHeaderV2(src, dst *net.TCPAddr) []byte {
+	b := append([]byte{}, proxyV2Sig...)
+	switch {
+	case src == nil || dst == nil:
+		return append(b, 0x20, 0x00, 0, 0) // LOCAL
+	case (src.IP.To4() == nil) != (dst.IP.To4() == nil):
+		return append(b, 0x21, 0x00, 0, 0) // PROXY, UNSPEC
+	case src.IP.To4() != nil:
+		b = append(b, 0x21, 0x11, 0, 12) // PROXY, TCP over IPv4
+		b = append(b, src.IP.To4()...)
+		b = append(b, dst.IP.To4()...)
+	default:
+		b = append(b, 0x21, 0x21, 0, 36) // PROXY, TCP over IPv6
+		b = append(b, src.IP.To16()...)
+		b = append(b, dst.IP.To16()...)
+	}
+	p := make([]byte, 4)
+	binary.BigEndian.PutUint16(p, uint16(src.Port))
+	binary.BigEndian.PutUint16(p[2:], uint16(dst.Port))
+	return append(b, p...)
+}
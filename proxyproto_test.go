@@ -0,0 +1,88 @@
+package pproxy
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 记录OnAuth看到的客户端地址
+type recordAddr struct {
+	allowAll
+	addrs chan string
+}
+
+func (o *recordAddr) OnAuth(conn net.Conn, user, password string) (string, error) {
+	o.addrs <- conn.RemoteAddr().String()
+	return o.level2, nil
+}
+
+// 发送PROXY头后CONNECT
+func connectWithHeader(proxyAddr, target string, header []byte) error {
+	conn, err := net.DialTimeout("tcp", proxyAddr, time.Second*3)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 3))
+	conn.Write(header)
+	conn.Write([]byte("CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\nProxy-Authorization: Basic eDp5\r\n\r\n"))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(line, " 200 ") {
+		return &net.AddrError{Err: line}
+	}
+	return nil
+}
+
+// go test pproxy -run Test_ProxyProtocol -v -count=1
+func Test_ProxyProtocol(t *testing.T) {
+	echo := startEcho(t)
+	trusted, err := NewProxyProtocol("127.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	untrusted, _ := NewProxyProtocol("10.0.0.1")
+
+	upstream := &recordAddr{addrs: make(chan string, 1)}
+	p2 := startProxy(t, upstream, func(pp *PProxy) { pp.ProxyProtocol = trusted })
+
+	for _, level2 := range []string{"", "http://a:b@" + p2 + "?proxy=v2", "socks5://a:b@" + p2 + "?proxy=v1"} {
+		pi := &recordAddr{allowAll: allowAll{level2: level2}, addrs: make(chan string, 1)}
+		p1 := startProxy(t, pi, func(pp *PProxy) { pp.ProxyProtocol = trusted })
+
+		src := &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 1111}
+		dst := &net.TCPAddr{IP: net.ParseIP("5.6.7.8"), Port: 2222}
+		for _, header := range [][]byte{proxyHeaderV1(src, dst), proxyHeaderV2(src, dst)} {
+			if err := connectWithHeader(p1, echo, header); err != nil {
+				t.Fatal(level2, err)
+			}
+			if addr := <-pi.addrs; addr != "1.2.3.4:1111" {
+				t.Fatal(level2, addr)
+			}
+			if level2 != "" {
+				if addr := <-upstream.addrs; addr != "1.2.3.4:1111" {
+					t.Fatal("upstream:", level2, addr)
+				}
+			}
+		}
+
+		// 可信地址必须发送PROXY头
+		if err := connectEcho(p1, echo); err == nil {
+			t.Fatal("want error")
+		}
+	}
+
+	// 不可信地址不解析PROXY头
+	p3 := startProxy(t, &allowAll{}, func(pp *PProxy) { pp.ProxyProtocol = untrusted })
+	if err := connectWithHeader(p3, echo, []byte("PROXY TCP4 1.2.3.4 5.6.7.8 1111 2222\r\n")); err == nil {
+		t.Fatal("want error")
+	}
+	if err := connectEcho(p3, echo); err != nil {
+		t.Fatal(err)
+	}
+}
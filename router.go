@@ -0,0 +1,396 @@
+package pproxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RoutePrefix OnAuth返回 route:name 时使用Router中注册的路由
+const RoutePrefix = "route:"
+
+var defaultRouter = &Router{}
+
+// Route 路由，按顺序尝试多个候选二级代理
+type Route struct {
+	Name      string
+	Upstreams []string // 候选二级代理，空表示直连
+	Retries   int      // 最多尝试几个候选，<=0使用Router.Retries
+	Strategy  string   // 负载均衡策略，空使用Router.Strategy
+
+	Middlewares []Middleware // 此路由额外使用的Middleware
+
+	SourceIPs    []string // 出口地址，用于直连和连接第一个二级代理，空为系统默认；IPv4/IPv6目标只使用同一地址族的地址
+	SourcePolicy string   // 多个出口地址时 SourceRotate按连接轮换（默认），SourceSticky同一会话固定
+
+	sourceNext uint32
+	mu         sync.Mutex
+	invalid    error // 最近一次Validate的结果
+}
+
+// Router 二级代理路由：故障转移、健康检查、熔断
+// 多个PProxy共享同一个Router
+type Router struct {
+	Retries  int    // 每个会话最多尝试几个候选，<=0表示全部尝试
+	Strategy string // 默认负载均衡策略
+
+	OnChoose func(s *Session) // 选中二级代理后回调，用于统计
+
+	CheckTarget   string        // 健康检查CONNECT目标，空表示不检查
+	CheckInterval time.Duration // 健康检查间隔，默认10秒
+	CheckTimeout  time.Duration // 健康检查超时，默认5秒
+
+	FailThreshold int           // 连续失败几次后熔断，<=0不熔断
+	OpenTimeout   time.Duration // 熔断持续时间，默认30秒
+
+	// IdleExpire 不在注册路由中的二级代理（OnAuth直接返回的列表）多久没有使用后删除状态、停止健康检查，默认10分钟
+	IdleExpire time.Duration
+
+	routes    sync.Map // name => *Route
+	upstreams sync.Map // url => *upstream
+	balancers sync.Map // route name => *balancer
+	stop      chan struct{}
+	mu        sync.Mutex
+	swept     time.Time // 上次清理的时间
+}
+
+// upstream 单个二级代理状态
+type upstream struct {
+	active int64 // 活动连接数
+	used   int64 // 最后选用的时间 UnixNano
+	url    string
+	weight int
+
+	mu        sync.Mutex
+	unhealthy bool      // 健康检查失败
+	fails     int       // 连续失败次数
+	openUntil time.Time // 熔断截止时间
+	probing   bool      // 半开状态，正在试探
+	latency   time.Duration
+}
+
+// UpstreamState 二级代理状态
+type UpstreamState struct {
+	URL       string
+	Weight    int
+	Active    int64
+	Latency   time.Duration
+	Healthy   bool
+	Fails     int
+	OpenUntil time.Time
+}
+
+// SetRoute 注册路由，Route.Validate失败时不注册
+func (o *Router) SetRoute(r *Route) error {
+	if err := r.revalidate(); err != nil {
+		return err
+	}
+	o.routes.Store(r.Name, r)
+	o.balancers.Delete(r.Name)
+	for _, u := range r.Upstreams {
+		o.upstream(u)
+	}
+	return nil
+}
+
+// DelRoute 删除路由
+func (o *Router) DelRoute(name string) {
+	o.routes.Delete(name)
+	o.balancers.Delete(name)
+}
+
+// Resolve 解析OnAuth返回的二级代理
+// route:name => 已注册路由
+// http://a,socks5://b => 按顺序尝试的候选列表
+// 已注册路由使用SetRoute和健康检查时Validate的结果，出口地址已不在本机时返回错误
+func (o *Router) Resolve(level2 string) (*Route, error) {
+	if strings.HasPrefix(level2, RoutePrefix) {
+		name := level2[len(RoutePrefix):]
+		v, ok := o.routes.Load(name)
+		if !ok {
+			return nil, errors.New("unknown route: " + name)
+		}
+		r := v.(*Route)
+		if err := r.validated(); err != nil {
+			return nil, err
+		}
+		return r, nil
+	}
+
+	r := &Route{Name: level2}
+	for _, u := range strings.Split(level2, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			r.Upstreams = append(r.Upstreams, u)
+		}
+	}
+	return r, nil
+}
+
+// States 所有二级代理状态
+func (o *Router) States() []UpstreamState {
+	states := []UpstreamState{}
+	o.upstreams.Range(func(k, v interface{}) bool {
+		u := v.(*upstream)
+		u.mu.Lock()
+		states = append(states, UpstreamState{
+			URL:       u.url,
+			Weight:    u.weight,
+			Active:    atomic.LoadInt64(&u.active),
+			Latency:   u.latency,
+			Healthy:   !u.unhealthy,
+			Fails:     u.fails,
+			OpenUntil: u.openUntil,
+		})
+		u.mu.Unlock()
+		return true
+	})
+	return states
+}
+
+// Start 启动健康检查
+func (o *Router) Start() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.stop != nil || o.CheckTarget == "" {
+		return
+	}
+	o.stop = make(chan struct{})
+
+	interval := o.CheckInterval
+	if interval <= 0 {
+		interval = time.Second * 10
+	}
+
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			o.checkAll()
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}(o.stop)
+}
+
+// Stop 停止健康检查
+func (o *Router) Stop() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.stop != nil {
+		close(o.stop)
+		o.stop = nil
+	}
+}
+
+func (o *Router) upstream(u string) *upstream {
+	o.expire(false)
+	v, _ := o.upstreams.LoadOrStore(u, &upstream{url: u, weight: upstreamWeight(u)})
+	up := v.(*upstream)
+	atomic.StoreInt64(&up.used, time.Now().UnixNano())
+	return up
+}
+
+func (o *Router) idleExpire() time.Duration {
+	if o.IdleExpire > 0 {
+		return o.IdleExpire
+	}
+	return time.Minute * 10
+}
+
+// 删除不在注册路由中、超过IdleExpire没有使用的二级代理和负载均衡状态
+// force为false时最多每分钟（或每个IdleExpire）清理一次
+func (o *Router) expire(force bool) {
+	now := time.Now()
+	idle := o.idleExpire()
+	if !force {
+		every := time.Minute
+		if idle < every {
+			every = idle
+		}
+		o.mu.Lock()
+		due := now.Sub(o.swept) >= every
+		if due {
+			o.swept = now
+		}
+		o.mu.Unlock()
+		if !due {
+			return
+		}
+	}
+
+	routed := map[string]bool{}
+	o.routes.Range(func(k, v interface{}) bool {
+		for _, u := range v.(*Route).Upstreams {
+			routed[u] = true
+		}
+		return true
+	})
+	o.upstreams.Range(func(k, v interface{}) bool {
+		up := v.(*upstream)
+		if !routed[up.url] && atomic.LoadInt64(&up.active) == 0 && now.Sub(time.Unix(0, atomic.LoadInt64(&up.used))) > idle {
+			o.upstreams.Delete(k)
+		}
+		return true
+	})
+	o.balancers.Range(func(k, v interface{}) bool {
+		if _, ok := o.routes.Load(k); !ok && now.Sub(time.Unix(0, atomic.LoadInt64(&v.(*balancer).used))) > idle {
+			o.balancers.Delete(k)
+		}
+		return true
+	})
+}
+
+// 按策略尝试候选二级代理
+func (o *Router) dial(pp *PProxy, info *httpProxyInfo, route *Route) (conn net.Conn, err error) {
+	if pp.session == nil {
+		pp.session = &Session{Target: info.uri}
+	}
+	pp.session.Route = route.Name
+	if len(route.Upstreams) == 0 {
+		return nil, nil
+	}
+
+	retries := route.Retries
+	if retries <= 0 {
+		retries = o.Retries
+	}
+	if retries <= 0 || retries > len(route.Upstreams) {
+		retries = len(route.Upstreams)
+	}
+
+	errs := []string{}
+	for _, c := range o.candidates(route, pp.session) {
+		if retries == 0 {
+			break
+		}
+
+		up := c.up
+		if !o.allow(up) {
+			continue
+		}
+		retries--
+
+		pp.session.Upstream, pp.session.Reason = up.url, c.reason
+		pp.emit(&Event{Type: EventRouteChosen, Upstream: up.url})
+
+		start := time.Now()
+		if conn, err = pp.level2One(info, up.url); err == nil {
+			up.observe(time.Since(start))
+			o.success(up)
+			pp.emit(&Event{Type: EventUpstreamNegotiated, Upstream: up.url, Duration: time.Since(start)})
+
+			atomic.AddInt64(&up.active, 1)
+			pp.onClose = append(pp.onClose, func() { atomic.AddInt64(&up.active, -1) })
+			if o.OnChoose != nil {
+				o.OnChoose(pp.session)
+			}
+			return
+		}
+		o.fail(up)
+		pp.emit(&Event{Type: EventError, Upstream: up.url, Err: err})
+		errs = append(errs, err.Error())
+	}
+	pp.session.Upstream, pp.session.Reason = "", ""
+
+	if len(errs) == 0 {
+		return nil, errors.New("no available upstream")
+	}
+	return nil, fmt.Errorf("all upstreams failed: %s", strings.Join(errs, "; "))
+}
+
+// 是否可以使用此二级代理
+func (o *Router) allow(up *upstream) bool {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+
+	if up.unhealthy {
+		return false
+	}
+	if up.openUntil.IsZero() {
+		return true
+	}
+	if time.Now().Before(up.openUntil) || up.probing {
+		return false
+	}
+
+	// 半开，放行一个请求试探
+	up.probing = true
+	return true
+}
+
+func (o *Router) success(up *upstream) {
+	up.mu.Lock()
+	up.fails = 0
+	up.openUntil = time.Time{}
+	up.probing = false
+	up.mu.Unlock()
+}
+
+func (o *Router) fail(up *upstream) {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+
+	up.fails++
+	up.probing = false
+	if o.FailThreshold > 0 && up.fails >= o.FailThreshold {
+		timeout := o.OpenTimeout
+		if timeout <= 0 {
+			timeout = time.Second * 30
+		}
+		up.openUntil = time.Now().Add(timeout)
+	}
+}
+
+// 检查所有二级代理，重新校验已注册路由的出口地址
+func (o *Router) checkAll() {
+	o.expire(true)
+	o.validateRoutes()
+	wg := sync.WaitGroup{}
+	o.upstreams.Range(func(k, v interface{}) bool {
+		wg.Add(1)
+		go func(up *upstream) {
+			defer wg.Done()
+			start := time.Now()
+			err := o.Check(up.url)
+			if err == nil {
+				up.observe(time.Since(start))
+			}
+
+			up.mu.Lock()
+			up.unhealthy = err != nil
+			up.mu.Unlock()
+		}(v.(*upstream))
+		return true
+	})
+	wg.Wait()
+}
+
+// 重新校验所有已注册路由
+func (o *Router) validateRoutes() {
+	o.routes.Range(func(k, v interface{}) bool {
+		v.(*Route).revalidate()
+		return true
+	})
+}
+
+// Check 通过二级代理CONNECT到CheckTarget
+func (o *Router) Check(level2 string) error {
+	timeout := o.CheckTimeout
+	if timeout <= 0 {
+		timeout = time.Second * 5
+	}
+
+	pp := &PProxy{deadline: time.Now().Add(timeout)}
+	conn, err := pp.level2One(connectInfo(o.CheckTarget), level2)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
@@ -0,0 +1,239 @@
+package pproxy
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// allowAll 所有账号直连，或使用level2
+type allowAll struct{ level2 string }
+
+func (o *allowAll) OnAuth(conn net.Conn, user, password string) (string, error) {
+	return o.level2, nil
+}
+func (o *allowAll) OnSuccess(clientConn net.Conn, serverConn net.Conn) {}
+
+// 启动代理服务器，返回监听地址
+func startProxy(t *testing.T, pi ProxyInterface, setup func(pp *PProxy)) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				pp := &PProxy{Client: conn, PI: pi}
+				if setup != nil {
+					setup(pp)
+				}
+				newConn, err := pp.Handshake()
+				if err != nil {
+					return
+				}
+				defer newConn.Close()
+				CopyHelper(conn, newConn)
+			}(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// 启动echo服务器，返回监听地址
+func startEcho(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// 一个已关闭的端口
+func deadAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+// 通过HTTP代理CONNECT目标并验证echo
+func connectEcho(proxyAddr, target string) error {
+	conn, err := net.DialTimeout("tcp", proxyAddr, time.Second*3)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 3))
+
+	if _, err = conn.Write([]byte("CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\nProxy-Authorization: Basic eDp5\r\n\r\n")); err != nil {
+		return err
+	}
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(line, " 200 ") {
+		return errors.New(line)
+	}
+	for line != "\r\n" {
+		if line, err = r.ReadString('\n'); err != nil {
+			return err
+		}
+	}
+
+	if _, err = conn.Write([]byte("ping")); err != nil {
+		return err
+	}
+	bs := make([]byte, 4)
+	if _, err = io.ReadFull(r, bs); err != nil {
+		return err
+	}
+	if string(bs) != "ping" {
+		return errors.New("echo error: " + string(bs))
+	}
+	return nil
+}
+
+// go test pproxy -run Test_RouterFailover -v -count=1
+func Test_RouterFailover(t *testing.T) {
+	echo := startEcho(t)
+	good := startProxy(t, &allowAll{}, nil)
+	dead := deadAddr(t)
+
+	router := &Router{FailThreshold: 1, OpenTimeout: time.Minute}
+	router.SetRoute(&Route{Name: "pool", Upstreams: []string{"http://a:b@" + dead, "socks5://a:b@" + good}})
+
+	for _, level2 := range []string{"http://a:b@" + dead + ",http://a:b@" + good, "route:pool"} {
+		p1 := startProxy(t, &allowAll{level2: level2}, func(pp *PProxy) { pp.Router = router })
+		if err := connectEcho(p1, echo); err != nil {
+			t.Fatal(level2, err)
+		}
+	}
+
+	// 熔断后不再尝试
+	for _, s := range router.States() {
+		if strings.Contains(s.URL, dead) && s.OpenUntil.IsZero() {
+			t.Fatal("circuit not open:", s.URL)
+		}
+	}
+	p1 := startProxy(t, &allowAll{level2: "http://a:b@" + dead}, func(pp *PProxy) { pp.Router = router })
+	if err := connectEcho(p1, echo); err == nil {
+		t.Fatal("want error")
+	}
+
+	// 不在注册路由中的二级代理空闲后删除，健康检查不再探测
+	expiring := &Router{IdleExpire: time.Millisecond * 50}
+	expiring.SetRoute(&Route{Name: "pool", Upstreams: []string{"socks5://a:b@" + good}})
+	adhoc := "http://a:b@" + good
+	p1 = startProxy(t, &allowAll{level2: adhoc}, func(pp *PProxy) { pp.Router = expiring })
+	if err := connectEcho(p1, echo); err != nil {
+		t.Fatal(err)
+	}
+	urls := func() (urls []string) {
+		for _, s := range expiring.States() {
+			urls = append(urls, s.URL)
+		}
+		sort.Strings(urls)
+		return
+	}
+	if u := urls(); len(u) != 2 {
+		t.Fatal(u)
+	}
+	deadline := time.Now().Add(time.Second * 3)
+	for len(urls()) != 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 100)
+		expiring.expire(true)
+	}
+	if u := urls(); len(u) != 1 || u[0] != "socks5://a:b@"+good {
+		t.Fatal("ad-hoc upstream not expired:", u)
+	}
+
+	// 健康检查
+	checker := &Router{CheckTarget: echo}
+	if err := checker.Check("http://a:b@" + good); err != nil {
+		t.Fatal(err)
+	}
+	if err := checker.Check("socks5://a:b@" + dead); err == nil {
+		t.Fatal("want error")
+	}
+}
+
+// 记录选中的二级代理
+type recordChoose struct {
+	allowAll
+	chosen chan *Session
+}
+
+func (o *recordChoose) OnSuccess(clientConn net.Conn, serverConn net.Conn) {
+	o.chosen <- SessionOf(serverConn)
+}
+
+// go test pproxy -run Test_Balance -v -count=1
+func Test_Balance(t *testing.T) {
+	echo := startEcho(t)
+	a := "http://a:b@" + startProxy(t, &allowAll{}, nil)
+	b := "socks5://a:b@" + startProxy(t, &allowAll{}, nil)
+
+	router := &Router{}
+	router.SetRoute(&Route{Name: "rr", Upstreams: []string{a, b}, Strategy: StrategyRoundRobin})
+	router.SetRoute(&Route{Name: "hash", Upstreams: []string{a, b}, Strategy: StrategyHashUser})
+	router.SetRoute(&Route{Name: "weighted", Upstreams: []string{a + "?weight=100", b}, Strategy: StrategyWeighted})
+
+	pick := func(level2 string) *Session {
+		pi := &recordChoose{allowAll: allowAll{level2: level2}, chosen: make(chan *Session, 1)}
+		p1 := startProxy(t, pi, func(pp *PProxy) { pp.Router = router })
+		if err := connectEcho(p1, echo); err != nil {
+			t.Fatal(level2, err)
+		}
+		return <-pi.chosen
+	}
+
+	s1, s2 := pick("route:rr"), pick("route:rr")
+	if s1.Upstream == s2.Upstream || s1.Reason != "roundrobin" {
+		t.Fatal("roundrobin:", s1, s2)
+	}
+	if s1.Target != echo || s1.User != "x" || s1.Route != "rr" {
+		t.Fatal("session:", s1)
+	}
+
+	s1, s2 = pick("route:hash"), pick("route:hash")
+	if s1.Upstream != s2.Upstream {
+		t.Fatal("hash:", s1, s2)
+	}
+
+	heavy := 0
+	for i := 0; i < 10; i++ {
+		if pick("route:weighted").Upstream != b {
+			heavy++
+		}
+	}
+	if heavy < 7 {
+		t.Fatal("weighted:", heavy)
+	}
+}
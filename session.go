@@ -0,0 +1,114 @@
+package pproxy
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Session 代理会话信息
+type Session struct {
+	ID         string    // 会话ID
+	TraceID    string    // 追踪ID，经pproxy://串联时沿用第一跳的会话ID
+	ParentID   string    // 上一跳pproxy的会话ID
+	Start      time.Time // 开始时间
+	Protocol   string    // socks5/socks4/http/h2/ss/pproxy/forward，TLS入站为 协议+tls
+	ClientAddr string    // 客户端地址，使用PROXY protocol时为真实客户端地址
+	ProxiedBy  string    // 发送PROXY头的负载均衡地址
+	User       string    // 账号
+	Target     string    // 目标地址 host:port
+	Route      string    // 路由名称
+	Upstream   string    // 选中的二级代理，空表示直连
+	Reason     string    // 选中原因
+	SourceIP   string    // 出口地址，路由没有设置时为空
+
+	Intercepted bool // 是否TLS拦截
+}
+
+// Conn Handshake返回的服务端连接，附带会话信息
+type Conn struct {
+	up, down int64 // 客户端到服务端、服务端到客户端字节数，放在首位保证64位对齐
+
+	net.Conn
+	Session *Session
+
+	once    sync.Once
+	onClose []func()
+}
+
+// Read ...
+func (o *Conn) Read(b []byte) (n int, err error) {
+	n, err = o.Conn.Read(b)
+	atomic.AddInt64(&o.down, int64(n))
+	return
+}
+
+// Write ...
+func (o *Conn) Write(b []byte) (n int, err error) {
+	n, err = o.Conn.Write(b)
+	atomic.AddInt64(&o.up, int64(n))
+	return
+}
+
+// Bytes 客户端到服务端、服务端到客户端字节数
+func (o *Conn) Bytes() (up, down int64) {
+	return atomic.LoadInt64(&o.up), atomic.LoadInt64(&o.down)
+}
+
+// Close ...
+func (o *Conn) Close() error {
+	o.once.Do(func() {
+		for _, fn := range o.onClose {
+			fn()
+		}
+	})
+	return o.Conn.Close()
+}
+
+// SessionOf 获取服务端连接的会话信息，OnSuccess中使用
+func SessionOf(conn net.Conn) *Session {
+	if c, ok := conn.(*Conn); ok {
+		return c.Session
+	}
+	return nil
+}
+
+// 包装服务端连接
+func (o *PProxy) wrapConn(conn net.Conn) *Conn {
+	if c, ok := conn.(*Conn); ok {
+		return c
+	}
+	// TLS拦截时抓解密后的数据
+	if stream := o.captureStream(); stream != nil && !o.intercepting() {
+		conn = &captureConn{Conn: conn, stream: stream}
+	}
+	c := &Conn{Conn: conn, Session: o.session}
+	c.onClose, o.onClose = o.onClose, nil
+	c.onClose = append(c.onClose, func() {
+		// 建立前失败（如回复客户端失败）只有EventError
+		if !o.succeeded {
+			return
+		}
+		up, down := c.Bytes()
+		o.emit(&Event{Type: EventTunnelClosed, Duration: time.Since(o.session.Start), BytesUp: up, BytesDown: down})
+	})
+	return c
+}
+
+// 代理建立成功
+func (o *PProxy) success(conn net.Conn) {
+	o.succeeded = true
+	o.emit(&Event{Type: EventTunnelEstablished, Upstream: o.session.Upstream})
+	if o.PI != nil {
+		o.PI.OnSuccess(o.clientConn(), conn)
+	}
+}
+
+// 回调PI使用的客户端连接，与调用方传入的相同
+func (o *PProxy) clientConn() net.Conn {
+	if o.accepted != nil {
+		return o.accepted
+	}
+	return o.Client
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"crypto/md5"
 	"crypto/sha256"
+	"crypto/tls"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
@@ -10,6 +11,7 @@ import (
 	"io"
 	"log"
 	"net"
+	"os"
 	"pproxy"
 	"sort"
 	"strings"
@@ -25,8 +27,24 @@ var (
 	requestCache sync.Map // 动态账号 u1:p1 => u2:p2
 	userConns    sync.Map // 代理客服端连接 u => conn
 	level2Conns  sync.Map // 代理客户=>二级代理 conn=>level2
+	clientUsers  sync.Map // 代理客户=>账号 conn=>u，关闭时只删除自己的记录
+	serverConns  sync.Map // 二级代理=>代理客户 level2=>conn
 )
 
+// PROXY头时OnAuth、OnSuccess收到的是包装后的连接，按原始连接索引
+func clientKey(conn net.Conn) net.Conn {
+	if nc, ok := conn.(interface{ NetConn() net.Conn }); ok {
+		return nc.NetConn()
+	}
+	return conn
+}
+
+// 记录账号使用的连接
+func storeUserConn(k string, conn net.Conn) {
+	userConns.Store(k, conn)
+	clientUsers.Store(clientKey(conn), k)
+}
+
 // Client 客户端
 type Client struct {
 	msg               *omsg.Client
@@ -37,6 +55,10 @@ type Client struct {
 	crc               bool
 	localServers      sync.Map // map[浏览器IP:Port + 本地服务IP:Port]本地服务连接
 	localServersCount int64    // 连接数
+	metrics           *pproxy.Metrics
+	observer          pproxy.Observer
+	proxyProtocol     *pproxy.ProxyProtocol
+	hop               *pproxy.Hop
 }
 
 // Start 启动客户端
@@ -48,6 +70,24 @@ func (o *Client) Start(key, serverPort, proxyPort, clientWebPort, clientLogPort
 		go lClient.Listen(clientLogPort)
 	}
 	o.serverPort, o.proxyPort, o.clientWebPort, o.crc = serverPort, proxyPort, clientWebPort, crc
+	o.metrics = &pproxy.Metrics{PerUser: *metricsUser}
+	o.observer = o.metrics
+	if *accessLog != "" {
+		alog := &pproxy.AccessLog{Format: *accessLogFmt, Writer: os.Stdout}
+		if *accessLog != "-" {
+			alog.Writer = pproxy.NewRotateFile(*accessLog, 100<<20, 5)
+		}
+		o.observer = pproxy.MultiObserver{o.metrics, alog}
+	}
+	if *proxyProto != "" {
+		if o.proxyProtocol, err = pproxy.NewProxyProtocol(strings.Split(*proxyProto, ",")...); err != nil {
+			return
+		}
+	}
+
+	if *hopPSK != "" {
+		o.hop = &pproxy.Hop{PSK: []byte(*hopPSK)}
+	}
 
 	// setup AES
 	if len(key) > 0 {
@@ -60,6 +100,24 @@ func (o *Client) Start(key, serverPort, proxyPort, clientWebPort, clientLogPort
 	}
 
 	go o.Listen()
+	if *h2Port != "" {
+		go func() { lClient.Log2Error(o.ListenH2()) }()
+	}
+	if *ssPort != "" {
+		go func() { lClient.Log2Error(o.ListenSS()) }()
+	}
+	if *tunnel != "" {
+		if *tunnelKey == "" {
+			return errTunnelKey
+		}
+		go func() { lClient.Log2Error(o.RunTunnel(*tunnelKey)) }()
+	}
+	for _, fwd := range strings.Split(*forwards, ";") {
+		if fs := strings.SplitN(strings.TrimSpace(fwd), "=", 3); len(fs) >= 2 {
+			fs = append(fs, "")
+			go func() { lClient.Log2Error(o.ListenForward(fs[0], fs[1], fs[2])) }()
+		}
+	}
 	go o.webServer(o.clientWebPort)
 	go o.ForTestLevel2()
 
@@ -170,14 +228,124 @@ func (o *Client) Listen() error {
 			return err
 		}
 
+		go o.serve(conn)
+	}
+}
+
+// 处理一个代理客户端连接，返回时连接已关闭
+func (o *Client) serve(conn net.Conn) {
+	defer conn.Close()
+	defer o.OnClientClose(conn)
+
+	pp1 := &pproxy.PProxy{Client: conn, PI: o, Observer: o.observer, ProxyProtocol: o.proxyProtocol, Hop: o.hop}
+	// pp1.DebugRead = o.DebugRead
+	// pp1.DebugWrite = o.DebugWrite
+
+	newConn, err := pp1.Handshake()
+	if err != nil {
+		lClient.Log2Error(err)
+		return
+	}
+	defer newConn.Close()
+	defer o.OnServerClose(newConn)
+
+	pproxy.CopyHelper(conn, newConn)
+}
+
+// ListenForward 静态端口转发，经二级代理转发到固定目标
+func (o *Client) ListenForward(listen, target, level2 string) error {
+	lClient.Log4Trace("listen forward:", listen, target, level2)
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		return err
+	}
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+
 		go func(conn net.Conn) {
 			defer conn.Close()
 			defer o.OnClientClose(conn)
 
-			pp1 := &pproxy.PProxy{Client: conn, PI: o}
-			// pp1.DebugRead = o.DebugRead
-			// pp1.DebugWrite = o.DebugWrite
+			pp1 := &pproxy.PProxy{Client: conn, PI: o, Observer: o.observer, ProxyProtocol: o.proxyProtocol, Hop: o.hop}
+			newConn, err := pp1.Forward(target, level2, "")
+			if err != nil {
+				lClient.Log2Error(err)
+				return
+			}
+			defer newConn.Close()
+			defer o.OnServerClose(newConn)
+
+			pproxy.CopyHelper(conn, newConn)
+		}(conn)
+	}
+}
+
+// RunTunnel 经反向隧道在服务端开放代理端口，断开后重连，key为空时不启动
+func (o *Client) RunTunnel(key string) error {
+	if key == "" {
+		return errTunnelKey
+	}
+	tc := &pproxy.TunnelClient{Hop: &pproxy.Hop{PSK: []byte(key)}, Serve: o.serve}
+	for {
+		lClient.Log4Trace("tunnel:", *tunnel, *tunnelPort)
+		if err := tc.Run("pproxy://"+*tunnel, *tunnelPort); err != nil {
+			lClient.Log2Error(err)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// ListenH2 HTTP/2代理，每个CONNECT流为一个会话
+func (o *Client) ListenH2() error {
+	cert, err := tls.LoadX509KeyPair(*h2Cert, *h2Key)
+	if err != nil {
+		return err
+	}
+	lClient.Log4Trace("listen h2:", *h2Port)
+	ln, err := tls.Listen("tcp", *h2Port, &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"h2", "http/1.1"}})
+	if err != nil {
+		return err
+	}
+
+	h := &pproxy.H2{PI: o, Setup: func(pp *pproxy.PProxy) {
+		pp.Observer = o.observer
+	}}
+	return h.Serve(ln)
+}
+
+// ListenSS Shadowsocks代理，按密码匹配账号
+func (o *Client) ListenSS() error {
+	lClient.Log4Trace("listen ss:", *ssPort)
+	ln, err := net.Listen("tcp", *ssPort)
+	if err != nil {
+		return err
+	}
+
+	ss := &pproxy.Shadowsocks{Cipher: *ssCipher, Users: func() map[string]string {
+		users := map[string]string{}
+		accountCache.Range(func(k, v interface{}) bool {
+			if up := strings.SplitN(k.(string), ":", 2); len(up) == 2 {
+				users[up[0]] = up[1]
+			}
+			return true
+		})
+		return users
+	}}
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
 
+		go func(conn net.Conn) {
+			defer conn.Close()
+			defer o.OnClientClose(conn)
+
+			pp1 := &pproxy.PProxy{Client: conn, PI: o, Observer: o.observer, Shadowsocks: ss}
 			newConn, err := pp1.Handshake()
 			if err != nil {
 				lClient.Log2Error(err)
@@ -203,7 +371,7 @@ func (o *Client) OnAuth(conn net.Conn, user, password string) (level2 string, er
 	// 先查动态账号缓存是否存在
 	if l2, ok = requestCache.Load(k); ok {
 		level2 = l2.(string)
-		userConns.Store(k, conn)
+		storeUserConn(k, conn)
 		return
 	}
 
@@ -227,7 +395,7 @@ func (o *Client) OnAuth(conn net.Conn, user, password string) (level2 string, er
 			level2 = m.Data.(string)
 		}
 
-		userConns.Store(k, conn)
+		storeUserConn(k, conn)
 		return
 	}
 
@@ -236,7 +404,12 @@ func (o *Client) OnAuth(conn net.Conn, user, password string) (level2 string, er
 
 // OnSuccess ...
 func (o *Client) OnSuccess(clientConn net.Conn, serverConn net.Conn) {
-	level2Conns.Store(clientConn, serverConn)
+	level2Conns.Store(clientKey(clientConn), serverConn)
+	serverConns.Store(serverConn, clientKey(clientConn))
+	if s := pproxy.SessionOf(serverConn); s != nil && s.Upstream != "" {
+		lClient.Log0Debug("OnSuccess:", clientConn.RemoteAddr().String(), serverConn.RemoteAddr().String(), s.Upstream, s.Reason)
+		return
+	}
 	lClient.Log0Debug("OnSuccess:", clientConn.RemoteAddr().String(), serverConn.RemoteAddr().String())
 }
 
@@ -253,24 +426,22 @@ func (o *Client) DebugWrite(conn net.Conn, bs []byte) {
 // OnClientClose ...
 func (o *Client) OnClientClose(conn net.Conn) {
 	lClient.Log0Debug("OnClientClose:", conn.RemoteAddr().String())
-	level2Conns.Delete(conn)
-	userConns.Range(func(k, v interface{}) bool {
-		if v == conn {
+	key := clientKey(conn)
+	if v, ok := level2Conns.LoadAndDelete(key); ok {
+		serverConns.Delete(v)
+	}
+	if k, ok := clientUsers.LoadAndDelete(key); ok {
+		// 同一账号的新连接已覆盖时保留
+		if v, ok := userConns.Load(k); ok && clientKey(v.(net.Conn)) == key {
 			userConns.Delete(k)
-			return false
 		}
-		return true
-	})
+	}
 }
 
 // OnServerClose ...
 func (o *Client) OnServerClose(conn net.Conn) {
 	lClient.Log0Debug("OnServerClose:", conn.RemoteAddr().String())
-	level2Conns.Range(func(k, v interface{}) bool {
-		if v == conn {
-			level2Conns.Delete(k)
-			return false
-		}
-		return true
-	})
+	if key, ok := serverConns.LoadAndDelete(conn); ok {
+		level2Conns.Delete(key)
+	}
 }
@@ -8,6 +8,7 @@ import (
 
 func (o *Client) webServer(webPort string) error {
 	http.HandleFunc("/status", o.webStatus)
+	http.Handle("/metrics", o.metrics)
 
 	lClient.Log4Trace("listen:", webPort)
 	return http.ListenAndServe(webPort, nil)
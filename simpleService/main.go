@@ -5,6 +5,7 @@ import (
 	"crypto/cipher"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"flag"
 	"io/ioutil"
 	"log"
@@ -38,12 +39,30 @@ var (
 	clientLogPort = flag.String("cslog", ":8083", "客户端日志端口")
 	key           = flag.String("key", "20201015", "密钥，留空不启用AES加密")
 	crc           = flag.Bool("crc", false, "是否启动crc校验数据")
+	metricsUser   = flag.Bool("mu", false, "/metrics是否按账号统计")
+	accessLog     = flag.String("alog", "", "访问日志文件，-为标准输出，留空不记录")
+	accessLogFmt  = flag.String("alogf", "json", "访问日志格式 json/clf")
+	proxyProto    = flag.String("pp", "", "接收PROXY protocol头的可信负载均衡地址，逗号分隔CIDR，留空不接收")
+	h2Port        = flag.String("h2", "", "HTTP/2代理端口（TLS，同时支持HTTP/1.1和SOCKS5），留空不启用")
+	h2Cert        = flag.String("h2cert", "ssl/ssl.crt", "HTTP/2代理证书")
+	h2Key         = flag.String("h2key", "ssl/ssl.key", "HTTP/2代理私钥")
+	ssPort        = flag.String("ssport", "", "Shadowsocks代理端口，账号的密码作为密钥，留空不启用")
+	ssCipher      = flag.String("sscipher", "", "Shadowsocks加密方式 chacha20-ietf-poly1305/aes-256-gcm，留空都支持")
+	hopPSK        = flag.String("hop", "", "代理端口接受pproxy://节点间协议的预共享密钥，留空不接受")
+	tunnel        = flag.String("rt", "", "反向隧道，服务端为节点连接的端口，客户端为服务端的隧道地址，留空不启用")
+	tunnelKey     = flag.String("rtkey", "", "反向隧道的预共享密钥，服务端和客户端相同，没有默认值，启用-rt时必须设置")
+	tunnelPort    = flag.String("rtport", ":18082", "反向隧道在服务端开放的代理端口，须在服务端-rtports范围内")
+	tunnelPorts   = flag.String("rtports", ":18082-18089", "服务端允许节点注册的代理端口范围 [监听地址]:起始-结束，监听地址由服务端决定")
+	forwards      = flag.String("fwd", "", "静态端口转发，监听地址=目标[=二级代理]，多个用;分隔，二级代理可用>串联")
 
 	aesEnable bool
 	aesKey    [32]byte
 	aesIV     [16]byte
 	lServer   = logger.NewLogger(nil)
 	lClient   = logger.NewLogger(nil)
+
+	// -key有公开的默认值，反向隧道使用单独的密钥
+	errTunnelKey = errors.New("reverse tunnel requires -rtkey")
 )
 
 func main() {
@@ -3,9 +3,14 @@ package main
 import (
 	"crypto/md5"
 	"crypto/sha256"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net"
+	"pproxy"
+	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/ohko/omsg"
@@ -20,6 +25,8 @@ type Server struct {
 	msg        *omsg.Server
 	serverPort string
 	clients    sync.Map
+	tunnels    sync.Map // 反向隧道端口 => *pproxy.TunnelNode
+	metrics    *pproxy.Metrics
 }
 
 // Start 启动服务
@@ -34,6 +41,11 @@ func (o *Server) Start(key, serverPort, webPort string, crc bool) (err error) {
 	accounts.Store("m:n",
 		"request:http://127.0.0.1:8080/account/request?k=m:n") // 反向请求代理设置
 
+	o.metrics = &pproxy.Metrics{}
+	o.metrics.Gauge("pproxy_server_clients", "Connected proxy clients.", func() float64 { return float64(count(&o.clients)) })
+	o.metrics.Gauge("pproxy_server_accounts", "Configured accounts.", func() float64 { return float64(count(&accounts)) })
+	o.metrics.Gauge("pproxy_server_tunnels", "Connected reverse tunnel nodes.", func() float64 { return float64(count(&o.tunnels)) })
+
 	go o.webServer(webPort)
 
 	// setup AES
@@ -46,6 +58,13 @@ func (o *Server) Start(key, serverPort, webPort string, crc bool) (err error) {
 		lServer.Log4Trace("AES crypt disabled")
 	}
 
+	if *tunnel != "" {
+		if *tunnelKey == "" {
+			return errTunnelKey
+		}
+		go func() { lServer.Log2Error(o.ListenTunnel(*tunnelKey)) }()
+	}
+
 	if o.msg, err = omsg.Listen("tcp", o.serverPort); err != nil {
 		return
 	}
@@ -57,6 +76,94 @@ func (o *Server) Start(key, serverPort, webPort string, crc bool) (err error) {
 	return
 }
 
+// ListenTunnel 反向隧道，每个节点注册一个端口，端口的连接经节点的隧道转给节点代理，key为空时不启动
+func (o *Server) ListenTunnel(key string) error {
+	if key == "" {
+		return errTunnelKey
+	}
+	lServer.Log4Trace("listen tunnel:", *tunnel)
+	ln, err := net.Listen("tcp", *tunnel)
+	if err != nil {
+		return err
+	}
+
+	host, low, high, err := parsePortRange(*tunnelPorts)
+	if err != nil {
+		return err
+	}
+
+	ts := &pproxy.TunnelServer{Hop: &pproxy.Hop{PSK: []byte(key)}, OnNode: func(node *pproxy.TunnelNode) error {
+		// 节点只能选择范围内的端口，监听地址由服务端决定
+		h, p, err := net.SplitHostPort(node.Name)
+		if err != nil {
+			return err
+		}
+		port, err := strconv.Atoi(p)
+		if err != nil || h != "" || port < low || port > high {
+			return fmt.Errorf("port not allowed: %s, allowed :%d-%d", node.Name, low, high)
+		}
+		if _, ok := o.tunnels.Load(node.Name); ok {
+			return errors.New("port in use: " + node.Name)
+		}
+		pln, err := net.Listen("tcp", net.JoinHostPort(host, p))
+		if err != nil {
+			return err
+		}
+		o.tunnels.Store(node.Name, node)
+		lServer.Log0Debug("tunnel open:", node.Addr, node.Name)
+
+		go func() {
+			<-node.Done()
+			pln.Close()
+			o.tunnels.Delete(node.Name)
+			lServer.Log0Debug("tunnel close:", node.Addr, node.Name)
+		}()
+		go func() {
+			for {
+				conn, err := pln.Accept()
+				if err != nil {
+					return
+				}
+				go func(conn net.Conn) {
+					defer conn.Close()
+					st, err := node.Open(conn.RemoteAddr())
+					if err != nil {
+						lServer.Log2Error(err)
+						return
+					}
+					defer st.Close()
+					pproxy.CopyHelper(conn, st)
+				}(conn)
+			}
+		}()
+		return nil
+	}}
+	return ts.Serve(ln)
+}
+
+// 解析 [地址]:起始-结束，只有一个端口时起始和结束相同
+func parsePortRange(s string) (host string, low, high int, err error) {
+	i := strings.LastIndexByte(s, ':')
+	if i < 0 {
+		return "", 0, 0, errors.New("port range error: " + s)
+	}
+	host, s = s[:i], s[i+1:]
+	ports := strings.SplitN(s, "-", 2)
+	if low, err = strconv.Atoi(ports[0]); err != nil {
+		return
+	}
+	high = low
+	if len(ports) == 2 {
+		if high, err = strconv.Atoi(ports[1]); err != nil {
+			return
+		}
+	}
+	if low < 1 || high > 65535 || low > high {
+		err = errors.New("port range error: " + s)
+	}
+	return
+}
+
 // OnRecvError ...
 func (o *Server) OnRecvError(conn net.Conn, err error) {
 	if err != io.EOF {
@@ -105,3 +212,11 @@ func (o *Server) OnData(conn net.Conn, cmd, ext uint16, data []byte) error {
 func (o *Server) Send(conn net.Conn, cmd, ext uint16, originData []byte) error {
 	return o.msg.Send(conn, cmd, ext, aesCrypt(originData))
 }
+
+func count(m *sync.Map) (n int) {
+	m.Range(func(k, v interface{}) bool {
+		n++
+		return true
+	})
+	return
+}
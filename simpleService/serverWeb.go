@@ -17,6 +17,7 @@ func (o *Server) webServer(webPort string) error {
 	http.HandleFunc("/account/disconnect", o.webAccountDisconnect)
 	http.HandleFunc("/account/request", o.webAccountRequest)
 	http.HandleFunc("/status", o.webStatus)
+	http.Handle("/metrics", o.metrics)
 
 	lServer.Log4Trace("listen:", webPort)
 	return http.ListenAndServe(webPort, nil)
@@ -0,0 +1,76 @@
+package pproxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// hand socks4/socks4a proxy，USERID为 user:password
+func (o *PProxy) handshakeSocks4() (conn net.Conn, err error) {
+	// 04 01 端口(2) IP(4) USERID 00 [域名 00]
+	// socks4a的IP为0.0.0.x(x非0)，域名跟在USERID后面
+	b := make([]byte, 8)
+	if _, err = io.ReadFull(o.Client, b); err != nil {
+		return
+	}
+	o.debugRead(PhaseRequest, o.Client, b)
+
+	var userid string
+	if userid, err = readSocks4String(o.Client); err != nil {
+		return
+	}
+	host := net.IP(b[4:8]).String()
+	if b[4] == 0 && b[5] == 0 && b[6] == 0 && b[7] != 0 {
+		if host, err = readSocks4String(o.Client); err != nil {
+			return
+		}
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(b[2:4]))))
+	o.debugRead(PhaseRequest, o.Client, []byte(addr))
+
+	// 00 5A 成功，00 5B 失败，后面6个字节忽略
+	replied := false
+	reply := func(code byte) error {
+		replied = true
+		bs := []byte{0x00, code, 0, 0, 0, 0, 0, 0}
+		o.debugWrite(PhaseRequest, o.Client, bs)
+		_, err := o.Client.Write(bs)
+		return err
+	}
+	defer func() {
+		if err != nil && !replied {
+			reply(0x5B)
+		}
+	}()
+	if b[0] != 0x4 || b[1] != 0x1 {
+		return nil, errors.New("socks4: only CONNECT supported")
+	}
+
+	user, password := userid, ""
+	if i := strings.Index(userid, ":"); i >= 0 {
+		user, password = userid[:i], userid[i+1:]
+	}
+	return o.Connect(user, password, addr, func() error { return reply(0x5A) })
+}
+
+// 以00结尾的字符串，逐字节读取，不能多读客户端的数据
+func readSocks4String(r io.Reader) (string, error) {
+	var s []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		if b[0] == 0 {
+			return string(s), nil
+		}
+		if len(s) >= 0xFF {
+			return "", errors.New("socks4: string too long")
+		}
+		s = append(s, b[0])
+	}
+}
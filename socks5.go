@@ -1,6 +1,7 @@
 package pproxy
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -8,7 +9,6 @@ import (
 	"net"
 	"net/url"
 	"strconv"
-	"strings"
 )
 
 // hand socks5 proxy
@@ -24,9 +24,7 @@ func (o *PProxy) handshakeSocks5(prefix []byte) (conn net.Conn, err error) {
 	if err != nil {
 		return
 	}
-	if o.DebugRead != nil {
-		o.DebugRead(o.Client, b[:1])
-	}
+	o.debugRead(PhaseGreeting, o.Client, b[:1])
 	if b[0] == 0 || b[0] >= 0xff {
 		return nil, errors.New("accept error")
 	}
@@ -34,14 +32,10 @@ func (o *PProxy) handshakeSocks5(prefix []byte) (conn net.Conn, err error) {
 	if _, err = io.ReadFull(o.Client, b[:rlen]); err != nil {
 		return
 	}
-	if o.DebugRead != nil {
-		o.DebugRead(o.Client, b[:rlen])
-	}
+	o.debugRead(PhaseGreeting, o.Client, b[:rlen])
 
 	// 服务端:如果socks5代理允许匿名那么就返回05 00两个字节，如果要求验证就返回05 02两个字节。
-	if o.DebugWrite != nil {
-		o.DebugWrite(o.Client, []byte{0x05, 0x02})
-	}
+	o.debugWrite(PhaseGreeting, o.Client, []byte{0x05, 0x02})
 	if _, err = o.Client.Write([]byte{0x05, 0x02}); err != nil {
 		return
 	}
@@ -57,9 +51,7 @@ func (o *PProxy) handshakeSocks5(prefix []byte) (conn net.Conn, err error) {
 	if _, err = io.ReadFull(o.Client, b[:2]); err != nil {
 		return
 	}
-	if o.DebugRead != nil {
-		o.DebugRead(o.Client, b[:2])
-	}
+	o.debugRead(PhaseAuth, o.Client, b[:2])
 	if b[0] != 0x1 {
 		return nil, errors.New("need user and password")
 	}
@@ -68,36 +60,28 @@ func (o *PProxy) handshakeSocks5(prefix []byte) (conn net.Conn, err error) {
 	if _, err = io.ReadFull(o.Client, b[:rlen]); err != nil {
 		return
 	}
-	if o.DebugRead != nil {
-		o.DebugRead(o.Client, b[:rlen])
-	}
+	o.debugRead(PhaseAuth, o.Client, b[:rlen])
 	user := string(b[:rlen])
 	// password
 	if _, err = io.ReadFull(o.Client, b[:1]); err != nil {
 		return
 	}
-	if o.DebugRead != nil {
-		o.DebugRead(o.Client, b[:1])
-	}
+	o.debugRead(PhaseAuth, o.Client, b[:1])
 	rlen = int(b[0])
 	if _, err = io.ReadFull(o.Client, b[:rlen]); err != nil {
 		return
 	}
-	if o.DebugRead != nil {
-		o.DebugRead(o.Client, b[:rlen])
-	}
+	o.debugRead(PhaseAuth, o.Client, b[:rlen])
 	password := string(b[:rlen])
 
 	// 服务器验证失败，直接关闭连接即可
 	// 服务器验证成功后，就发送01 00给客户端，后面和匿名代理一样了
 	var newAuth string
-	newAuth, err = o.PI.OnAuth(o.Client, user, password)
+	newAuth, err = o.onAuth(user, password)
 	if err != nil {
 		return
 	}
-	if o.DebugWrite != nil {
-		o.DebugWrite(o.Client, []byte{0x01, 0x00})
-	}
+	o.debugWrite(PhaseAuth, o.Client, []byte{0x01, 0x00})
 	if _, err = o.Client.Write([]byte{0x01, 0x00}); err != nil {
 		return
 	}
@@ -120,9 +104,7 @@ func (o *PProxy) handshakeSocks5(prefix []byte) (conn net.Conn, err error) {
 	if _, err = io.ReadFull(o.Client, b[:4]); err != nil {
 		return
 	}
-	if o.DebugRead != nil {
-		o.DebugRead(o.Client, b[:4])
-	}
+	o.debugRead(PhaseRequest, o.Client, b[:4])
 	if b[0] != 0x5 {
 		return nil, errors.New("proxy command error")
 	}
@@ -134,18 +116,14 @@ func (o *PProxy) handshakeSocks5(prefix []byte) (conn net.Conn, err error) {
 		if err = binary.Read(o.Client, binary.BigEndian, &sip); err != nil {
 			return
 		}
-		if o.DebugRead != nil {
-			o.DebugRead(o.Client, []byte(sip.toAddr()))
-		}
+		o.debugRead(PhaseRequest, o.Client, []byte(sip.toAddr()))
 		addr = sip.toAddr()
 		// log.Printf("IP代理模式: %s", addr)
 	case 0x03: // 域名模式
 		if _, err = io.ReadFull(o.Client, b[:1]); err != nil {
 			return
 		}
-		if o.DebugRead != nil {
-			o.DebugRead(o.Client, b[:1])
-		}
+		o.debugRead(PhaseRequest, o.Client, b[:1])
 		rlen = int(b[0])
 		if rlen > 0x80 {
 			return nil, errors.New("host too long")
@@ -159,33 +137,28 @@ func (o *PProxy) handshakeSocks5(prefix []byte) (conn net.Conn, err error) {
 			return
 		}
 		addr = fmt.Sprintf("%s:%d", host, port)
-		if o.DebugRead != nil {
-			o.DebugRead(o.Client, []byte(addr))
-		}
+		o.debugRead(PhaseRequest, o.Client, []byte(addr))
 		// log.Printf("域名要求代理: %s", addr)
 	default: // 未知模式
 		return nil, fmt.Errorf("未知模式")
 	}
 
+	o.session.Target = addr
+
 	// 二级代理
 	if newAuth != "" {
-		info := &httpProxyInfo{uri: addr}
-
-		if strings.HasPrefix(newAuth, "http") {
-			info.originHeader = "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\nProxy-Authorization: Basic eDp5\r\nUser-Agengt: pproxy\r\n\r\n"
-			info.authLine = "Proxy-Authorization: Basic eDp5\r\n"
-			info.method = "CONNECT"
-		}
-
-		if conn, err = o.level2(info, newAuth); err != nil {
+		if conn, err = o.level2(connectInfo(addr), newAuth); err != nil {
 			return
 		}
 	}
 
 	// 建立连接
-	if conn, err = net.Dial("tcp", addr); err != nil {
-		return
+	if conn == nil {
+		if conn, err = o.dialTCP(addr); err != nil {
+			return
+		}
 	}
+	conn = o.wrapConn(conn)
 	defer func() {
 		if err != nil && conn != nil {
 			conn.Close()
@@ -195,31 +168,61 @@ func (o *PProxy) handshakeSocks5(prefix []byte) (conn net.Conn, err error) {
 	// 返回成功建立代理: 05 00 00 01 C0 A8  00 08 16 CE共10个字节
 	// 1、05 00 00 01固定的
 	// 2、后面8个字节可以全是00，也可以发送socks5服务器连接远程主机用到的ip地址和端口，比如这里C0 A8 00 08，就是192.168.0.8，16 CE即5838端口，即是socks5服务器用5838端口去连接百度的80端口。
-	if o.DebugWrite != nil {
-		o.DebugWrite(o.Client, []byte{0x05, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
-	}
+	o.debugWrite(PhaseRequest, o.Client, []byte{0x05, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
 	if _, err = o.Client.Write([]byte{0x05, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}); err != nil {
 		return
 	}
 
-	o.PI.OnSuccess(o.Client, conn)
+	if conn, err = o.intercept(conn); err != nil {
+		return
+	}
+
+	o.success(conn)
 	return
 }
 
-// socks5二级代理
-func (o *PProxy) socks5Level2(info *httpProxyInfo, newAuth string) (conn net.Conn, err error) {
-	info.level2 = "socks5"
+// Socks5Error socks5二级代理返回的REP错误码
+type Socks5Error byte
 
-	b := make([]byte, 0x100)
-	var u *url.URL
+var socks5Errors = map[Socks5Error]string{
+	0x01: "general SOCKS server failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
 
-	// log.Println("二级代理:", newAuth)
-	if u, err = url.Parse(newAuth); err != nil {
+func (e Socks5Error) Error() string {
+	if s, ok := socks5Errors[e]; ok {
+		return "socks5: " + s
+	}
+	return fmt.Sprintf("socks5: unknown error 0x%02x", byte(e))
+}
+
+// socks5二级代理，没有账号时只请求匿名
+// socks5:// 本地解析域名后按IP请求；socks5h:// 域名交给二级代理解析
+func (o *PProxy) socks5Level2(info *httpProxyInfo, u *url.URL, prev net.Conn) (conn net.Conn, err error) {
+	info.level2 = "socks5"
+
+	host, port, err := net.SplitHostPort(info.uri)
+	if err != nil {
+		return
+	}
+	var p int
+	if p, err = strconv.Atoi(port); err != nil {
 		return
 	}
+	if u.Scheme == "socks5" && net.ParseIP(host) == nil {
+		if host, err = o.resolve(host); err != nil {
+			return
+		}
+	}
 
 	// Dail
-	if conn, err = net.Dial("tcp", u.Host); err != nil {
+	if conn, err = o.upstreamConn(prev, u); err != nil {
 		return
 	}
 	defer func() {
@@ -229,37 +232,36 @@ func (o *PProxy) socks5Level2(info *httpProxyInfo, newAuth string) (conn net.Con
 	}()
 
 	// 匿名/登录
-	if o.DebugWrite != nil {
-		o.DebugWrite(conn, []byte{0x5, 0x2, 0x0, 0x2})
+	b := []byte{0x5, 0x1, 0x0}
+	if u.User != nil {
+		b = []byte{0x5, 0x2, 0x0, 0x2}
 	}
-	if _, err = conn.Write([]byte{0x5, 0x2, 0x0, 0x2}); err != nil {
+	o.debugWrite(PhaseLevel2, conn, b)
+	if _, err = conn.Write(b); err != nil {
 		return
 	}
 	if _, err = io.ReadFull(conn, b[:2]); err != nil {
 		return
 	}
-	if o.DebugRead != nil {
-		o.DebugRead(conn, b[:2])
-	}
+	o.debugRead(PhaseLevel2, conn, b[:2])
 	if b[0] != 0x5 {
 		return nil, errors.New("proxy command error")
 	}
-	if b[1] != 0x0 && b[1] != 2 {
-		return nil, errors.New("login return unknown command")
-	}
-
-	// need login
-	if b[1] == 0x2 {
-		b = b[:0]
-		b = append(b, 0x1)
-		b = append(b, byte(len(u.User.Username())))
-		b = append(b, []byte(u.User.Username())...)
-		p, _ := u.User.Password()
-		b = append(b, byte(len(p)))
-		b = append(b, []byte(p)...)
-		if o.DebugWrite != nil {
-			o.DebugWrite(conn, b)
+	switch {
+	case b[1] == 0x0:
+	case b[1] == 0x2 && u.User != nil:
+		// need login
+		user := u.User.Username()
+		pass, _ := u.User.Password()
+		if len(user) > 0xFF || len(pass) > 0xFF {
+			return nil, errors.New("socks5 user or password too long")
 		}
+		b = b[:0]
+		b = append(b, 0x1, byte(len(user)))
+		b = append(b, user...)
+		b = append(b, byte(len(pass)))
+		b = append(b, pass...)
+		o.debugWrite(PhaseLevel2, conn, b)
 		if _, err = conn.Write(b); err != nil {
 			return
 		}
@@ -267,46 +269,93 @@ func (o *PProxy) socks5Level2(info *httpProxyInfo, newAuth string) (conn net.Con
 		if _, err = io.ReadFull(conn, b[:2]); err != nil {
 			return
 		}
-		if o.DebugRead != nil {
-			o.DebugRead(conn, b[:2])
-		}
-		if b[0] != 0x1 && b[1] != 0 {
+		o.debugRead(PhaseLevel2, conn, b[:2])
+		if b[1] != 0x0 {
 			return nil, errors.New("socks5 login error")
 		}
+	case b[1] == 0xFF:
+		return nil, errors.New("socks5 no acceptable auth method")
+	default:
+		return nil, errors.New("login return unknown command")
 	}
 
-	// 域名方式代理
-	port := 0
-	up := strings.Split(info.uri, ":")
-	if port, err = strconv.Atoi(up[1]); err != nil {
-		return
-	}
-	b = b[:0]
-	b = append(b, []byte{0x5, 0x1, 0x0, 0x3}...)
-	b = append(b, byte(len(up[0])))
-	b = append(b, []byte(up[0])...)
-	bPort := make([]byte, 2)
-	binary.BigEndian.PutUint16(bPort, uint16(port))
-	b = append(b, bPort...)
-	if o.DebugWrite != nil {
-		o.DebugWrite(conn, b)
+	// 按目标地址类型请求：01 IPv4，04 IPv6，03 域名
+	b = []byte{0x5, 0x1, 0x0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 0xFF {
+			return nil, errors.New("host too long")
+		}
+		b = append(b, 0x3, byte(len(host)))
+		b = append(b, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, 0x1)
+		b = append(b, ip4...)
+	} else {
+		b = append(b, 0x4)
+		b = append(b, ip...)
 	}
+	b = append(b, byte(p>>8), byte(p))
+	o.debugWrite(PhaseLevel2, conn, b)
 	if _, err = conn.Write(b); err != nil {
 		return
 	}
-	if _, err = io.ReadFull(conn, b[:10]); err != nil {
+
+	// 应答: 05 REP 00 ATYP BND.ADDR BND.PORT，BND.ADDR长度由ATYP决定
+	if _, err = io.ReadFull(conn, b[:4]); err != nil {
 		return
 	}
-	if o.DebugRead != nil {
-		o.DebugRead(conn, b[:10])
+	o.debugRead(PhaseLevel2, conn, b[:4])
+	if b[0] != 0x5 {
+		return nil, errors.New("proxy command error")
 	}
-	if b[0] != 0x5 && b[1] != 0x0 && b[2] != 0x0 && b[3] != 0x1 {
-		return nil, errors.New("socks5 server connect error")
+	if b[1] != 0x0 {
+		return nil, Socks5Error(b[1])
 	}
-
+	n := 0
+	switch b[3] {
+	case 0x1:
+		n = net.IPv4len
+	case 0x4:
+		n = net.IPv6len
+	case 0x3:
+		if _, err = io.ReadFull(conn, b[:1]); err != nil {
+			return
+		}
+		n = int(b[0])
+	default:
+		return nil, errors.New("socks5 reply address type error")
+	}
+	bnd := make([]byte, n+2)
+	if _, err = io.ReadFull(conn, bnd); err != nil {
+		return
+	}
+	o.debugRead(PhaseLevel2, conn, bnd)
 	return
 }
 
+// 本地解析域名，优先IPv4
+func (o *PProxy) resolve(host string) (string, error) {
+	ctx := o.context()
+	if !o.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, o.deadline)
+		defer cancel()
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	for _, ip := range ips {
+		if ip.IP.To4() != nil {
+			return ip.IP.String(), nil
+		}
+	}
+	if len(ips) == 0 {
+		return "", errors.New("no address for " + host)
+	}
+	return ips[0].IP.String(), nil
+}
+
 type sockIP struct {
 	A, B, C, D byte
 	PORT       uint16
@@ -0,0 +1,139 @@
+package pproxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// 请求记录
+type socks5Request struct {
+	methods []byte
+	atyp    byte
+	host    string
+}
+
+// 匿名socks5服务器，按rep应答，bnd为应答中的ATYP和地址，成功后连接echo
+func startSocks5(t *testing.T, echo string, rep byte, bnd []byte, reqs chan<- socks5Request) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				var r socks5Request
+				b := make([]byte, 0x100)
+				if _, err := io.ReadFull(conn, b[:2]); err != nil {
+					return
+				}
+				r.methods = make([]byte, b[1])
+				io.ReadFull(conn, r.methods)
+				conn.Write([]byte{0x5, 0x0})
+
+				io.ReadFull(conn, b[:4])
+				r.atyp = b[3]
+				switch r.atyp {
+				case 0x1:
+					io.ReadFull(conn, b[:4])
+					r.host = net.IP(b[:4]).String()
+				case 0x4:
+					io.ReadFull(conn, b[:16])
+					r.host = net.IP(b[:16]).String()
+				case 0x3:
+					io.ReadFull(conn, b[:1])
+					n := int(b[0])
+					io.ReadFull(conn, b[:n])
+					r.host = string(b[:n])
+				}
+				io.ReadFull(conn, b[:2])
+				reqs <- r
+
+				conn.Write(append(append([]byte{0x5, rep, 0x0}, bnd...), 0x1, 0xBB))
+				if rep != 0 {
+					return
+				}
+				up, err := net.Dial("tcp", echo)
+				if err != nil {
+					return
+				}
+				defer up.Close()
+				CopyHelper(conn, up)
+			}(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// go test pproxy -run Test_Socks5Level2 -v -count=1
+func Test_Socks5Level2(t *testing.T) {
+	echo := startEcho(t)
+	_, port, _ := net.SplitHostPort(echo)
+	reqs := make(chan socks5Request, 1)
+
+	v4 := []byte{0x1, 10, 0, 0, 1}
+	v6 := append([]byte{0x4}, net.ParseIP("::1")...)
+	domain := append([]byte{0x3, 9}, "localhost"...)
+	for _, c := range []struct {
+		upstream string
+		bnd      []byte
+		target   string
+		atyp     byte
+		host     string
+	}{
+		{"socks5://", v4, "localhost:" + port, 0x1, "127.0.0.1"},
+		{"socks5h://", v6, "localhost:" + port, 0x3, "localhost"},
+		{"socks5h://", domain, "[::1]:" + port, 0x4, "::1"},
+		{"socks5://", domain, "10.1.2.3:" + port, 0x1, "10.1.2.3"},
+	} {
+		s := startSocks5(t, echo, 0, c.bnd, reqs)
+		conn, err := NewDialer(c.upstream+s).Dial("tcp", c.target)
+		if err != nil {
+			t.Fatal(c.upstream, c.target, err)
+		}
+		r := <-reqs
+		if string(r.methods) != "\x00" || r.atyp != c.atyp || r.host != c.host {
+			t.Fatal(c.upstream, c.target, r)
+		}
+		// 变长应答后的数据不能丢
+		conn.SetDeadline(time.Now().Add(time.Second * 3))
+		conn.Write([]byte("ping"))
+		bs := make([]byte, 4)
+		if _, err = io.ReadFull(conn, bs); err != nil || string(bs) != "ping" {
+			t.Fatal(c.upstream, err, string(bs))
+		}
+		conn.Close()
+	}
+
+	// 有账号时请求匿名和登录
+	s := startSocks5(t, echo, 0, v4, reqs)
+	conn, err := NewDialer("socks5://a:b@"+s).Dial("tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if r := <-reqs; string(r.methods) != "\x00\x02" {
+		t.Fatal(r)
+	}
+
+	// REP错误码
+	s = startSocks5(t, echo, 0x5, v4, reqs)
+	_, err = NewDialer("socks5h://"+s).Dial("tcp", echo)
+	<-reqs
+	var se Socks5Error
+	if !errors.As(err, &se) || se != 0x5 || err.Error() != "socks5: connection refused" {
+		t.Fatal(err)
+	}
+	if s := Socks5Error(0x42).Error(); s != "socks5: unknown error 0x"+strconv.FormatInt(0x42, 16) {
+		t.Fatal(s)
+	}
+}
@@ -0,0 +1,104 @@
+package pproxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+)
+
+// 出口地址策略
+const (
+	SourceRotate = "rotate" // 每个连接轮换
+	SourceSticky = "sticky" // 同一会话的连接固定使用一个地址
+)
+
+// Validate 检查出口地址是本机地址、策略有效
+func (o *Route) Validate() error {
+	switch o.SourcePolicy {
+	case "", SourceRotate, SourceSticky:
+	default:
+		return errors.New("unknown source policy: " + o.SourcePolicy)
+	}
+	for _, ip := range o.SourceIPs {
+		if net.ParseIP(ip) == nil {
+			return errors.New("invalid source ip: " + ip)
+		}
+		// 能绑定说明地址在本机
+		pc, err := net.ListenPacket("udp", net.JoinHostPort(ip, "0"))
+		if err != nil {
+			return fmt.Errorf("source ip %s not on this host: %v", ip, err)
+		}
+		pc.Close()
+	}
+	return nil
+}
+
+// 重新Validate并缓存结果，SetRoute和健康检查时调用
+func (o *Route) revalidate() error {
+	err := o.Validate()
+	o.mu.Lock()
+	o.invalid = err
+	o.mu.Unlock()
+	return err
+}
+
+// 最近一次Validate的结果
+func (o *Route) validated() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.invalid
+}
+
+// 从与目标同一地址族的出口地址中轮换选择，ip为nil时不区分，没有可用地址时返回空
+func (o *Route) source(ip net.IP) string {
+	pool := o.SourceIPs
+	if ip != nil {
+		pool = nil
+		for _, v := range o.SourceIPs {
+			if sameFamily(net.ParseIP(v), ip) {
+				pool = append(pool, v)
+			}
+		}
+	}
+	n := len(pool)
+	if n == 0 {
+		return ""
+	}
+	return pool[(atomic.AddUint32(&o.sourceNext, 1)-1)%uint32(n)]
+}
+
+func sameFamily(a, b net.IP) bool {
+	return (a.To4() != nil) == (b.To4() != nil)
+}
+
+// 连接addr使用的出口地址，SourceRotate每个连接重新选择，SourceSticky第一次连接时选择、会话内不变
+// addr为IP时只使用同一地址族的出口地址，会话的地址族不同时为这次连接另选；为域名或空时不区分
+// Session.SourceIP记录会话最近使用的地址
+func (o *PProxy) sourceIP(addr string) (net.IP, error) {
+	if o.source != nil {
+		return o.source, nil
+	}
+	if o.session == nil || o.route == nil || len(o.route.SourceIPs) == 0 {
+		return nil, nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	target := net.ParseIP(host)
+	sticky := o.route.SourcePolicy == SourceSticky
+	if sticky && o.session.SourceIP != "" {
+		if ip := net.ParseIP(o.session.SourceIP); target == nil || sameFamily(ip, target) {
+			return ip, nil
+		}
+	}
+	source := o.route.source(target)
+	if source == "" {
+		return nil, errors.New("no source ip of the same family as " + addr)
+	}
+	if !sticky || o.session.SourceIP == "" {
+		o.session.SourceIP = source
+	}
+	return net.ParseIP(source), nil
+}
@@ -0,0 +1,140 @@
+package pproxy
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// 记录连接来源地址
+type recordSource struct {
+	allowAll
+	sources chan string
+}
+
+func (o *recordSource) OnAuth(conn net.Conn, user, password string) (string, error) {
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	o.sources <- host
+	return o.level2, nil
+}
+
+// go test pproxy -run Test_SourceIP -v -count=1
+func Test_SourceIP(t *testing.T) {
+	echo := startEcho(t)
+	upstream := &recordSource{sources: make(chan string, 1)}
+	up := startProxy(t, upstream, nil)
+
+	router := &Router{}
+	for _, r := range []*Route{
+		{Name: "rotate", SourceIPs: []string{"127.0.0.2", "127.0.0.3"}},
+		{Name: "sticky", SourceIPs: []string{"127.0.0.2", "127.0.0.3"}, SourcePolicy: SourceSticky},
+		{Name: "level2", Upstreams: []string{"http://a:b@" + up}, SourceIPs: []string{"127.0.0.4"}},
+	} {
+		if err := router.SetRoute(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pick := func(level2 string) *Session {
+		pi := &recordChoose{allowAll: allowAll{level2: level2}, chosen: make(chan *Session, 1)}
+		p := startProxy(t, pi, func(pp *PProxy) { pp.Router = router })
+		if err := connectEcho(p, echo); err != nil {
+			t.Fatal(level2, err)
+		}
+		return <-pi.chosen
+	}
+
+	// 直连轮换
+	s1, s2 := pick("route:rotate"), pick("route:rotate")
+	if s1.SourceIP == s2.SourceIP || s1.SourceIP == "" || s2.SourceIP == "" {
+		t.Fatal("rotate:", s1.SourceIP, s2.SourceIP)
+	}
+
+	// 同一会话先后连接两个目标，返回目标看到的来源地址
+	web1, web2 := startRemoteAddrServer(t), startRemoteAddrServer(t)
+	session := func(level2 string) (a, b string) {
+		p := startProxy(t, &allowAll{level2: level2}, func(pp *PProxy) { pp.Router = router })
+		conn, err := net.DialTimeout("tcp", p, time.Second*3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(time.Second * 3))
+		br := bufio.NewReader(conn)
+		get := func(web string) string {
+			conn.Write([]byte("GET http://" + web + "/ HTTP/1.1\r\nHost: " + web + "\r\nProxy-Authorization: Basic eDp5\r\n\r\n"))
+			resp, err := http.ReadResponse(br, nil)
+			if err != nil {
+				t.Fatal(level2, err)
+			}
+			defer resp.Body.Close()
+			bs, _ := ioutil.ReadAll(resp.Body)
+			host, _, _ := net.SplitHostPort(string(bs))
+			return host
+		}
+		return get(web1), get(web2)
+	}
+	// 每个连接轮换
+	if a, b := session("route:rotate"); a == b {
+		t.Fatal("rotate per connection:", a, b)
+	}
+	// 同一会话固定
+	if a, b := session("route:sticky"); a != b || a == "" {
+		t.Fatal("sticky per session:", a, b)
+	}
+	// 连接二级代理使用出口地址
+	if s := pick("route:level2"); s.SourceIP != "127.0.0.4" {
+		t.Fatal("level2:", s.SourceIP)
+	}
+	if source := <-upstream.sources; source != "127.0.0.4" {
+		t.Fatal("level2 source:", source)
+	}
+	// 没有设置时为空
+	if s := pick(""); s.SourceIP != "" {
+		t.Fatal("direct:", s.SourceIP)
+	}
+
+	// 只使用与目标同一地址族的出口地址
+	if ln, err := net.Listen("tcp", "[::1]:0"); err == nil {
+		ln.Close()
+		if err := router.SetRoute(&Route{Name: "mixed", SourceIPs: []string{"::1", "127.0.0.2"}}); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3; i++ {
+			if s := pick("route:mixed"); s.SourceIP != "127.0.0.2" {
+				t.Fatal("mixed:", s.SourceIP)
+			}
+		}
+		router.SetRoute(&Route{Name: "v6", SourceIPs: []string{"::1"}})
+		p := startProxy(t, &allowAll{level2: "route:v6"}, func(pp *PProxy) { pp.Router = router })
+		if err := connectEcho(p, echo); err == nil {
+			t.Fatal("want error: no IPv4 source")
+		}
+	}
+
+	// 校验，注册时和健康检查时检查，会话使用检查的结果
+	for _, r := range []*Route{
+		{SourceIPs: []string{"192.0.2.1"}},
+		{SourceIPs: []string{"bad"}},
+		{SourceIPs: []string{"127.0.0.2"}, SourcePolicy: "random"},
+	} {
+		if err := router.SetRoute(r); err == nil {
+			t.Fatal("want error:", r.SourceIPs, r.SourcePolicy)
+		}
+	}
+	r := &Route{Name: "changed", SourceIPs: []string{"127.0.0.2"}}
+	if err := router.SetRoute(r); err != nil {
+		t.Fatal(err)
+	}
+	r.SourceIPs = []string{"192.0.2.1"}
+	if _, err := router.Resolve("route:changed"); err != nil {
+		t.Fatal(err)
+	}
+	router.checkAll()
+	if _, err := router.Resolve("route:changed"); err == nil {
+		t.Fatal("want error: source ip not on this host")
+	}
+}
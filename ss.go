@@ -0,0 +1,522 @@
+package pproxy
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Shadowsocks AEAD 加密方式
+const (
+	SSChacha20   = "chacha20-ietf-poly1305"
+	SSAES256GCM  = "aes-256-gcm"
+	ssKeySize    = 32 // 两种加密方式的密钥和salt都是32字节
+	ssTagSize    = 16
+	ssMaxPayload = 0x3FFF
+)
+
+// Shadowsocks 入站配置，设置后Handshake按Shadowsocks AEAD处理，不再探测SOCKS5/HTTP
+// 协议不带账号，按密钥依次尝试解密第一个数据块，匹配后用账号密码调用OnAuth
+// 密码即密钥，多个账号使用相同密码时无法区分，拒绝连接
+// 多个PProxy共享同一个Shadowsocks
+type Shadowsocks struct {
+	Cipher string                   // SSChacha20/SSAES256GCM，空表示两种都尝试
+	Users  func() map[string]string // 账号 => 密码
+
+	mu   sync.Mutex
+	keys map[string][]byte // 密码 => 主密钥，避免每个连接重新派生
+}
+
+// 一个主密钥对应的账号
+type ssUser struct {
+	key      []byte
+	password string
+	users    []string // 多于一个时密码重复
+}
+
+// 按主密钥索引账号，密钥去重，按密钥排序使匹配结果确定
+func (o *Shadowsocks) users() []*ssUser {
+	var users map[string]string
+	if o.Users != nil {
+		users = o.Users()
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	keys := make(map[string][]byte, len(users))
+	byKey := map[string]*ssUser{}
+	for u, p := range users {
+		k, ok := o.keys[p]
+		if !ok {
+			k = ssKey(p)
+		}
+		keys[p] = k
+		su, ok := byKey[string(k)]
+		if !ok {
+			su = &ssUser{key: k, password: p}
+			byKey[string(k)] = su
+		}
+		su.users = append(su.users, u)
+	}
+	o.keys = keys
+
+	index := make([]*ssUser, 0, len(byKey))
+	for _, su := range byKey {
+		sort.Strings(su.users)
+		index = append(index, su)
+	}
+	sort.Slice(index, func(i, j int) bool { return bytes.Compare(index[i].key, index[j].key) < 0 })
+	return index
+}
+
+// 按密码派生主密钥，EVP_BytesToKey(MD5)
+func ssKey(password string) []byte {
+	var key, prev []byte
+	for len(key) < ssKeySize {
+		h := md5.New()
+		h.Write(prev)
+		h.Write([]byte(password))
+		prev = h.Sum(nil)
+		key = append(key, prev...)
+	}
+	return key[:ssKeySize]
+}
+
+// 每个方向一个AEAD，nonce从0递增
+// Shadowsocks子密钥为 HKDF-SHA1(key, salt, "ss-subkey")
+type aeadCipher struct {
+	aead  cipher.AEAD
+	nonce []byte
+}
+
+func newSSCipher(method string, key, salt []byte) (*aeadCipher, error) {
+	subkey := make([]byte, ssKeySize)
+	if _, err := io.ReadFull(hkdf.New(sha1.New, key, salt, []byte("ss-subkey")), subkey); err != nil {
+		return nil, err
+	}
+
+	var aead cipher.AEAD
+	var err error
+	switch method {
+	case SSChacha20:
+		aead, err = chacha20poly1305.New(subkey)
+	case SSAES256GCM:
+		var block cipher.Block
+		if block, err = aes.NewCipher(subkey); err == nil {
+			aead, err = cipher.NewGCM(block)
+		}
+	default:
+		err = errors.New("unknown shadowsocks cipher: " + method)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &aeadCipher{aead: aead, nonce: make([]byte, aead.NonceSize())}, nil
+}
+
+func (o *aeadCipher) increment() {
+	for i := range o.nonce {
+		o.nonce[i]++
+		if o.nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+func (o *aeadCipher) seal(dst, plain []byte) []byte {
+	dst = o.aead.Seal(dst, o.nonce, plain, nil)
+	o.increment()
+	return dst
+}
+
+func (o *aeadCipher) open(ciphertext []byte) ([]byte, error) {
+	plain, err := o.aead.Open(ciphertext[:0], o.nonce, ciphertext, nil)
+	if err != nil {
+		return nil, err
+	}
+	o.increment()
+	return plain, nil
+}
+
+// 加密为数据块：[长度+tag][数据+tag]
+func (o *aeadCipher) sealChunks(dst, plain []byte) []byte {
+	for len(plain) > 0 {
+		n := len(plain)
+		if n > ssMaxPayload {
+			n = ssMaxPayload
+		}
+		size := []byte{byte(n >> 8), byte(n)}
+		dst = o.seal(dst, size)
+		dst = o.seal(dst, plain[:n])
+		plain = plain[n:]
+	}
+	return dst
+}
+
+// 读取一个数据块
+func (o *aeadCipher) readChunk(r io.Reader) ([]byte, error) {
+	b := make([]byte, 2+ssTagSize)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	size, err := o.open(b)
+	if err != nil {
+		return nil, err
+	}
+	b = make([]byte, int(binary.BigEndian.Uint16(size)&ssMaxPayload)+ssTagSize)
+	if _, err = io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return o.open(b)
+}
+
+// ssConn 到Shadowsocks服务器的连接，Write加密，Read解密
+type ssConn struct {
+	net.Conn
+	method string
+	key    []byte
+
+	wmu  sync.Mutex
+	enc  *aeadCipher
+	dec  *aeadCipher
+	rbuf []byte
+}
+
+func (o *ssConn) Write(b []byte) (n int, err error) {
+	o.wmu.Lock()
+	defer o.wmu.Unlock()
+
+	var out []byte
+	if o.enc == nil {
+		salt := make([]byte, ssKeySize)
+		if _, err = rand.Read(salt); err != nil {
+			return
+		}
+		if o.enc, err = newSSCipher(o.method, o.key, salt); err != nil {
+			return
+		}
+		out = salt
+	}
+	if _, err = o.Conn.Write(o.enc.sealChunks(out, b)); err != nil {
+		return
+	}
+	return len(b), nil
+}
+
+func (o *ssConn) Read(b []byte) (n int, err error) {
+	if len(o.rbuf) == 0 {
+		if o.dec == nil {
+			salt := make([]byte, ssKeySize)
+			if _, err = io.ReadFull(o.Conn, salt); err != nil {
+				return
+			}
+			if o.dec, err = newSSCipher(o.method, o.key, salt); err != nil {
+				return
+			}
+		}
+		if o.rbuf, err = o.dec.readChunk(o.Conn); err != nil {
+			return
+		}
+	}
+	n = copy(b, o.rbuf)
+	o.rbuf = o.rbuf[n:]
+	return
+}
+
+// ssServerConn 入站会话返回给调用方的连接，调用方CopyHelper时：
+// Write收到客户端的密文，解密后写入目标；Read从目标读取，加密后返回给客户端
+type ssServerConn struct {
+	net.Conn // 到目标的连接
+	dec      *aeadCipher
+	in       []byte // 未解密的密文
+	size     int    // 等待的数据块长度，-1表示等待长度块
+
+	method string
+	key    []byte
+	enc    *aeadCipher
+	out    []byte // 未返回的密文
+	buf    []byte
+}
+
+func (o *ssServerConn) Write(b []byte) (n int, err error) {
+	o.in = append(o.in, b...)
+	for {
+		need := 2 + ssTagSize
+		if o.size >= 0 {
+			need = o.size + ssTagSize
+		}
+		if len(o.in) < need {
+			break
+		}
+
+		var plain []byte
+		if plain, err = o.dec.open(o.in[:need]); err != nil {
+			return
+		}
+		o.in = o.in[need:]
+		if o.size < 0 {
+			o.size = int(binary.BigEndian.Uint16(plain) & ssMaxPayload)
+			continue
+		}
+		o.size = -1
+		if _, err = o.Conn.Write(plain); err != nil {
+			return
+		}
+	}
+	if len(o.in) == 0 {
+		o.in = nil
+	}
+	return len(b), nil
+}
+
+func (o *ssServerConn) Read(b []byte) (n int, err error) {
+	if len(o.out) == 0 {
+		if o.buf == nil {
+			o.buf = make([]byte, ssMaxPayload)
+		}
+		var m int
+		if m, err = o.Conn.Read(o.buf); m == 0 {
+			return
+		}
+		err = nil
+		if o.enc == nil {
+			salt := make([]byte, ssKeySize)
+			if _, err = rand.Read(salt); err != nil {
+				return
+			}
+			if o.enc, err = newSSCipher(o.method, o.key, salt); err != nil {
+				return
+			}
+			o.out = salt
+		}
+		o.out = o.enc.sealChunks(o.out, o.buf[:m])
+	}
+	n = copy(b, o.out)
+	o.out = o.out[n:]
+	return
+}
+
+// SOCKS5格式的目标地址
+func ssAddr(addr string) ([]byte, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, err
+	}
+
+	var b []byte
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		b = append([]byte{0x01}, ip.To4()...)
+	} else if ip != nil {
+		b = append([]byte{0x04}, ip.To16()...)
+	} else {
+		if len(host) > 0xFF {
+			return nil, errors.New("host too long")
+		}
+		b = append([]byte{0x03, byte(len(host))}, host...)
+	}
+	return append(b, byte(p>>8), byte(p)), nil
+}
+
+// 解析SOCKS5格式的目标地址，返回地址和剩余数据
+func ssParseAddr(b []byte) (addr string, rest []byte, err error) {
+	if len(b) < 1 {
+		return "", nil, errors.New("shadowsocks address error")
+	}
+	var host string
+	switch b[0] {
+	case 0x01:
+		if len(b) < 1+4+2 {
+			return "", nil, errors.New("shadowsocks address error")
+		}
+		host, b = net.IP(b[1:5]).String(), b[5:]
+	case 0x04:
+		if len(b) < 1+16+2 {
+			return "", nil, errors.New("shadowsocks address error")
+		}
+		host, b = net.IP(b[1:17]).String(), b[17:]
+	case 0x03:
+		if len(b) < 2 || len(b) < 2+int(b[1])+2 {
+			return "", nil, errors.New("shadowsocks address error")
+		}
+		host, b = string(b[2:2+int(b[1])]), b[2+int(b[1]):]
+	default:
+		return "", nil, errors.New("shadowsocks address type error")
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(b)))), b[2:], nil
+}
+
+// Shadowsocks入站
+func (o *PProxy) handshakeSS() (conn net.Conn, err error) {
+	salt := make([]byte, ssKeySize)
+	if _, err = io.ReadFull(o.Client, salt); err != nil {
+		return
+	}
+	size := make([]byte, 2+ssTagSize)
+	if _, err = io.ReadFull(o.Client, size); err != nil {
+		return
+	}
+	o.debugRead(PhaseGreeting, o.Client, append(salt, size...))
+
+	// 依次尝试每个密钥
+	methods := []string{SSChacha20, SSAES256GCM}
+	if o.Shadowsocks.Cipher != "" {
+		methods = []string{o.Shadowsocks.Cipher}
+	}
+	var (
+		dec    *aeadCipher
+		method string
+		match  *ssUser
+	)
+	for _, su := range o.Shadowsocks.users() {
+		for _, m := range methods {
+			c, e := newSSCipher(m, su.key, salt)
+			if e != nil {
+				return nil, e
+			}
+			if _, e = c.aead.Open(nil, c.nonce, size, nil); e == nil {
+				dec, method, match = c, m, su
+				break
+			}
+		}
+		if dec != nil {
+			break
+		}
+	}
+	if dec == nil || len(match.users) > 1 {
+		o.session.User = ""
+		o.emit(&Event{Type: EventAuthAttempt})
+		err = errors.New("shadowsocks: no matching user")
+		if dec != nil {
+			err = errors.New("shadowsocks: password shared by users " + strings.Join(match.users, ","))
+		}
+		o.emit(&Event{Type: EventAuthResult, Err: err})
+		return
+	}
+	user, password, key := match.users[0], match.password, match.key
+
+	// 地址和第一段数据
+	plain, _ := dec.open(size)
+	b := make([]byte, int(binary.BigEndian.Uint16(plain)&ssMaxPayload)+ssTagSize)
+	if _, err = io.ReadFull(o.Client, b); err != nil {
+		return
+	}
+	if plain, err = dec.open(b); err != nil {
+		return
+	}
+	var addr string
+	var rest []byte
+	if addr, rest, err = ssParseAddr(plain); err != nil {
+		return
+	}
+	o.debugRead(PhaseRequest, o.Client, []byte(addr))
+	o.session.Target = addr
+
+	var newAuth string
+	if newAuth, err = o.onAuth(user, password); err != nil {
+		return
+	}
+
+	// 二级代理
+	if newAuth != "" {
+		if conn, err = o.level2(connectInfo(addr), newAuth); err != nil {
+			return
+		}
+	}
+	if conn == nil {
+		if conn, err = o.dialTCP(addr); err != nil {
+			return
+		}
+	}
+	conn = o.wrapConn(conn)
+	defer func() {
+		if err != nil && conn != nil {
+			conn.Close()
+		}
+	}()
+
+	if conn, err = o.intercept(conn); err != nil {
+		return
+	}
+	if len(rest) > 0 {
+		if _, err = conn.Write(rest); err != nil {
+			return
+		}
+	}
+
+	sc := &ssServerConn{Conn: conn, dec: dec, size: -1, method: method, key: key}
+	conn = &Conn{Conn: sc, Session: o.session}
+	o.success(conn)
+	return
+}
+
+// 解析 ss://method:password@host:port 或 SIP002 ss://base64(method:password)@host:port
+func ssURL(u *url.URL) (method, password string, err error) {
+	if u.User == nil {
+		return "", "", errors.New("shadowsocks: missing method and password")
+	}
+	method = u.User.Username()
+	var ok bool
+	if password, ok = u.User.Password(); !ok {
+		var bs []byte
+		if bs, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(method, "=")); err != nil {
+			return
+		}
+		i := strings.Index(string(bs), ":")
+		if i < 0 {
+			return "", "", errors.New("shadowsocks: userinfo error")
+		}
+		method, password = string(bs[:i]), string(bs[i+1:])
+	}
+	return
+}
+
+// Shadowsocks二级代理
+func (o *PProxy) ssLevel2(info *httpProxyInfo, u *url.URL, prev net.Conn) (conn net.Conn, err error) {
+	info.level2 = "ss"
+
+	method, password, err := ssURL(u)
+	if err != nil {
+		return
+	}
+	if _, err = newSSCipher(method, make([]byte, ssKeySize), make([]byte, ssKeySize)); err != nil {
+		return
+	}
+	var addr []byte
+	if addr, err = ssAddr(info.uri); err != nil {
+		return
+	}
+
+	if conn, err = o.upstreamConn(prev, u); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil && conn != nil {
+			conn.Close()
+		}
+	}()
+
+	conn = &ssConn{Conn: conn, method: method, key: ssKey(password)}
+	o.debugWrite(PhaseLevel2, conn, addr)
+	_, err = conn.Write(addr)
+	return
+}
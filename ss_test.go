@@ -0,0 +1,76 @@
+package pproxy
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"net"
+	"testing"
+)
+
+// 按账号返回二级代理
+type userLevel2 struct {
+	allowAll
+	users map[string]string
+}
+
+func (o *userLevel2) OnAuth(conn net.Conn, user, password string) (string, error) {
+	return o.users[user], nil
+}
+
+// go test pproxy -run Test_Shadowsocks -v -count=1
+func Test_Shadowsocks(t *testing.T) {
+	// EVP_BytesToKey("foobar")
+	if k := hex.EncodeToString(ssKey("foobar")); k != "3858f62230ac3c915f300c664312c63f568378529614d22ddb49237d2f60bfdf" {
+		t.Fatal(k)
+	}
+
+	echo := startEcho(t)
+	p3 := startProxy(t, &allowAll{}, nil)
+	ss := &Shadowsocks{Users: func() map[string]string {
+		return map[string]string{"u1": "p1", "u2": "p2"}
+	}}
+	sessions := make(chan *Session, 1)
+	pi := &recordChoose{chosen: sessions}
+	s1 := startProxy(t, &userLevel2{allowAll: allowAll{}, users: map[string]string{"u2": "http://a:b@" + p3}}, func(pp *PProxy) { pp.Shadowsocks = ss })
+	s2 := startProxy(t, pi, func(pp *PProxy) { pp.Shadowsocks = ss })
+
+	sip002 := base64.RawURLEncoding.EncodeToString([]byte(SSAES256GCM + ":p1"))
+	for _, level2 := range []string{
+		"ss://" + SSChacha20 + ":p1@" + s1,
+		"ss://" + sip002 + "@" + s1,
+		"ss://" + SSChacha20 + ":p2@" + s1, // Shadowsocks入站再经过http二级代理
+	} {
+		p1 := startProxy(t, &allowAll{level2: level2}, nil)
+		if err := connectEcho(p1, echo); err != nil {
+			t.Fatal(level2, err)
+		}
+	}
+
+	p1 := startProxy(t, &allowAll{level2: "ss://" + SSAES256GCM + ":p2@" + s2}, nil)
+	if err := connectEcho(p1, echo); err != nil {
+		t.Fatal(err)
+	}
+	if s := <-sessions; s.User != "u2" || s.Protocol != "ss" || s.Target != echo {
+		t.Fatal(s)
+	}
+
+	p1 = startProxy(t, &allowAll{level2: "ss://" + SSChacha20 + ":bad@" + s1}, nil)
+	if err := connectEcho(p1, echo); err == nil {
+		t.Fatal("want error")
+	}
+
+	// 密码相同的账号无法区分，拒绝；其他账号不受影响
+	shared := &Shadowsocks{Users: func() map[string]string {
+		return map[string]string{"u1": "p1", "u2": "p1", "u3": "p3"}
+	}}
+	s3 := startProxy(t, &allowAll{}, func(pp *PProxy) { pp.Shadowsocks = shared })
+	if err := connectEcho(startProxy(t, &allowAll{level2: "ss://" + SSChacha20 + ":p1@" + s3}, nil), echo); err == nil {
+		t.Fatal("want error")
+	}
+	if err := connectEcho(startProxy(t, &allowAll{level2: "ss://" + SSChacha20 + ":p3@" + s3}, nil), echo); err != nil {
+		t.Fatal(err)
+	}
+	if users := shared.users(); len(users) != 2 || len(shared.keys) != 2 {
+		t.Fatal(users)
+	}
+}
@@ -0,0 +1,3 @@
+# TLS拦截（MITM）使用的CA，客户端需要信任 ca.crt
+openssl genrsa -out ca.key 2048
+openssl req -new -x509 -days 3650 -sha256 -subj "/C=CN/ST=Shanghai/L=Shanghai/O=MyCompany/OU=MyCompany/CN=PProxy CA" -addext "basicConstraints=critical,CA:TRUE" -addext "keyUsage=critical,keyCertSign,cRLSign" -key ca.key -out ca.crt
@@ -0,0 +1,163 @@
+package pproxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"time"
+)
+
+// TunnelServer 反向隧道服务端，NAT后面的节点主动连接，服务端把公网客户端连接经节点的连接转给节点处理
+// 节点连接使用节点间协议（Hop的PSK或TLS）和多路复用，每个客户端连接一个流
+type TunnelServer struct {
+	Hop    *Hop
+	OnNode func(node *TunnelNode) error // 节点注册，返回错误拒绝；节点断开后Done关闭
+}
+
+// TunnelNode 已注册的节点
+type TunnelNode struct {
+	Name string   // 节点注册的名称
+	Addr net.Addr // 节点地址
+
+	s     *muxSession
+	ready chan struct{}
+}
+
+// Serve 接受节点连接
+func (o *TunnelServer) Serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go o.ServeConn(conn)
+	}
+}
+
+// ServeConn 处理一个节点连接，节点断开时返回
+func (o *TunnelServer) ServeConn(conn net.Conn) {
+	defer conn.Close()
+
+	prefix := make([]byte, 1)
+	if _, err := io.ReadFull(conn, prefix); err != nil || !o.Hop.accepts(prefix[0]) {
+		return
+	}
+	conn.SetDeadline(time.Now().Add(muxDialTimeout))
+	pc := &proxyConn{Conn: conn, prefix: prefix}
+	var secure net.Conn
+	if prefix[0] == hopMagic {
+		var err error
+		if secure, err = hopServer(pc, o.Hop.PSK); err != nil {
+			return
+		}
+	} else {
+		tc := tls.Server(pc, o.Hop.TLS)
+		if err := tc.Handshake(); err != nil {
+			return
+		}
+		secure = tc
+	}
+
+	var meta hopMeta
+	if err := readHopFrame(secure, &meta); err != nil {
+		return
+	}
+	if meta.Tunnel == "" {
+		writeHopFrame(secure, &hopReply{Error: "tunnel name required"})
+		return
+	}
+
+	s := &muxSession{conn: secure, client: true, local: conn.LocalAddr(), remote: conn.RemoteAddr(), keepAlive: o.Hop.keepAlive()}
+	s.init()
+	node := &TunnelNode{Name: meta.Tunnel, Addr: conn.RemoteAddr(), s: s, ready: make(chan struct{})}
+	if o.OnNode != nil {
+		if err := o.OnNode(node); err != nil {
+			writeHopFrame(secure, &hopReply{Error: err.Error()})
+			s.Close()
+			return
+		}
+	}
+	if err := writeHopFrame(secure, &hopReply{Mux: true}); err != nil {
+		s.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	s.run()
+	close(node.ready)
+	<-s.done
+}
+
+// Open 打开到节点的流，client为公网客户端地址，节点按入站代理处理
+func (o *TunnelNode) Open(client net.Addr) (net.Conn, error) {
+	select {
+	case <-o.ready:
+	case <-o.s.done:
+		return nil, io.ErrClosedPipe
+	}
+	meta := &hopMeta{}
+	if client != nil {
+		meta.Client = client.String()
+	}
+	return o.s.open(meta, time.Now().Add(muxDialTimeout))
+}
+
+// Done 节点断开时关闭
+func (o *TunnelNode) Done() <-chan struct{} {
+	return o.s.done
+}
+
+// Close 断开节点
+func (o *TunnelNode) Close() error {
+	return o.s.Close()
+}
+
+// TunnelClient 反向隧道节点端
+type TunnelClient struct {
+	Hop   *Hop                // PSK或TLS，nil时地址需要带psk参数
+	Serve func(conn net.Conn) // 处理服务端转来的客户端连接，RemoteAddr为公网客户端地址，返回时关闭连接
+}
+
+// Run 连接服务端 pproxy://host:port 或 pproxys://host:port 并注册name，断开时返回，调用方负责重连
+func (o *TunnelClient) Run(addr, name string) error {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return err
+	}
+	hop := o.Hop
+	if hop == nil {
+		hop = defaultHop
+	}
+
+	pp := &PProxy{Hop: o.Hop, deadline: time.Now().Add(muxDialTimeout)}
+	conn, err := pp.hopDial(nil, u)
+	if err != nil {
+		return err
+	}
+	reply, err := hopRequest(conn, &hopMeta{Tunnel: name})
+	if err == nil && reply.Error != "" {
+		err = errors.New("pproxy tunnel: " + reply.Error)
+	}
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+
+	s := &muxSession{conn: conn, local: conn.LocalAddr(), remote: conn.RemoteAddr(), keepAlive: hop.keepAlive()}
+	s.onStream = func(st *muxStream, meta *hopMeta) {
+		defer st.Close()
+		if st.writeReply(&hopReply{}) != nil {
+			return
+		}
+		var c net.Conn = st
+		if addr, err := net.ResolveTCPAddr("tcp", meta.Client); err == nil {
+			c = &proxyConn{Conn: st, remote: addr}
+		}
+		o.Serve(c)
+	}
+	s.start()
+	<-s.done
+	return nil
+}
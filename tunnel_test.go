@@ -0,0 +1,104 @@
+package pproxy
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// go test pproxy -run Test_Tunnel -v -count=1
+func Test_Tunnel(t *testing.T) {
+	echo := startEcho(t)
+	hop := &Hop{PSK: []byte("secret")}
+
+	// 服务端为每个节点开放一个公网端口
+	public := make(chan string, 1)
+	nodes := make(chan *TunnelNode, 1)
+	server := &TunnelServer{Hop: hop, OnNode: func(node *TunnelNode) error {
+		if node.Name != "node1" {
+			return errors.New("unknown node")
+		}
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return err
+		}
+		go func() {
+			<-node.Done()
+			ln.Close()
+		}()
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				go func(conn net.Conn) {
+					defer conn.Close()
+					st, err := node.Open(conn.RemoteAddr())
+					if err != nil {
+						return
+					}
+					defer st.Close()
+					CopyHelper(conn, st)
+				}(conn)
+			}
+		}()
+		public <- ln.Addr().String()
+		nodes <- node
+		return nil
+	}}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go server.Serve(ln)
+
+	// 节点按代理处理转来的连接
+	sessions := make(chan *Session, 1)
+	pi := &recordChoose{chosen: sessions}
+	client := &TunnelClient{Hop: hop, Serve: func(conn net.Conn) {
+		pp := &PProxy{Client: conn, PI: pi}
+		newConn, err := pp.Handshake()
+		if err != nil {
+			return
+		}
+		defer newConn.Close()
+		CopyHelper(conn, newConn)
+	}}
+	done := make(chan error, 1)
+	go func() { done <- client.Run("pproxy://"+ln.Addr().String(), "node1") }()
+
+	addr := <-public
+	node := <-nodes
+	for i := 0; i < 3; i++ {
+		if err := connectEcho(addr, echo); err != nil {
+			t.Fatal(err)
+		}
+		s := <-sessions
+		if s.Protocol != "http" || s.Target != echo || s.ClientAddr == node.Addr.String() {
+			t.Fatal(s)
+		}
+	}
+
+	// 服务端断开节点
+	node.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 3):
+		t.Fatal("node not closed")
+	}
+	if err := connectEcho(addr, echo); err == nil {
+		t.Fatal("want error")
+	}
+
+	// 拒绝注册
+	if err := client.Run("pproxy://"+ln.Addr().String(), "node2"); err == nil || !strings.Contains(err.Error(), "unknown node") {
+		t.Fatal(err)
+	}
+	if err := client.Run("pproxy://"+ln.Addr().String()+"?psk=bad", "node1"); err == nil {
+		t.Fatal("want error")
+	}
+}
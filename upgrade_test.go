@@ -0,0 +1,65 @@
+package pproxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// 启动WebSocket风格的服务器，升级后echo
+func startUpgradeEcho(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "websocket" || r.Header.Get("Connection") != "Upgrade" || r.Header.Get("Proxy-Authorization") != "" {
+			http.Error(w, "bad upgrade", http.StatusBadRequest)
+			return
+		}
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+		rw.Flush()
+		io.Copy(conn, rw)
+	}))
+	return ln.Addr().String()
+}
+
+// go test pproxy -run Test_Upgrade -v -count=1
+func Test_Upgrade(t *testing.T) {
+	ws := startUpgradeEcho(t)
+	p2 := startProxy(t, &allowAll{}, nil)
+
+	for _, level2 := range []string{"", "http://a:b@" + p2} {
+		p1 := startProxy(t, &allowAll{level2: level2}, nil)
+
+		conn, err := net.Dial("tcp", p1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(time.Second * 3))
+		conn.Write([]byte("GET http://" + ws + "/ws HTTP/1.1\r\nHost: " + ws + "\r\nConnection: keep-alive, Upgrade\r\nUpgrade: websocket\r\nProxy-Authorization: Basic eDp5\r\n\r\nping"))
+
+		r := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatal(level2, err)
+		}
+		if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Upgrade") != "websocket" {
+			t.Fatal(level2, resp.Status, resp.Header)
+		}
+		conn.Write([]byte("pong"))
+		bs := make([]byte, 8)
+		if _, err = io.ReadFull(r, bs); err != nil || string(bs) != "pingpong" {
+			t.Fatal(level2, err, string(bs))
+		}
+		conn.Close()
+	}
+}
@@ -0,0 +1,140 @@
+package pproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// UpstreamDialer 二级代理协议，经二级代理u连接target
+// conn为链式二级代理中上一个二级代理已经连到u的连接，为nil时用UpstreamConn连接u.Host
+// 返回错误时调用方会关闭conn
+type UpstreamDialer interface {
+	DialUpstream(ctx context.Context, conn net.Conn, u *url.URL, target string) (net.Conn, error)
+}
+
+// UpstreamDialerFunc 函数形式的UpstreamDialer
+type UpstreamDialerFunc func(ctx context.Context, conn net.Conn, u *url.URL, target string) (net.Conn, error)
+
+// DialUpstream ...
+func (f UpstreamDialerFunc) DialUpstream(ctx context.Context, conn net.Conn, u *url.URL, target string) (net.Conn, error) {
+	return f(ctx, conn, u, target)
+}
+
+var upstreams sync.Map // scheme => UpstreamDialer
+
+// RegisterUpstream 注册二级代理协议，scheme不区分大小写，已存在时覆盖，d为nil时删除
+// 内置 http https socks5 socks5h ss pproxy pproxys；https 与二级代理TLS握手后按http，证书按PProxy.UpstreamTLS校验
+func RegisterUpstream(scheme string, d UpstreamDialer) {
+	scheme = strings.ToLower(scheme)
+	if d == nil {
+		upstreams.Delete(scheme)
+		return
+	}
+	upstreams.Store(scheme, d)
+}
+
+func init() {
+	RegisterUpstream("http", builtinUpstream((*PProxy).httpLevel2))
+	RegisterUpstream("https", builtinUpstream((*PProxy).httpLevel2))
+	RegisterUpstream("socks5", builtinUpstream((*PProxy).socks5Level2))
+	RegisterUpstream("socks5h", builtinUpstream((*PProxy).socks5Level2))
+	RegisterUpstream("ss", builtinUpstream((*PProxy).ssLevel2))
+	RegisterUpstream("pproxy", builtinUpstream((*PProxy).hopLevel2))
+	RegisterUpstream("pproxys", builtinUpstream((*PProxy).hopLevel2))
+}
+
+// 传给内置二级代理协议的会话状态
+type upstreamKey struct{}
+
+type upstreamState struct {
+	pp   *PProxy
+	info *httpProxyInfo
+}
+
+// 内置二级代理协议，不经PProxy调用时使用默认设置和ctx的截止时间
+func builtinUpstream(f func(o *PProxy, info *httpProxyInfo, u *url.URL, conn net.Conn) (net.Conn, error)) UpstreamDialer {
+	return UpstreamDialerFunc(func(ctx context.Context, conn net.Conn, u *url.URL, target string) (net.Conn, error) {
+		if s, ok := ctx.Value(upstreamKey{}).(*upstreamState); ok {
+			return f(s.pp, s.info, u, conn)
+		}
+		return f(upstreamPProxy(ctx), connectInfo(target), u, conn)
+	})
+}
+
+// 不经PProxy调用时使用默认设置和ctx
+func upstreamPProxy(ctx context.Context) *PProxy {
+	pp := &PProxy{ctx: ctx}
+	if d, ok := ctx.Deadline(); ok {
+		pp.deadline = d
+	}
+	return pp
+}
+
+// UpstreamConn 在UpstreamDialer中连接二级代理u.Host，和内置协议一样使用会话的出口地址、
+// 发送PROXY头（?proxy=v1|v2）、通知EventUpstreamDialed，ctx为DialUpstream收到的ctx
+func UpstreamConn(ctx context.Context, u *url.URL) (net.Conn, error) {
+	pp := upstreamPProxy(ctx)
+	if s, ok := ctx.Value(upstreamKey{}).(*upstreamState); ok {
+		pp = s.pp
+	}
+	return pp.upstreamConn(nil, u)
+}
+
+// 经注册的二级代理协议连接，conn为链式中上一个二级代理建立的连接
+func (o *PProxy) dialUpstream(info *httpProxyInfo, newAuth string, conn net.Conn) (net.Conn, error) {
+	u, err := url.Parse(newAuth)
+	if err != nil {
+		return nil, err
+	}
+	d, ok := upstreams.Load(u.Scheme)
+	if !ok {
+		return nil, errors.New("unknown level2 protocol")
+	}
+
+	ctx := context.WithValue(o.context(), upstreamKey{}, &upstreamState{pp: o, info: info})
+	if !o.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, o.deadline)
+		defer cancel()
+	}
+	return d.(UpstreamDialer).DialUpstream(ctx, conn, u, info.uri)
+}
+
+// 二级代理的连接：链式时使用上一个二级代理的连接，否则连接二级代理，然后按需发送PROXY头
+func (o *PProxy) upstreamConn(conn net.Conn, u *url.URL) (net.Conn, error) {
+	if conn == nil {
+		addr, err := upstreamHost(u)
+		if err != nil {
+			return nil, err
+		}
+		if conn, err = o.dialTCP(addr); err != nil {
+			return nil, err
+		}
+	}
+	if err := o.writeProxyHeader(conn, u); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// https://二级代理，PROXY头之后TLS握手
+	if u.Scheme == "https" {
+		cfg := &tls.Config{}
+		if o.UpstreamTLS != nil {
+			cfg = o.UpstreamTLS.Clone()
+		}
+		if cfg.ServerName == "" {
+			cfg.ServerName = u.Hostname()
+		}
+		tc := tls.Client(conn, cfg)
+		if err := tc.HandshakeContext(o.context()); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tc
+	}
+	return conn, nil
+}
@@ -0,0 +1,125 @@
+package pproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// go test pproxy -run Test_Upstream -v -count=1
+func Test_Upstream(t *testing.T) {
+	echo := startEcho(t)
+	ps := startProxy(t, &allowAll{}, nil)
+
+	// 自定义协议：直接连接u.Host，链式时使用上一个二级代理的连接
+	type call struct {
+		chained bool
+		target  string
+	}
+	calls := make(chan call, 1)
+	RegisterUpstream("TEST", UpstreamDialerFunc(func(ctx context.Context, conn net.Conn, u *url.URL, target string) (net.Conn, error) {
+		calls <- call{conn != nil, target}
+		if conn != nil {
+			return conn, nil
+		}
+		return UpstreamConn(ctx, u)
+	}))
+	defer RegisterUpstream("test", nil)
+
+	for _, c := range []struct {
+		level2  string
+		chained bool
+		first   string // 第一个连接的地址
+	}{
+		{"test://" + echo, false, echo},
+		{"socks5://a:b@" + ps + ">test://" + echo, true, ps},
+	} {
+		dialed := make(chan string, 2)
+		proxy := startProxy(t, &allowAll{level2: c.level2}, func(pp *PProxy) {
+			pp.Observer = ObserverFunc(func(e *Event) {
+				if e.Type == EventUpstreamDialed {
+					dialed <- e.Addr
+				}
+			})
+		})
+		if err := connectEcho(proxy, echo); err != nil {
+			t.Fatal(c.level2, err)
+		}
+		if r := <-calls; r.chained != c.chained || r.target != echo {
+			t.Fatal(c.level2, r)
+		}
+		// UpstreamConn和内置协议一样通知连接事件
+		if addr := <-dialed; addr != c.first {
+			t.Fatal(c.level2, "EventUpstreamDialed:", addr)
+		}
+	}
+
+	// https与二级代理TLS握手后按http，证书不可信或二级代理不是TLS时失败，不退回明文
+	ca, roots := testCA(t)
+	interceptor, err := NewInterceptor(ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := interceptor.cert("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions := make(chan *Session, 1)
+	tp := startProxy(t, &recordChoose{chosen: sessions}, func(pp *PProxy) {
+		pp.TLS = &tls.Config{Certificates: []tls.Certificate{*cert}}
+	})
+	trusted := func(pp *PProxy) { pp.UpstreamTLS = &tls.Config{RootCAs: roots} }
+	if err := connectEcho(startProxy(t, &allowAll{level2: "https://a:b@" + tp}, trusted), echo); err != nil {
+		t.Fatal(err)
+	}
+	if s := <-sessions; s.User != "a" || s.Protocol != "http+tls" {
+		t.Fatal(s.User, s.Protocol)
+	}
+	if err := connectEcho(startProxy(t, &allowAll{level2: "https://a:b@" + tp}, nil), echo); err == nil {
+		t.Fatal("want error: untrusted certificate")
+	}
+	reqs := make(chan *http.Request, 1)
+	plain := startConnectProxy(t, []string{connected}, reqs)
+	if err := connectEcho(startProxy(t, &allowAll{level2: "https://a:b@" + plain}, trusted), echo); err == nil {
+		t.Fatal("want error: plaintext level2")
+	}
+	select {
+	case req := <-reqs:
+		t.Fatal("plaintext CONNECT:", req.Header)
+	default:
+	}
+	if addr, _ := upstreamAddr("https://a:b@h"); addr != "h:443" {
+		t.Fatal(addr)
+	}
+
+	// 未注册的协议
+	if _, err := NewDialer("nope://"+echo).Dial("tcp", echo); err == nil || !strings.Contains(err.Error(), "unknown level2 protocol") {
+		t.Fatal(err)
+	}
+	RegisterUpstream("test", nil)
+	if _, err := NewDialer("test://"+echo).Dial("tcp", echo); err == nil {
+		t.Fatal("want error")
+	}
+
+	// 内置协议不经PProxy调用
+	d, ok := upstreams.Load("socks5")
+	if !ok {
+		t.Fatal("socks5 not registered")
+	}
+	u, _ := url.Parse("socks5://a:b@" + ps)
+	conn, err := d.(UpstreamDialer).DialUpstream(context.Background(), nil, u, echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("ping"))
+	bs := make([]byte, 4)
+	if _, err = io.ReadFull(conn, bs); err != nil || string(bs) != "ping" {
+		t.Fatal(err, string(bs))
+	}
+}